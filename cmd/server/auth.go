@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Every /api/v1/files request carries a bearer JWT. The middleware validates it and
+// stores the caller's Principal in the gin context; handlers take the caller's identity
+// from there and never from request parameters.
+//
+//	JWT_SECRET           HS256 shared secret
+//	JWT_PUBLIC_KEY_FILE  PEM RSA public key for RS256
+//	JWT_JWKS_URL         JWKS endpoint for RS256 keys, refreshed every JWT_JWKS_REFRESH (default 10m)
+//	JWT_JWKS_FILE        JWKS document on disk, as an alternative to the URL
+//	JWT_ISSUER           required iss claim (optional)
+//	JWT_AUDIENCE         required aud claim (optional)
+//
+// At least one key source must be configured.
+
+const (
+	principalContextKey = "principal"
+	jwtLeeway           = 30 * time.Second
+	// An unknown kid triggers a JWKS refetch at most this often
+	jwksMinRefetchInterval = time.Minute
+)
+
+// Principal is the authenticated caller
+type Principal struct {
+	UserID string
+	// Roles are service-wide, e.g. "admin"
+	Roles []string
+	// Workspaces maps each workspace the caller belongs to onto their role in it
+	Workspaces map[string]string
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkspaceRole returns the caller's role in a workspace and whether they are a member
+func (p *Principal) WorkspaceRole(workspaceID string) (string, bool) {
+	role, ok := p.Workspaces[workspaceID]
+	return role, ok
+}
+
+// accessClaims is the token payload: sub is the user ID, workspaces maps workspace IDs to roles
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Roles      []string          `json:"roles"`
+	Workspaces map[string]string `json:"workspaces"`
+}
+
+type tokenVerifier struct {
+	hmacSecret []byte
+	rsaKey     *rsa.PublicKey
+	jwks       *jwksCache
+	parser     *jwt.Parser
+}
+
+var verifier *tokenVerifier
+
+func initAuth(ctx context.Context) {
+	v := &tokenVerifier{}
+	var methods []string
+	if secret := getEnv("JWT_SECRET", ""); secret != "" {
+		v.hmacSecret = []byte(secret)
+		methods = append(methods, "HS256")
+	}
+	if path := getEnv("JWT_PUBLIC_KEY_FILE", ""); path != "" {
+		pemData, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read JWT public key: %v", err)
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(pemData)
+		if err != nil {
+			log.Fatalf("Invalid JWT public key: %v", err)
+		}
+		v.rsaKey = key
+	}
+	if url, path := getEnv("JWT_JWKS_URL", ""), getEnv("JWT_JWKS_FILE", ""); url != "" || path != "" {
+		refresh, err := time.ParseDuration(getEnv("JWT_JWKS_REFRESH", "10m"))
+		if err != nil || refresh <= 0 {
+			refresh = 10 * time.Minute
+		}
+		v.jwks = &jwksCache{url: url, path: path}
+		if err := v.jwks.load(ctx); err != nil {
+			log.Fatalf("Failed to load JWKS: %v", err)
+		}
+		if url != "" {
+			go v.jwks.refreshLoop(ctx, refresh)
+		}
+	}
+	if v.rsaKey != nil || v.jwks != nil {
+		methods = append(methods, "RS256")
+	}
+	if len(methods) == 0 {
+		log.Fatal("No JWT key configured: set JWT_SECRET, JWT_PUBLIC_KEY_FILE, JWT_JWKS_URL or JWT_JWKS_FILE")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithExpirationRequired(),
+	}
+	if iss := getEnv("JWT_ISSUER", ""); iss != "" {
+		opts = append(opts, jwt.WithIssuer(iss))
+	}
+	if aud := getEnv("JWT_AUDIENCE", ""); aud != "" {
+		opts = append(opts, jwt.WithAudience(aud))
+	}
+	v.parser = jwt.NewParser(opts...)
+	verifier = v
+}
+
+// verify parses and validates a token, returning the caller it identifies
+func (v *tokenVerifier) verify(ctx context.Context, tokenString string) (*Principal, error) {
+	var claims accessClaims
+	_, err := v.parser.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.Alg() {
+		case "HS256":
+			return v.hmacSecret, nil
+		case "RS256":
+			kid, _ := t.Header["kid"].(string)
+			if v.jwks != nil && (kid != "" || v.rsaKey == nil) {
+				return v.jwks.key(ctx, kid)
+			}
+			return v.rsaKey, nil
+		}
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	if claims.Workspaces == nil {
+		claims.Workspaces = map[string]string{}
+	}
+	return &Principal{UserID: claims.Subject, Roles: claims.Roles, Workspaces: claims.Workspaces}, nil
+}
+
+// authMiddleware rejects requests without a valid bearer token. Routes in publicRoutes
+// are let through anonymously, but still get a principal when a valid token is sent.
+func authMiddleware(publicRoutes ...string) gin.HandlerFunc {
+	public := make(map[string]bool, len(publicRoutes))
+	for _, route := range publicRoutes {
+		public[route] = true
+	}
+	return func(c *gin.Context) {
+		token := bearerToken(c.GetHeader("Authorization"))
+		if token == "" {
+			if public[c.FullPath()] {
+				c.Next()
+				return
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="file-service"`)
+			c.AbortWithStatusJSON(401, gin.H{"error": "authentication required"})
+			return
+		}
+		principal, err := verifier.verify(c.Request.Context(), token)
+		if err != nil {
+			log.WithField("path", c.Request.URL.Path).Debugf("Rejected token: %v", err)
+			c.Header("WWW-Authenticate", `Bearer realm="file-service", error="invalid_token"`)
+			c.AbortWithStatusJSON(401, gin.H{"error": "invalid token"})
+			return
+		}
+		c.Set(principalContextKey, principal)
+		c.Next()
+	}
+}
+
+func bearerToken(header string) string {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// currentPrincipal is the authenticated caller, or nil on an anonymous public route
+func currentPrincipal(c *gin.Context) *Principal {
+	if v, ok := c.Get(principalContextKey); ok {
+		return v.(*Principal)
+	}
+	return nil
+}
+
+// currentUserID is the authenticated caller's user ID, or "" if anonymous
+func currentUserID(c *gin.Context) string {
+	if p := currentPrincipal(c); p != nil {
+		return p.UserID
+	}
+	return ""
+}
+
+// ── JWKS ──
+
+type jwksCache struct {
+	url  string
+	path string
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// key returns the RSA key with the given kid, refetching the set once if it is unknown
+// so that rotated keys are picked up before the next scheduled refresh
+func (j *jwksCache) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.mu.RLock()
+	key, ok := j.lookup(kid)
+	stale := time.Since(j.lastFetched) > jwksMinRefetchInterval
+	j.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if j.url != "" && stale {
+		if err := j.load(ctx); err != nil {
+			log.Warnf("Failed to refresh JWKS: %v", err)
+		}
+		j.mu.RLock()
+		key, ok = j.lookup(kid)
+		j.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup finds a key by kid; a token without a kid matches a set holding a single key
+func (j *jwksCache) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" {
+		if len(j.keys) == 1 {
+			for _, key := range j.keys {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *jwksCache) load(ctx context.Context) error {
+	var data []byte
+	var err error
+	if j.url != "" {
+		data, err = fetchJWKS(ctx, j.url)
+	} else {
+		data, err = os.ReadFile(j.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parse JWKS: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			log.Warnf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS contains no usable RS256 keys")
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.lastFetched = time.Now()
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *jwksCache) refreshLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.load(ctx); err != nil {
+				// Keep serving the last good key set
+				log.Warnf("Failed to refresh JWKS: %v", err)
+			}
+		}
+	}
+}
+
+func fetchJWKS(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+	if len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	exp := 0
+	for _, b := range e {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
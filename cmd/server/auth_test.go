@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// setupAuth configures the package verifier from env, which is applied on top of
+// empty JWT_* settings
+func setupAuth(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range []string{"JWT_SECRET", "JWT_PUBLIC_KEY_FILE", "JWT_JWKS_URL", "JWT_JWKS_FILE", "JWT_ISSUER", "JWT_AUDIENCE"} {
+		t.Setenv(name, env[name])
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	previous := verifier
+	t.Cleanup(func() {
+		cancel()
+		verifier = previous
+	})
+	initAuth(ctx)
+}
+
+var (
+	testRSAKeysOnce sync.Once
+	testRSAKeys     [2]*rsa.PrivateKey
+)
+
+func testRSAKey(t *testing.T, i int) *rsa.PrivateKey {
+	testRSAKeysOnce.Do(func() {
+		for n := range testRSAKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				panic(err)
+			}
+			testRSAKeys[n] = key
+		}
+	})
+	return testRSAKeys[i]
+}
+
+func jwkFor(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// fakeJWKS serves the keys currently in *keys and counts the fetches
+func fakeJWKS(t *testing.T, keys *atomic.Value) (string, *atomic.Int32) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys.Load()})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &fetches
+}
+
+func claimsFor(sub string, issued time.Time, ttl time.Duration) accessClaims {
+	return accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   sub,
+			IssuedAt:  jwt.NewNumericDate(issued),
+			NotBefore: jwt.NewNumericDate(issued),
+			ExpiresAt: jwt.NewNumericDate(issued.Add(ttl)),
+		},
+		Roles:      []string{"user"},
+		Workspaces: map[string]string{"ws1": workspaceRoleMember},
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.Claims, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifyHS256(t *testing.T) {
+	setupAuth(t, map[string]string{"JWT_SECRET": "shared-secret"})
+	now := time.Now()
+	hs := func(claims jwt.Claims) string {
+		return signToken(t, jwt.SigningMethodHS256, "", claims, []byte("shared-secret"))
+	}
+	noExpiry := claimsFor("u1", now, time.Hour)
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", hs(claimsFor("u1", now, time.Hour)), true},
+		{"within leeway", hs(claimsFor("u1", now.Add(-time.Hour), time.Hour-10*time.Second)), true},
+		{"expired", hs(claimsFor("u1", now.Add(-2*time.Hour), time.Hour)), false},
+		{"not yet valid", hs(claimsFor("u1", now.Add(time.Hour), time.Hour)), false},
+		{"no expiry", hs(noExpiry), false},
+		{"no subject", hs(claimsFor("", now, time.Hour)), false},
+		{"wrong secret", signToken(t, jwt.SigningMethodHS256, "", claimsFor("u1", now, time.Hour), []byte("guess")), false},
+		{"alg none", signToken(t, jwt.SigningMethodNone, "", claimsFor("u1", now, time.Hour), jwt.UnsafeAllowNoneSignatureType), false},
+		{"rs256 not configured", signToken(t, jwt.SigningMethodRS256, "", claimsFor("u1", now, time.Hour), testRSAKey(t, 0)), false},
+		{"garbage", "not.a.token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := verifier.verify(context.Background(), tt.token)
+			if (err == nil) != tt.ok {
+				t.Fatalf("verify = %+v, %v; want ok=%v", p, err, tt.ok)
+			}
+			if tt.ok && (p.UserID != "u1" || p.Workspaces["ws1"] != workspaceRoleMember) {
+				t.Fatalf("principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestVerifyRS256JWKS(t *testing.T) {
+	k1, k2 := testRSAKey(t, 0), testRSAKey(t, 1)
+	var keys atomic.Value
+	keys.Store([]jsonWebKey{jwkFor("k1", &k1.PublicKey)})
+	url, fetches := fakeJWKS(t, &keys)
+	setupAuth(t, map[string]string{"JWT_JWKS_URL": url})
+	if fetches.Load() != 1 {
+		t.Fatalf("%d fetches at startup", fetches.Load())
+	}
+	now := time.Now()
+	rs := func(kid string, key *rsa.PrivateKey) string {
+		return signToken(t, jwt.SigningMethodRS256, kid, claimsFor("u1", now, time.Hour), key)
+	}
+
+	if _, err := verifier.verify(context.Background(), rs("k1", k1)); err != nil {
+		t.Fatalf("valid RS256 token: %v", err)
+	}
+	if _, err := verifier.verify(context.Background(), rs("", k1)); err != nil {
+		t.Fatalf("token without kid against a single-key set: %v", err)
+	}
+	if _, err := verifier.verify(context.Background(), rs("k1", k2)); err == nil {
+		t.Fatal("token signed with another key was accepted")
+	}
+	expired := signToken(t, jwt.SigningMethodRS256, "k1", claimsFor("u1", now.Add(-2*time.Hour), time.Hour), k1)
+	if _, err := verifier.verify(context.Background(), expired); err == nil {
+		t.Fatal("expired RS256 token was accepted")
+	}
+	if fetches.Load() != 1 {
+		t.Fatalf("known kids caused %d fetches", fetches.Load())
+	}
+
+	// The issuer rotates to k2; a token naming it triggers one refetch
+	keys.Store([]jsonWebKey{jwkFor("k1", &k1.PublicKey), jwkFor("k2", &k2.PublicKey)})
+	verifier.jwks.lastFetched = time.Now().Add(-2 * jwksMinRefetchInterval)
+	if _, err := verifier.verify(context.Background(), rs("k2", k2)); err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	if fetches.Load() != 2 {
+		t.Fatalf("unknown kid caused %d fetches, want one refetch", fetches.Load()-1)
+	}
+	if _, err := verifier.verify(context.Background(), rs("k2", k2)); err != nil || fetches.Load() != 2 {
+		t.Fatalf("second k2 token: %v, %d fetches", err, fetches.Load())
+	}
+
+	// Unknown kids can't be used to hammer the issuer
+	verifier.jwks.lastFetched = time.Now().Add(-2 * jwksMinRefetchInterval)
+	for i := 0; i < 3; i++ {
+		if _, err := verifier.verify(context.Background(), rs("k9", k2)); err == nil {
+			t.Fatal("token with an unknown kid was accepted")
+		}
+	}
+	if fetches.Load() != 3 {
+		t.Fatalf("repeated unknown kids caused %d fetches, want 1", fetches.Load()-2)
+	}
+}
+
+func TestVerifyAlgorithmConfusion(t *testing.T) {
+	key := testRSAKey(t, 0)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	claims := claimsFor("attacker", time.Now(), time.Hour)
+	forged := signToken(t, jwt.SigningMethodHS256, "", claims, pemData)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"rs256 only", map[string]string{"JWT_PUBLIC_KEY_FILE": path}},
+		{"rs256 and hs256", map[string]string{"JWT_PUBLIC_KEY_FILE": path, "JWT_SECRET": "shared-secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupAuth(t, tt.env)
+			if p, err := verifier.verify(context.Background(), forged); err == nil {
+				t.Fatalf("HS256 token signed with the RSA public key was accepted as %+v", p)
+			}
+			genuine := signToken(t, jwt.SigningMethodRS256, "", claims, key)
+			if _, err := verifier.verify(context.Background(), genuine); err != nil {
+				t.Fatalf("genuine RS256 token: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIssuerAndAudience(t *testing.T) {
+	setupAuth(t, map[string]string{"JWT_SECRET": "shared-secret", "JWT_ISSUER": "auth.example", "JWT_AUDIENCE": "files"})
+	claims := claimsFor("u1", time.Now(), time.Hour)
+	if _, err := verifier.verify(context.Background(), signToken(t, jwt.SigningMethodHS256, "", claims, []byte("shared-secret"))); err == nil {
+		t.Fatal("token without iss and aud was accepted")
+	}
+	claims.Issuer, claims.Audience = "auth.example", jwt.ClaimStrings{"files"}
+	if _, err := verifier.verify(context.Background(), signToken(t, jwt.SigningMethodHS256, "", claims, []byte("shared-secret"))); err != nil {
+		t.Fatalf("token with iss and aud: %v", err)
+	}
+}
+
+func TestAuthMiddlewarePrincipal(t *testing.T) {
+	setupAuth(t, map[string]string{"JWT_SECRET": "shared-secret"})
+	var got *Principal
+	r := gin.New()
+	r.Use(authMiddleware("/public"))
+	handler := func(c *gin.Context) {
+		got = currentPrincipal(c)
+		c.Status(204)
+	}
+	r.GET("/private", handler)
+	r.GET("/public", handler)
+
+	claims := claimsFor("u1", time.Now(), time.Hour)
+	claims.Roles = []string{roleServiceAdmin}
+	token := signToken(t, jwt.SigningMethodHS256, "", claims, []byte("shared-secret"))
+	send := func(path, authorization string) int {
+		got = nil
+		req := httptest.NewRequest("GET", path+"?user_id=mallory&workspace_id=ws9", nil)
+		req.Header.Set("X-User-ID", "mallory")
+		req.Header.Set("X-User-Roles", "admin")
+		req.Header.Set("X-Workspace-ID", "ws9")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send("/private", "Bearer "+token); code != 204 {
+		t.Fatalf("status %d", code)
+	}
+	want := &Principal{UserID: "u1", Roles: []string{roleServiceAdmin}, Workspaces: map[string]string{"ws1": workspaceRoleMember}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("principal %+v, want %+v", got, want)
+	}
+
+	if code := send("/private", ""); code != 401 || got != nil {
+		t.Fatalf("no token: status %d, principal %+v", code, got)
+	}
+	if code := send("/private", "Bearer "+token+"x"); code != 401 || got != nil {
+		t.Fatalf("bad token: status %d, principal %+v", code, got)
+	}
+	if code := send("/public", ""); code != 204 || got != nil {
+		t.Fatalf("anonymous public route: status %d, principal %+v", code, got)
+	}
+	if code := send("/public", "Bearer "+token); code != 204 || got == nil || got.UserID != "u1" {
+		t.Fatalf("public route with token: status %d, principal %+v", code, got)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Permission is what a caller may do with a file. Each level includes the ones below it.
+type Permission int
+
+const (
+	permNone Permission = iota
+	permRead
+	permComment
+	permEdit
+	permManage // share, grant permissions, manage links
+	permOwner  // delete, restore
+)
+
+var permissionNames = map[Permission]string{
+	permNone:    "none",
+	permRead:    "read",
+	permComment: "comment",
+	permEdit:    "edit",
+	permManage:  "manage",
+	permOwner:   "owner",
+}
+
+func (p Permission) String() string { return permissionNames[p] }
+
+// parsePermission maps a FilePermission.Permission value onto its level. "write" and
+// "admin" are accepted for records granted before the hierarchy existed.
+func parsePermission(s string) (Permission, bool) {
+	switch s {
+	case "read", "view":
+		return permRead, true
+	case "comment":
+		return permComment, true
+	case "edit", "write":
+		return permEdit, true
+	case "manage", "admin":
+		return permManage, true
+	case "owner":
+		return permOwner, true
+	}
+	return permNone, false
+}
+
+// Roles carried in the token. Service admins may act on any file; workspace owners and
+// admins on any file in their workspace. Guests only see what is shared with them.
+const (
+	roleServiceAdmin    = "admin"
+	workspaceRoleOwner  = "owner"
+	workspaceRoleAdmin  = "admin"
+	workspaceRoleMember = "member"
+	workspaceRoleGuest  = "guest"
+)
+
+func (p *Principal) IsAdmin() bool {
+	return p != nil && p.HasRole(roleServiceAdmin)
+}
+
+func (p *Principal) IsWorkspaceAdmin(workspaceID string) bool {
+	if p == nil {
+		return false
+	}
+	if p.IsAdmin() {
+		return true
+	}
+	role, ok := p.WorkspaceRole(workspaceID)
+	return ok && (role == workspaceRoleOwner || role == workspaceRoleAdmin)
+}
+
+// IsWorkspaceMember reports whether the caller can see the workspace's files; guests can't
+func (p *Principal) IsWorkspaceMember(workspaceID string) bool {
+	if p == nil {
+		return false
+	}
+	if p.IsAdmin() {
+		return true
+	}
+	role, ok := p.WorkspaceRole(workspaceID)
+	return ok && role != workspaceRoleGuest
+}
+
+// memberWorkspaces lists the workspaces whose files the caller can see
+func (p *Principal) memberWorkspaces() []string {
+	ids := []string{}
+	for ws, role := range p.Workspaces {
+		if role != workspaceRoleGuest {
+			ids = append(ids, ws)
+		}
+	}
+	return ids
+}
+
+// effectivePermission resolves the caller's highest permission on a file, loading their
+// unexpired FilePermission grants for it
+func effectivePermission(ctx context.Context, p *Principal, file *File) (Permission, error) {
+	if p == nil {
+		// Anonymous callers reach files only through share links
+		return permNone, nil
+	}
+	if p.IsWorkspaceAdmin(file.WorkspaceID) || file.UploadedBy == p.UserID {
+		return permOwner, nil
+	}
+	cursor, err := permissionsCol().Find(ctx, bson.M{
+		"file_id": file.FileID,
+		"user_id": p.UserID,
+		"$or": []bson.M{
+			{"expires_at": nil},
+			{"expires_at": bson.M{"$gt": time.Now()}},
+		},
+	})
+	if err != nil {
+		return permNone, err
+	}
+	var grants []FilePermission
+	if err := cursor.All(ctx, &grants); err != nil {
+		return permNone, err
+	}
+	return permissionFor(p, file, grants, time.Now()), nil
+}
+
+// permissionFor is the permission matrix: service and workspace admins and the uploader
+// own the file; workspace members, SharedWith and IsPublic give read; explicit grants
+// that haven't expired by now can raise that to any level.
+func permissionFor(p *Principal, file *File, grants []FilePermission, now time.Time) Permission {
+	if p == nil {
+		return permNone
+	}
+	if p.IsWorkspaceAdmin(file.WorkspaceID) || file.UploadedBy == p.UserID {
+		return permOwner
+	}
+	level := permNone
+	if p.IsWorkspaceMember(file.WorkspaceID) || file.IsPublic || contains(file.SharedWith, p.UserID) {
+		level = permRead
+	}
+	for _, grant := range grants {
+		if grant.UserID != p.UserID || grant.FileID != file.FileID {
+			continue
+		}
+		if grant.ExpiresAt != nil && !grant.ExpiresAt.After(now) {
+			continue
+		}
+		if granted, ok := parsePermission(grant.Permission); ok && granted > level {
+			level = granted
+		}
+	}
+	return level
+}
+
+// authorize checks that the caller may perform action on file. Callers that cannot even
+// read the file get a 404 so its existence isn't disclosed.
+func authorize(ctx context.Context, p *Principal, file *File, action Permission) error {
+	level, err := effectivePermission(ctx, p, file)
+	if err != nil {
+		return err
+	}
+	return permissionError(level, action)
+}
+
+// permissionError is the error for a caller holding level attempting action, or nil
+func permissionError(level, action Permission) error {
+	if level < permRead {
+		return &UploadVerificationError{Status: 404, Message: "file not found"}
+	}
+	if level < action {
+		return &UploadVerificationError{Status: 403, Message: fmt.Sprintf("%s permission required", action)}
+	}
+	return nil
+}
+
+// checkFileAccess authorizes the caller on an already loaded file, writing the error
+// response and returning false if they may not perform action
+func checkFileAccess(c *gin.Context, file *File, action Permission) bool {
+	if err := authorize(c.Request.Context(), currentPrincipal(c), file, action); err != nil {
+		respondPolicyError(c, err)
+		return false
+	}
+	return true
+}
+
+// authorizedFile loads a live file by its file ID and authorizes the caller on it. On
+// failure it writes the response and returns nil.
+func authorizedFile(c *gin.Context, fileID string, action Permission) *File {
+	return authorizedFileBy(c, bson.M{"file_id": fileID}, action)
+}
+
+func authorizedFileBy(c *gin.Context, filter bson.M, action Permission) *File {
+	filter["deleted_at"] = nil
+	var file File
+	err := filesCol.FindOne(c.Request.Context(), filter).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return nil
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load file"})
+		return nil
+	}
+	if !checkFileAccess(c, &file, action) {
+		return nil
+	}
+	return &file
+}
+
+// visibleFilesFilter matches the files the caller can read; it is empty for service admins
+func visibleFilesFilter(ctx context.Context, p *Principal) (bson.M, error) {
+	if p.IsAdmin() {
+		return bson.M{}, nil
+	}
+	granted, err := permissionsCol().Distinct(ctx, "file_id", bson.M{
+		"user_id": p.UserID,
+		"$or": []bson.M{
+			{"expires_at": nil},
+			{"expires_at": bson.M{"$gt": time.Now()}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"$or": []bson.M{
+		{"uploaded_by": p.UserID},
+		{"workspace_id": bson.M{"$in": p.memberWorkspaces()}},
+		{"shared_with": p.UserID},
+		{"is_public": true},
+		{"file_id": bson.M{"$in": granted}},
+	}}, nil
+}
+
+// restrictToVisible narrows a file query to what the caller can read, writing a 500 and
+// returning false if the caller's grants can't be loaded
+func restrictToVisible(c *gin.Context, filter bson.M) bool {
+	visible, err := visibleFilesFilter(c.Request.Context(), currentPrincipal(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to resolve permissions"})
+		return false
+	}
+	if len(visible) == 0 {
+		return true
+	}
+	and, _ := filter["$and"].([]bson.M)
+	filter["$and"] = append(and, visible)
+	return true
+}
+
+// authorizedFiles loads the live files matching filter and keeps those the caller may
+// perform action on
+func authorizedFiles(c *gin.Context, filter bson.M, action Permission) ([]File, bool) {
+	ctx := c.Request.Context()
+	filter["deleted_at"] = nil
+	cursor, err := filesCol.Find(ctx, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to fetch files"})
+		return nil, false
+	}
+	var files []File
+	cursor.All(ctx, &files)
+	p := currentPrincipal(c)
+	allowed := []File{}
+	for i := range files {
+		if authorize(ctx, p, &files[i], action) == nil {
+			allowed = append(allowed, files[i])
+		}
+	}
+	return allowed, true
+}
+
+// authorizedFileIDs keeps the IDs of files the caller may perform action on, in their
+// original order
+func authorizedFileIDs(c *gin.Context, fileIDs []string, action Permission) ([]string, bool) {
+	files, ok := authorizedFiles(c, bson.M{"file_id": bson.M{"$in": fileIDs}}, action)
+	if !ok {
+		return nil, false
+	}
+	allowed := map[string]bool{}
+	for _, f := range files {
+		allowed[f.FileID] = true
+	}
+	ids := []string{}
+	for _, id := range fileIDs {
+		if allowed[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, true
+}
+
+// ── Non-file checks ──
+
+func requireWorkspaceMember(c *gin.Context, workspaceID string) bool {
+	if !currentPrincipal(c).IsWorkspaceMember(workspaceID) {
+		c.JSON(403, gin.H{"error": "not a member of this workspace"})
+		return false
+	}
+	return true
+}
+
+func requireWorkspaceAdmin(c *gin.Context, workspaceID string) bool {
+	if !currentPrincipal(c).IsWorkspaceAdmin(workspaceID) {
+		c.JSON(403, gin.H{"error": "workspace admin role required"})
+		return false
+	}
+	return true
+}
+
+func requireAdmin(c *gin.Context) bool {
+	if !currentPrincipal(c).IsAdmin() {
+		c.JSON(403, gin.H{"error": "admin role required"})
+		return false
+	}
+	return true
+}
+
+// requireSelfOrAdmin allows callers to read their own per-user data
+func requireSelfOrAdmin(c *gin.Context, userID string) bool {
+	p := currentPrincipal(c)
+	if p == nil || (p.UserID != userID && !p.IsAdmin()) {
+		c.JSON(403, gin.H{"error": "forbidden"})
+		return false
+	}
+	return true
+}
+
+// ownsUpload reports whether the caller started an upload session; other callers are
+// told the session doesn't exist
+func ownsUpload(c *gin.Context, pending *PendingUpload) bool {
+	return pending.UploadedBy == currentUserID(c)
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPermissionMatrix(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	file := File{FileID: "f1", WorkspaceID: "ws1", UploadedBy: "owner"}
+	public := file
+	public.IsPublic = true
+	shared := file
+	shared.SharedWith = []string{"guest"}
+
+	member := &Principal{UserID: "member", Workspaces: map[string]string{"ws1": workspaceRoleMember}}
+	outsider := &Principal{UserID: "outsider", Workspaces: map[string]string{"ws2": workspaceRoleMember}}
+	grant := func(user, perm string, expires *time.Time) FilePermission {
+		return FilePermission{FileID: "f1", UserID: user, Permission: perm, ExpiresAt: expires}
+	}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		file      File
+		grants    []FilePermission
+		want      Permission
+	}{
+		{"anonymous", nil, public, nil, permNone},
+		{"uploader", &Principal{UserID: "owner"}, file, nil, permOwner},
+		{"service admin", &Principal{UserID: "root", Roles: []string{roleServiceAdmin}}, file, nil, permOwner},
+		{"workspace owner", &Principal{UserID: "wo", Workspaces: map[string]string{"ws1": workspaceRoleOwner}}, file, nil, permOwner},
+		{"workspace admin", &Principal{UserID: "wa", Workspaces: map[string]string{"ws1": workspaceRoleAdmin}}, file, nil, permOwner},
+		{"admin of another workspace", &Principal{UserID: "wa", Workspaces: map[string]string{"ws2": workspaceRoleAdmin}}, file, nil, permNone},
+		{"workspace member", member, file, nil, permRead},
+		{"workspace guest", &Principal{UserID: "guest", Workspaces: map[string]string{"ws1": workspaceRoleGuest}}, file, nil, permNone},
+		{"guest in shared_with", &Principal{UserID: "guest", Workspaces: map[string]string{"ws1": workspaceRoleGuest}}, shared, nil, permRead},
+		{"non-member", outsider, file, nil, permNone},
+		{"non-member, public file", outsider, public, nil, permRead},
+		{"non-member in shared_with", &Principal{UserID: "guest"}, shared, nil, permRead},
+
+		{"read grant", outsider, file, []FilePermission{grant("outsider", "read", nil)}, permRead},
+		{"view grant", outsider, file, []FilePermission{grant("outsider", "view", nil)}, permRead},
+		{"comment grant", outsider, file, []FilePermission{grant("outsider", "comment", nil)}, permComment},
+		{"edit grant", outsider, file, []FilePermission{grant("outsider", "edit", &future)}, permEdit},
+		{"legacy write grant", outsider, file, []FilePermission{grant("outsider", "write", nil)}, permEdit},
+		{"manage grant", member, file, []FilePermission{grant("member", "manage", nil)}, permManage},
+		{"legacy admin grant", member, file, []FilePermission{grant("member", "admin", nil)}, permManage},
+		{"owner grant", member, file, []FilePermission{grant("member", "owner", nil)}, permOwner},
+		{"highest grant wins", outsider, file, []FilePermission{grant("outsider", "edit", nil), grant("outsider", "comment", nil)}, permEdit},
+		{"read grant doesn't lower", member, file, []FilePermission{grant("member", "read", nil)}, permRead},
+		{"expired grant", outsider, file, []FilePermission{grant("outsider", "edit", &past)}, permNone},
+		{"expired grant, member", member, file, []FilePermission{grant("member", "manage", &past)}, permRead},
+		{"grant expiring now", outsider, file, []FilePermission{grant("outsider", "edit", &now)}, permNone},
+		{"grant for another user", outsider, file, []FilePermission{grant("member", "edit", nil)}, permNone},
+		{"grant for another file", outsider, file, []FilePermission{{FileID: "f2", UserID: "outsider", Permission: "edit"}}, permNone},
+		{"unknown grant", outsider, file, []FilePermission{grant("outsider", "superuser", nil)}, permNone},
+	}
+
+	actions := []Permission{permRead, permComment, permEdit, permManage, permOwner}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := permissionFor(tt.principal, &tt.file, tt.grants, now)
+			if got != tt.want {
+				t.Fatalf("permission = %s, want %s", got, tt.want)
+			}
+			for _, action := range actions {
+				status := 0
+				var verr *UploadVerificationError
+				if err := permissionError(got, action); errors.As(err, &verr) {
+					status = verr.Status
+				}
+				want := 0
+				switch {
+				case tt.want < permRead:
+					want = 404
+				case tt.want < action:
+					want = 403
+				}
+				if status != want {
+					t.Errorf("%s: status %d, want %d", action, status, want)
+				}
+			}
+		})
+	}
+}
+
+// authorize settles these callers without loading grants
+func TestAuthorizeWithoutGrants(t *testing.T) {
+	file := &File{FileID: "f1", WorkspaceID: "ws1", UploadedBy: "owner", IsPublic: true}
+	tests := []struct {
+		name      string
+		principal *Principal
+		status    int
+	}{
+		{"anonymous", nil, 404},
+		{"uploader", &Principal{UserID: "owner"}, 0},
+		{"service admin", &Principal{UserID: "root", Roles: []string{roleServiceAdmin}}, 0},
+		{"workspace admin", &Principal{UserID: "wa", Workspaces: map[string]string{"ws1": workspaceRoleAdmin}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := 0
+			var verr *UploadVerificationError
+			if err := authorize(context.Background(), tt.principal, file, permOwner); errors.As(err, &verr) {
+				status = verr.Status
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a span of a blob starting at start
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// maxRanges bounds how many parts a multi-range request may ask for
+const maxRanges = 16
+
+// parseRanges parses a Range header against a blob of the given size. It returns nil
+// for a missing or unusable header, which is served as the whole blob, and
+// errRangeNotSatisfiable if no requested range overlaps the blob.
+func parseRanges(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if header == "" || !ok {
+		return nil, nil
+	}
+	var ranges []byteRange
+	var total int64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		var r byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	// Too many parts, or parts adding up to more than the blob, are cheaper sent whole
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// contentDisposition builds an inline or attachment header, encoding non-ASCII names
+func contentDisposition(inline bool, filename string) string {
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return disposition
+}
+
+// fileETag is the strong validator for a file's content: its checksum, or the storage
+// backend's ETag for files stored before checksums were recorded
+func fileETag(file *File, info *BlobInfo) string {
+	if file.Checksum != "" {
+		return `"` + file.Checksum + `"`
+	}
+	if info.ETag != "" {
+		return `"` + info.ETag + `"`
+	}
+	return ""
+}
+
+// etagMatches reports whether an If-None-Match or If-Range header lists etag
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since as RFC 9110
+// requires when both are sent
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// rangeApplies reports whether a Range header should be honoured given If-Range, which
+// only a strong ETag or the exact Last-Modified date satisfies
+func rangeApplies(r *http.Request, etag string, modified time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		return ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modified.IsZero() && modified.Truncate(time.Second).Equal(t)
+}
+
+// serveFileContent streams a file's blob with conditional GET and single or multi-range
+// support, and returns the status it sent. Inline responses are sandboxed so uploaded
+// HTML or SVG can't run script on our origin.
+func serveFileContent(c *gin.Context, file *File, inline bool) int {
+	ctx := c.Request.Context()
+	info, err := blobStore.Stat(ctx, file.StorageKey)
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(404, gin.H{"error": "file content not found"})
+		return 404
+	}
+	if err != nil {
+		log.Errorf("Failed to stat %s: %v", file.StorageKey, err)
+		c.JSON(500, gin.H{"error": "failed to read file"})
+		return 500
+	}
+
+	etag, modified := fileETag(file, info), info.LastModified
+	h := c.Writer.Header()
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	h.Set("Cache-Control", "private, no-cache")
+	if notModified(c.Request, etag, modified) {
+		c.Status(304)
+		c.Writer.WriteHeaderNow()
+		return 304
+	}
+
+	var ranges []byteRange
+	if rangeApplies(c.Request, etag, modified) {
+		if ranges, err = parseRanges(c.GetHeader("Range"), info.Size); err != nil {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			c.JSON(416, gin.H{"error": "requested range not satisfiable"})
+			return 416
+		}
+	}
+
+	contentType := file.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Disposition", contentDisposition(inline, file.OriginalName))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if inline {
+		h.Set("Content-Security-Policy", "sandbox")
+	}
+
+	switch len(ranges) {
+	case 0:
+		return sendBlob(c, file.StorageKey, nil, info.Size, contentType, 200)
+	case 1:
+		h.Set("Content-Range", ranges[0].contentRange(info.Size))
+		return sendBlob(c, file.StorageKey, &ranges[0], ranges[0].length, contentType, 206)
+	default:
+		return sendByteRanges(c, file.StorageKey, ranges, info.Size, contentType)
+	}
+}
+
+// sendBlob writes the whole blob, or one range of it
+func sendBlob(c *gin.Context, key string, rng *byteRange, length int64, contentType string, status int) int {
+	var body io.ReadCloser = http.NoBody
+	if c.Request.Method != http.MethodHead {
+		var err error
+		if rng != nil {
+			body, err = blobStore.GetRange(c.Request.Context(), key, rng.start, rng.length)
+		} else {
+			body, err = blobStore.Get(c.Request.Context(), key)
+		}
+		if err != nil {
+			return contentReadFailed(c, key, err)
+		}
+	}
+	defer body.Close()
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	c.Status(status)
+	c.Writer.WriteHeaderNow()
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		log.WithField("storage_key", key).Debugf("Content stream ended early: %v", err)
+	}
+	return status
+}
+
+// sendByteRanges writes a multipart/byteranges response, fetching each part from the
+// backend as it goes
+func sendByteRanges(c *gin.Context, key string, ranges []byteRange, size int64, contentType string) int {
+	// Lay the body out once without content to learn its length and boundary
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	for _, r := range ranges {
+		mw.CreatePart(byteRangeHeader(r, size, contentType))
+		counter += countingWriter(r.length)
+	}
+	mw.Close()
+	boundary := mw.Boundary()
+
+	c.Header("Content-Type", "multipart/byteranges; boundary="+boundary)
+	c.Header("Content-Length", strconv.FormatInt(int64(counter), 10))
+	if c.Request.Method == http.MethodHead {
+		c.Status(206)
+		c.Writer.WriteHeaderNow()
+		return 206
+	}
+
+	// Open the first part before committing to a 206 so a backend failure is still a 500
+	first, err := blobStore.GetRange(c.Request.Context(), key, ranges[0].start, ranges[0].length)
+	if err != nil {
+		return contentReadFailed(c, key, err)
+	}
+	c.Status(206)
+	c.Writer.WriteHeaderNow()
+	mw = multipart.NewWriter(c.Writer)
+	mw.SetBoundary(boundary)
+	for i, r := range ranges {
+		body := first
+		if i > 0 {
+			if body, err = blobStore.GetRange(c.Request.Context(), key, r.start, r.length); err != nil {
+				log.WithField("storage_key", key).Warnf("Failed to read range: %v", err)
+				return 206
+			}
+		}
+		part, _ := mw.CreatePart(byteRangeHeader(r, size, contentType))
+		_, err := io.Copy(part, body)
+		body.Close()
+		if err != nil {
+			log.WithField("storage_key", key).Debugf("Content stream ended early: %v", err)
+			return 206
+		}
+	}
+	mw.Close()
+	return 206
+}
+
+func byteRangeHeader(r byteRange, size int64, contentType string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+func contentReadFailed(c *gin.Context, key string, err error) int {
+	log.Errorf("Failed to read %s: %v", key, err)
+	for _, h := range []string{"Content-Disposition", "Content-Range", "ETag", "Last-Modified", "Content-Security-Policy"} {
+		c.Writer.Header().Del(h)
+	}
+	c.JSON(500, gin.H{"error": "failed to read file"})
+	return 500
+}
+
+// countingWriter discards what is written to it, counting the bytes
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// getFileContent streams a file through the service, for clients that can't follow a
+// presigned URL and for media players that seek with Range requests
+func getFileContent(c *gin.Context) {
+	file := authorizedFile(c, c.Param("id"), permRead)
+	if file == nil || rejectQuarantined(c, file) {
+		return
+	}
+	status := serveFileContent(c, file, c.Query("inline") == "1")
+	if (status == 200 || status == 206) && c.Request.Method == http.MethodGet {
+		recordDownload(c, file.FileID, downloadChannelAPI, nil)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRanges(t *testing.T) {
+	const size = 10000
+	many := func(n int) string {
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = fmt.Sprintf("%d-%d", i*10, i*10+4)
+		}
+		return "bytes=" + strings.Join(parts, ",")
+	}
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{"no header", "", size, nil, nil},
+		{"first bytes", "bytes=0-499", size, []byteRange{{0, 500}}, nil},
+		{"suffix", "bytes=-500", size, []byteRange{{9500, 500}}, nil},
+		{"open-ended", "bytes=9500-", size, []byteRange{{9500, 500}}, nil},
+		{"end clamped", "bytes=9500-20000", size, []byteRange{{9500, 500}}, nil},
+		{"suffix longer than the blob", "bytes=-20000", size, []byteRange{{0, size}}, nil},
+		{"multiple", "bytes=0-0, -1", size, []byteRange{{0, 1}, {9999, 1}}, nil},
+		{"unsatisfiable part skipped", "bytes=0-9,20000-", size, []byteRange{{0, 10}}, nil},
+		{"start at size", "bytes=10000-", size, nil, errRangeNotSatisfiable},
+		{"past the end", "bytes=20000-30000", size, nil, errRangeNotSatisfiable},
+		{"empty suffix", "bytes=-0", size, nil, errRangeNotSatisfiable},
+		{"empty blob", "bytes=0-", 0, nil, errRangeNotSatisfiable},
+		{"other unit", "items=0-10", size, nil, nil},
+		{"mixed units", "bytes=0-10, items=5-", size, nil, nil},
+		{"no dash", "bytes=500", size, nil, nil},
+		{"end before start", "bytes=500-100", size, nil, nil},
+		{"not a number", "bytes=0-abc", size, nil, nil},
+		{"negative start", "bytes=--5", size, nil, nil},
+		{"maxRanges parts", many(maxRanges), size, func() []byteRange {
+			var r []byteRange
+			for i := 0; i < maxRanges; i++ {
+				r = append(r, byteRange{int64(i * 10), 5})
+			}
+			return r
+		}(), nil},
+		{"more than maxRanges parts", many(maxRanges + 1), size, nil, nil},
+		{"parts larger than the blob", "bytes=0-,0-", size, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRanges(tt.header, tt.size)
+			if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseRanges(%q) = %v, %v; want %v, %v", tt.header, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	modified := time.Date(2026, 3, 1, 12, 0, 0, 500e6, time.UTC)
+	const etag = `"abc"`
+	date := func(t time.Time) string { return t.Format(http.TimeFormat) }
+	request := func(header ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+
+	notModifiedTests := []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"unconditional", request(), false},
+		{"any", request("If-None-Match", "*"), true},
+		{"listed", request("If-None-Match", `"x", "abc"`), true},
+		{"weak match", request("If-None-Match", `W/"abc"`), true},
+		{"changed", request("If-None-Match", `"x", "y"`), false},
+		{"etag wins over date", request("If-None-Match", `"x"`, "If-Modified-Since", date(modified.Add(time.Hour))), false},
+		{"same second", request("If-Modified-Since", date(modified)), true},
+		{"modified since", request("If-Modified-Since", date(modified.Add(-time.Hour))), false},
+		{"bad date", request("If-Modified-Since", "yesterday"), false},
+	}
+	for _, tt := range notModifiedTests {
+		t.Run("If-None-Match/"+tt.name, func(t *testing.T) {
+			if got := notModified(tt.r, etag, modified); got != tt.want {
+				t.Fatalf("notModified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if notModified(request("If-Modified-Since", date(modified)), etag, time.Time{}) {
+		t.Error("If-Modified-Since matched an unknown modification time")
+	}
+
+	rangeTests := []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"no If-Range", request(), true},
+		{"current etag", request("If-Range", etag), true},
+		{"stale etag", request("If-Range", `"old"`), false},
+		{"weak etag", request("If-Range", `W/"abc"`), false},
+		{"exact date", request("If-Range", date(modified)), true},
+		{"older date", request("If-Range", date(modified.Add(-time.Hour))), false},
+		{"garbage", request("If-Range", "soon"), false},
+	}
+	for _, tt := range rangeTests {
+		t.Run("If-Range/"+tt.name, func(t *testing.T) {
+			if got := rangeApplies(tt.r, etag, modified); got != tt.want {
+				t.Fatalf("rangeApplies = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeFileContent(t *testing.T) {
+	defer func(store BlobStore) { blobStore = store }(blobStore)
+	blobStore = &localBlobStore{root: t.TempDir()}
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	file := &File{FileID: "f1", StorageKey: "files/ws1/u1/f1.txt", MimeType: "text/plain", OriginalName: "a.txt", Checksum: "sum"}
+	if err := blobStore.Put(context.Background(), file.StorageKey, bytes.NewReader(content), int64(len(content)), file.MimeType); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		for i := 0; i < len(header); i += 2 {
+			c.Request.Header.Set(header[i], header[i+1])
+		}
+		serveFileContent(c, file, false)
+		return w
+	}
+
+	if w := serve(); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) || w.Header().Get("ETag") != `"sum"` {
+		t.Fatalf("whole file: %d %q", w.Code, w.Body)
+	}
+	if w := serve("If-None-Match", `"sum"`); w.Code != 304 || w.Body.Len() != 0 {
+		t.Fatalf("If-None-Match: %d", w.Code)
+	}
+	if w := serve("Range", "bytes=-6"); w.Code != 206 || w.Body.String() != "uvwxyz" || w.Header().Get("Content-Range") != "bytes 30-35/36" {
+		t.Fatalf("single range: %d %q %s", w.Code, w.Body, w.Header().Get("Content-Range"))
+	}
+	if w := serve("Range", "bytes=0-3", "If-Range", `"stale"`); w.Code != 200 || w.Body.Len() != len(content) {
+		t.Fatalf("stale If-Range: %d", w.Code)
+	}
+	if w := serve("Range", "bytes=100-"); w.Code != 416 || w.Header().Get("Content-Range") != "bytes */36" {
+		t.Fatalf("unsatisfiable: %d %s", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	w := serve("Range", "bytes=0-3,10-12,-2")
+	if w.Code != 206 {
+		t.Fatalf("multi-range: %d", w.Code)
+	}
+	if got, _ := strconv.Atoi(w.Header().Get("Content-Length")); got != w.Body.Len() {
+		t.Fatalf("Content-Length %d, body %d bytes", got, w.Body.Len())
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-3/36", "0123"},
+		{"bytes 10-12/36", "abc"},
+		{"bytes 34-35/36", "yz"},
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for i, wp := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != wp.contentRange || string(body) != wp.body || part.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("part %d: %v %q", i, part.Header, body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected 3 parts, got more (%v)", err)
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Versions of text, CSV and JSON files can be compared line by line, row by row or
+// structurally; anything else, or anything too large to diff in memory, is compared by
+// size and checksum only. Results depend only on the two contents, so they are cached
+// per file by checksum pair.
+const (
+	maxDiffInputBytes  = 2 << 20   // per side; larger content is compared by checksum
+	maxDiffOutputBytes = 256 << 10 // unified diff text
+	maxDiffChanges     = 1000      // CSV rows or JSON paths
+	maxDiffEdits       = 1000      // beyond this, changed regions are not minimised
+	diffContextLines   = 3
+	diffCacheTTL       = 24 * time.Hour
+)
+
+const (
+	diffFormatText   = "text"
+	diffFormatCSV    = "csv"
+	diffFormatJSON   = "json"
+	diffFormatBinary = "binary"
+)
+
+// diffSide is one of the two contents being compared: a version or the current content
+type diffSide struct {
+	VersionID  string `json:"version_id"` // "current" for the file's current content
+	VersionNum int    `json:"version_num,omitempty"`
+	Size       int64  `json:"size"`
+	Checksum   string `json:"checksum"`
+	MimeType   string `json:"mime_type"`
+	storageKey string
+}
+
+// diffResult is the cacheable part of a diff response
+type diffResult struct {
+	Format    string      `json:"format"`
+	Identical bool        `json:"identical"`
+	Truncated bool        `json:"truncated"`
+	Reason    string      `json:"reason,omitempty"` // why a text format fell back to binary
+	Stats     gin.H       `json:"stats,omitempty"`
+	Diff      interface{} `json:"diff,omitempty"`
+}
+
+// versionDiff is the response of the diff endpoint
+type versionDiff struct {
+	FileID string    `json:"file_id"`
+	From   *diffSide `json:"from"`
+	To     *diffSide `json:"to"`
+	*diffResult
+}
+
+func diffCacheKey(fileID string, a, b *diffSide) string {
+	return "version_diff:" + fileID + ":" + a.Checksum + ":" + b.Checksum
+}
+
+// diffVersions compares two versions of a file; either side may be "current"
+func diffVersions(c *gin.Context) {
+	file := authorizedFile(c, c.Param("id"), permRead)
+	if file == nil || rejectQuarantined(c, file) {
+		return
+	}
+	ctx := c.Request.Context()
+	from, ok := resolveDiffSide(c, file, c.Param("versionId"))
+	if !ok {
+		return
+	}
+	to, ok := resolveDiffSide(c, file, c.Param("otherId"))
+	if !ok {
+		return
+	}
+
+	cacheable := from.Checksum != "" && to.Checksum != ""
+	var result *diffResult
+	if cacheable {
+		if data, err := redisClient.Get(ctx, diffCacheKey(file.FileID, from, to)).Bytes(); err == nil {
+			var cached diffResult
+			if json.Unmarshal(data, &cached) == nil {
+				result = &cached
+			}
+		}
+	}
+	if result == nil {
+		var err error
+		if result, err = compareContents(ctx, file, from, to); err != nil {
+			log.Errorf("Failed to diff versions of %s: %v", file.FileID, err)
+			c.JSON(500, gin.H{"error": "failed to read version content"})
+			return
+		}
+		if cacheable {
+			if data, err := json.Marshal(result); err == nil {
+				redisClient.Set(ctx, diffCacheKey(file.FileID, from, to), data, diffCacheTTL)
+			}
+		}
+	}
+	c.JSON(200, gin.H{"success": true, "data": versionDiff{FileID: file.FileID, From: from, To: to, diffResult: result}})
+}
+
+func resolveDiffSide(c *gin.Context, file *File, ref string) (*diffSide, bool) {
+	if ref == "current" {
+		return &diffSide{
+			VersionID: "current", Size: file.Size, Checksum: file.Checksum, MimeType: file.MimeType, storageKey: file.StorageKey,
+		}, true
+	}
+	versionID, err := primitive.ObjectIDFromHex(ref)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid version ID"})
+		return nil, false
+	}
+	var version FileVersion
+	if err := versionsCol().FindOne(c.Request.Context(), bson.M{"_id": versionID, "file_id": file.FileID}).Decode(&version); err != nil {
+		c.JSON(404, gin.H{"error": "version not found"})
+		return nil, false
+	}
+	if version.StorageKey == "" {
+		c.JSON(409, gin.H{"error": "version content not available"})
+		return nil, false
+	}
+	mimeType := version.MimeType
+	if mimeType == "" {
+		mimeType = file.MimeType
+	}
+	return &diffSide{
+		VersionID: ref, VersionNum: version.VersionNum, Size: version.Size, Checksum: version.Checksum, MimeType: mimeType, storageKey: version.StorageKey,
+	}, true
+}
+
+// diffFormatFor picks how content of a MIME type is compared
+func diffFormatFor(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = mimeType
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return diffFormatJSON
+	case mediaType == "text/csv":
+		return diffFormatCSV
+	case strings.HasPrefix(mediaType, "text/"):
+		return diffFormatText
+	}
+	return diffFormatBinary
+}
+
+func compareContents(ctx context.Context, file *File, from, to *diffSide) (*diffResult, error) {
+	format := diffFormatFor(from.MimeType)
+	if other := diffFormatFor(to.MimeType); other != format {
+		// e.g. a .txt saved as .csv still diffs as text
+		if format == diffFormatBinary || other == diffFormatBinary {
+			format = diffFormatBinary
+		} else {
+			format = diffFormatText
+		}
+	}
+	identical := from.Checksum != "" && from.Checksum == to.Checksum
+	binary := &diffResult{Format: diffFormatBinary, Identical: identical, Stats: gin.H{"size_delta": to.Size - from.Size}}
+	if format == diffFormatBinary {
+		return binary, nil
+	}
+	if identical {
+		return &diffResult{Format: format, Identical: true}, nil
+	}
+	if from.Size > maxDiffInputBytes || to.Size > maxDiffInputBytes {
+		binary.Reason = "too large to diff"
+		return binary, nil
+	}
+
+	a, err := readDiffInput(ctx, from.storageKey)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readDiffInput(ctx, to.storageKey)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil {
+		binary.Reason = "too large to diff"
+		return binary, nil
+	}
+	if !utf8.Valid(a) || !utf8.Valid(b) {
+		binary.Reason = "not valid UTF-8 text"
+		return binary, nil
+	}
+	if bytes.Equal(a, b) {
+		return &diffResult{Format: format, Identical: true}, nil
+	}
+
+	switch format {
+	case diffFormatJSON:
+		if result := diffJSON(a, b); result != nil {
+			return result, nil
+		}
+	case diffFormatCSV:
+		if result := diffCSV(a, b); result != nil {
+			return result, nil
+		}
+	}
+	// Content that doesn't parse as its declared format is still worth a line diff
+	return diffText(a, b, "a/"+file.OriginalName, "b/"+file.OriginalName), nil
+}
+
+// readDiffInput reads a blob, returning nil if it is over maxDiffInputBytes
+func readDiffInput(ctx context.Context, key string) ([]byte, error) {
+	body, err := blobStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxDiffInputBytes+1))
+	if err != nil || len(data) > maxDiffInputBytes {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ── Line diff ──
+
+type lineOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+func splitLines(data []byte) []string {
+	s := strings.ReplaceAll(string(data), "\r\n", "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines returns the edit script turning a into b, minimal up to maxDiffEdits changes
+func diffLines(a, b []string) []lineOp {
+	var prefix, suffix []lineOp
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, lineOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, lineOp{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	ops := append(prefix, myersDiff(a, b)...)
+	for i := len(suffix) - 1; i >= 0; i-- {
+		ops = append(ops, suffix[i])
+	}
+	return ops
+}
+
+// myersDiff implements Myers' O(ND) algorithm, giving up on minimality (and reporting
+// everything as removed then added) after maxDiffEdits edits
+func myersDiff(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+	v := make([]int, 2*limit+3)
+	off := limit + 1
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace)
+			}
+		}
+	}
+
+	ops := make([]lineOp, 0, n+m)
+	for _, line := range a {
+		ops = append(ops, lineOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, lineOp{'+', line})
+	}
+	return ops
+}
+
+func myersBacktrack(a, b []string, trace [][]int) []lineOp {
+	var ops []lineOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		// trace[d] holds the furthest x on diagonals -d..d before step d
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, lineOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			ops = append(ops, lineOp{'+', b[y-1]})
+		} else {
+			ops = append(ops, lineOp{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, lineOp{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff renders ops as a unified diff, stopping at a hunk boundary once the
+// output would exceed maxDiffOutputBytes
+func unifiedDiff(ops []lineOp, from, to string) (string, bool) {
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", from, to)
+
+	// Line numbers in a and b before each op
+	aLine, bLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op.kind != '+' {
+			aLine[i+1]++
+		}
+		if op.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		// Extend the hunk while the next change is close enough to share context
+		last := i
+		for j := i + 1; j < len(ops) && j-last <= 2*diffContextLines+1; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		start := max(i-diffContextLines, 0)
+		end := min(last+diffContextLines+1, len(ops))
+
+		var hunk strings.Builder
+		fmt.Fprintf(&hunk, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[end]-aLine[start]), hunkRange(bLine[start], bLine[end]-bLine[start]))
+		for _, op := range ops[start:end] {
+			hunk.WriteByte(op.kind)
+			hunk.WriteString(op.text)
+			hunk.WriteByte('\n')
+		}
+		if out.Len()+hunk.Len() > maxDiffOutputBytes {
+			return out.String(), true
+		}
+		out.WriteString(hunk.String())
+		i = end
+	}
+	return out.String(), false
+}
+
+// hunkRange formats a hunk's start line and length; start is the 0-based line before it
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func diffText(a, b []byte, from, to string) *diffResult {
+	ops := diffLines(splitLines(a), splitLines(b))
+	added, removed := 0, 0
+	for _, op := range ops {
+		switch op.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	text, truncated := unifiedDiff(ops, from, to)
+	return &diffResult{
+		Format:    diffFormatText,
+		Truncated: truncated,
+		Stats:     gin.H{"lines_added": added, "lines_removed": removed},
+		Diff:      text,
+	}
+}
+
+// ── CSV diff ──
+
+type csvCellChange struct {
+	Column string `json:"column"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+// csvRowChange describes an added, removed or changed data row; row numbers are 1-based
+// and exclude the header
+type csvRowChange struct {
+	Op     string          `json:"op"`
+	OldRow int             `json:"old_row,omitempty"`
+	NewRow int             `json:"new_row,omitempty"`
+	Values []string        `json:"values,omitempty"`
+	Cells  []csvCellChange `json:"cells,omitempty"`
+}
+
+func parseCSV(data []byte) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	return r.ReadAll()
+}
+
+// diffCSV matches rows with a line diff, treating a run of removed rows followed by
+// added rows as changed rows compared cell by cell under the header's column names.
+// Added and removed columns are reported once rather than as a change to every row.
+// It returns nil if either side isn't CSV with a header.
+func diffCSV(a, b []byte) *diffResult {
+	oldRows, err := parseCSV(a)
+	if err != nil || len(oldRows) == 0 {
+		return nil
+	}
+	newRows, err := parseCSV(b)
+	if err != nil || len(newRows) == 0 {
+		return nil
+	}
+	oldHeader, newHeader := oldRows[0], newRows[0]
+	oldRows, newRows = oldRows[1:], newRows[1:]
+
+	oldCols, newCols := map[string]int{}, map[string]int{}
+	for i, name := range oldHeader {
+		oldCols[name] = i
+	}
+	// Rows are matched and compared on the columns both sides have
+	columns := []string{}
+	addedCols := []string{}
+	for i, name := range newHeader {
+		newCols[name] = i
+		if _, ok := oldCols[name]; ok {
+			columns = append(columns, name)
+		} else {
+			addedCols = append(addedCols, name)
+		}
+	}
+	removedCols := []string{}
+	for _, name := range oldHeader {
+		if _, ok := newCols[name]; !ok {
+			removedCols = append(removedCols, name)
+		}
+	}
+
+	cell := func(row []string, cols map[string]int, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	key := func(row []string, cols map[string]int) string {
+		values := make([]string, len(columns))
+		for i, name := range columns {
+			values[i] = cell(row, cols, name)
+		}
+		return strings.Join(values, "\x1f")
+	}
+	oldKeys, newKeys := make([]string, len(oldRows)), make([]string, len(newRows))
+	for i, row := range oldRows {
+		oldKeys[i] = key(row, oldCols)
+	}
+	for i, row := range newRows {
+		newKeys[i] = key(row, newCols)
+	}
+
+	var changes []csvRowChange
+	added, removed, changed := 0, 0, 0
+	ops := diffLines(oldKeys, newKeys)
+	oldRow, newRow := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			oldRow, newRow, i = oldRow+1, newRow+1, i+1
+			continue
+		}
+		var dels, adds int
+		for i < len(ops) && ops[i].kind == '-' {
+			dels, i = dels+1, i+1
+		}
+		for i < len(ops) && ops[i].kind == '+' {
+			adds, i = adds+1, i+1
+		}
+		for j := 0; j < max(dels, adds); j++ {
+			switch {
+			case j < dels && j < adds:
+				o, n := oldRows[oldRow+j], newRows[newRow+j]
+				var cells []csvCellChange
+				for _, name := range columns {
+					if ov, nv := cell(o, oldCols, name), cell(n, newCols, name); ov != nv {
+						cells = append(cells, csvCellChange{Column: name, Old: ov, New: nv})
+					}
+				}
+				changed++
+				changes = append(changes, csvRowChange{Op: "changed", OldRow: oldRow + j + 1, NewRow: newRow + j + 1, Cells: cells})
+			case j < dels:
+				removed++
+				changes = append(changes, csvRowChange{Op: "removed", OldRow: oldRow + j + 1, Values: oldRows[oldRow+j]})
+			default:
+				added++
+				changes = append(changes, csvRowChange{Op: "added", NewRow: newRow + j + 1, Values: newRows[newRow+j]})
+			}
+		}
+		oldRow, newRow = oldRow+dels, newRow+adds
+	}
+
+	truncated := len(changes) > maxDiffChanges
+	if truncated {
+		changes = changes[:maxDiffChanges]
+	}
+	return &diffResult{
+		Format:    diffFormatCSV,
+		Truncated: truncated,
+		Stats:     gin.H{"rows_added": added, "rows_removed": removed, "rows_changed": changed},
+		Diff: gin.H{
+			"columns_added":   addedCols,
+			"columns_removed": removedCols,
+			"rows":            changes,
+		},
+	}
+}
+
+// ── JSON diff ──
+
+// jsonChange is one difference between two JSON documents, located by a JSON Pointer
+type jsonChange struct {
+	Op   string      `json:"op"` // add, remove or replace
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+func decodeJSON(data []byte) (interface{}, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil || dec.More() {
+		return nil, false
+	}
+	return v, true
+}
+
+// diffJSON compares objects key by key and arrays index by index. It returns nil if
+// either side isn't a single JSON document.
+func diffJSON(a, b []byte) *diffResult {
+	oldDoc, ok := decodeJSON(a)
+	if !ok {
+		return nil
+	}
+	newDoc, ok := decodeJSON(b)
+	if !ok {
+		return nil
+	}
+	changes := []jsonChange{}
+	truncated := !collectJSONChanges("", oldDoc, newDoc, &changes)
+	return &diffResult{
+		Format:    diffFormatJSON,
+		Identical: len(changes) == 0,
+		Truncated: truncated,
+		Stats:     gin.H{"changes": len(changes)},
+		Diff:      changes,
+	}
+}
+
+// collectJSONChanges appends the changes from a to b under path, returning false once
+// maxDiffChanges have been collected
+func collectJSONChanges(path string, a, b interface{}, changes *[]jsonChange) bool {
+	add := func(change jsonChange) bool {
+		if len(*changes) >= maxDiffChanges {
+			return false
+		}
+		*changes = append(*changes, change)
+		return true
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := path + "/" + jsonPointerEscape(k)
+			oldValue, inOld := av[k]
+			newValue, inNew := bv[k]
+			var ok bool
+			switch {
+			case !inOld:
+				ok = add(jsonChange{Op: "add", Path: child, New: newValue})
+			case !inNew:
+				ok = add(jsonChange{Op: "remove", Path: child, Old: oldValue})
+			default:
+				ok = collectJSONChanges(child, oldValue, newValue, changes)
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < max(len(av), len(bv)); i++ {
+			child := path + "/" + strconv.Itoa(i)
+			var ok bool
+			switch {
+			case i >= len(av):
+				ok = add(jsonChange{Op: "add", Path: child, New: bv[i]})
+			case i >= len(bv):
+				ok = add(jsonChange{Op: "remove", Path: child, Old: av[i]})
+			default:
+				ok = collectJSONChanges(child, av[i], bv[i], changes)
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	return add(jsonChange{Op: "replace", Path: path, Old: a, New: b})
+}
+
+func jsonPointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
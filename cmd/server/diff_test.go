@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// applyOps rebuilds both sides from an edit script
+func applyOps(ops []lineOp) (a, b []string) {
+	for _, op := range ops {
+		if op.kind != '+' {
+			a = append(a, op.text)
+		}
+		if op.kind != '-' {
+			b = append(b, op.text)
+		}
+	}
+	return a, b
+}
+
+func numberedLines(prefix string, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s %d", prefix, i+1)
+	}
+	return lines
+}
+
+func TestDiffLines(t *testing.T) {
+	long := numberedLines("line", 50)
+	edited := append([]string(nil), long...)
+	edited[10], edited[40] = "changed", "changed too"
+	tests := []struct {
+		name  string
+		a, b  []string
+		edits int
+	}{
+		{"identical", long, long, 0},
+		{"both empty", nil, nil, 0},
+		{"insert at start", []string{"x", "y"}, []string{"new", "x", "y"}, 1},
+		{"delete at end", []string{"x", "y", "z"}, []string{"x", "y"}, 1},
+		{"empty before", nil, []string{"x", "y"}, 2},
+		{"empty after", []string{"x", "y"}, nil, 2},
+		{"two changes", long, edited, 4},
+		{"interleaved", []string{"a", "b", "c", "a", "b", "b", "a"}, []string{"c", "b", "a", "b", "a", "c"}, 5},
+		{"past maxDiffEdits", numberedLines("old", maxDiffEdits), numberedLines("new", maxDiffEdits), 2 * maxDiffEdits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := diffLines(tt.a, tt.b)
+			a, b := applyOps(ops)
+			if !reflect.DeepEqual(a, tt.a) || !reflect.DeepEqual(b, tt.b) {
+				t.Fatalf("edit script doesn't reproduce the inputs: %v", ops)
+			}
+			edits := 0
+			for _, op := range ops {
+				if op.kind != ' ' {
+					edits++
+				}
+			}
+			if edits != tt.edits {
+				t.Fatalf("%d edits, want %d", edits, tt.edits)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	long := numberedLines("line", 20)
+	edited := append([]string(nil), long...)
+	edited[1], edited[17] = "second", "eighteenth"
+	tests := []struct {
+		name string
+		a, b []string
+		want string
+	}{
+		{"insert at start", []string{"x", "y", "z"}, []string{"new", "x", "y", "z"},
+			"@@ -1,3 +1,4 @@\n+new\n x\n y\n z\n"},
+		{"delete at end", []string{"1", "2", "3", "4", "5"}, []string{"1", "2", "3", "4"},
+			"@@ -2,4 +2,3 @@\n 2\n 3\n 4\n-5\n"},
+		{"empty before", nil, []string{"x", "y"},
+			"@@ -0,0 +1,2 @@\n+x\n+y\n"},
+		{"empty after", []string{"x"}, nil,
+			"@@ -1 +0,0 @@\n-x\n"},
+		{"separate hunks", long, edited,
+			"@@ -1,5 +1,5 @@\n line 1\n-line 2\n+second\n line 3\n line 4\n line 5\n" +
+				"@@ -15,6 +15,6 @@\n line 15\n line 16\n line 17\n-line 18\n+eighteenth\n line 19\n line 20\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := unifiedDiff(diffLines(tt.a, tt.b), "a/f.txt", "b/f.txt")
+			want := "--- a/f.txt\n+++ b/f.txt\n" + tt.want
+			if truncated || got != want {
+				t.Fatalf("unified diff (truncated %v):\n%s\nwant:\n%s", truncated, got, want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffTruncated(t *testing.T) {
+	// Every tenth line changes, so each change is its own hunk, and the hunks add up to
+	// more than the output cap
+	var a, b []string
+	filler := strings.Repeat("x", 100)
+	for i := 0; i < 4000; i++ {
+		a = append(a, fmt.Sprintf("%d %s", i, filler))
+		if i%10 == 0 {
+			b = append(b, fmt.Sprintf("%d changed", i))
+		} else {
+			b = append(b, a[i])
+		}
+	}
+	text, truncated := unifiedDiff(diffLines(a, b), "a", "b")
+	if !truncated || len(text) > maxDiffOutputBytes {
+		t.Fatalf("truncated %v, %d bytes", truncated, len(text))
+	}
+	if !strings.HasSuffix(text, "\n") || strings.HasSuffix(text, "@@\n") {
+		t.Fatal("output was not cut at a hunk boundary")
+	}
+
+	result := diffText([]byte(strings.Join(a, "\n")), []byte(strings.Join(b, "\n")), "a", "b")
+	if !result.Truncated || result.Stats["lines_added"] != 400 || result.Stats["lines_removed"] != 400 {
+		t.Fatalf("diffText stats %v, truncated %v", result.Stats, result.Truncated)
+	}
+}
+
+func TestDiffCSV(t *testing.T) {
+	tests := []struct {
+		name             string
+		a, b             string
+		colsAdded        []string
+		colsRemoved      []string
+		rows             []csvRowChange
+		added, rem, chgd int
+	}{
+		{"row added", "id,name\n1,ada\n2,bob\n", "id,name\n1,ada\n9,zed\n2,bob\n",
+			[]string{}, []string{}, []csvRowChange{{Op: "added", NewRow: 2, Values: []string{"9", "zed"}}}, 1, 0, 0},
+		{"row removed", "id,name\n1,ada\n2,bob\n3,cy\n", "id,name\n1,ada\n3,cy\n",
+			[]string{}, []string{}, []csvRowChange{{Op: "removed", OldRow: 2, Values: []string{"2", "bob"}}}, 0, 1, 0},
+		{"row changed", "id,name,age\n1,ada,36\n2,bob,40\n", "id,name,age\n1,ada,36\n2,bobby,41\n",
+			[]string{}, []string{}, []csvRowChange{{Op: "changed", OldRow: 2, NewRow: 2, Cells: []csvCellChange{
+				{Column: "name", Old: "bob", New: "bobby"}, {Column: "age", Old: "40", New: "41"},
+			}}}, 0, 0, 1},
+		{"columns added and removed", "id,name,age\n1,ada,36\n", "id,email,name\n1,a@x,ada\n",
+			[]string{"email"}, []string{"age"}, nil, 0, 0, 0},
+		{"reordered columns", "id,name\n1,ada\n", "name,id\nada,1\n",
+			[]string{}, []string{}, nil, 0, 0, 0},
+		{"column added and cell changed", "id,name\n1,ada\n", "id,name,age\n1,eve,30\n",
+			[]string{"age"}, []string{}, []csvRowChange{{Op: "changed", OldRow: 1, NewRow: 1, Cells: []csvCellChange{
+				{Column: "name", Old: "ada", New: "eve"},
+			}}}, 0, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := diffCSV([]byte(tt.a), []byte(tt.b))
+			if result == nil {
+				t.Fatal("not parsed as CSV")
+			}
+			diff := result.Diff.(gin.H)
+			if !reflect.DeepEqual(diff["columns_added"], tt.colsAdded) || !reflect.DeepEqual(diff["columns_removed"], tt.colsRemoved) {
+				t.Fatalf("columns added %v, removed %v", diff["columns_added"], diff["columns_removed"])
+			}
+			if rows := diff["rows"].([]csvRowChange); !reflect.DeepEqual(rows, tt.rows) {
+				t.Fatalf("rows %+v, want %+v", rows, tt.rows)
+			}
+			if result.Stats["rows_added"] != tt.added || result.Stats["rows_removed"] != tt.rem || result.Stats["rows_changed"] != tt.chgd {
+				t.Fatalf("stats %v", result.Stats)
+			}
+		})
+	}
+
+	if diffCSV([]byte(""), []byte("id\n1\n")) != nil {
+		t.Error("empty content diffed as CSV")
+	}
+
+	var b strings.Builder
+	b.WriteString("id\n")
+	for i := 0; i < maxDiffChanges+500; i++ {
+		fmt.Fprintf(&b, "%d\n", i)
+	}
+	result := diffCSV([]byte("id\n"), []byte(b.String()))
+	if rows := result.Diff.(gin.H)["rows"].([]csvRowChange); !result.Truncated || len(rows) != maxDiffChanges {
+		t.Fatalf("truncated %v with %d rows", result.Truncated, len(rows))
+	}
+	if result.Stats["rows_added"] != maxDiffChanges+500 {
+		t.Fatalf("stats %v", result.Stats)
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	a := `{"name": "a", "tags": ["x", "y"], "meta": {"n": 1, "old": true, "deep": {"k": [1, {"v": 1}]}}, "list": [1, 2, 3], "a/b": 1, "shape": {"x": 1}}`
+	b := `{"name": "b", "tags": ["x", "z", "w"], "meta": {"n": 1, "new": null, "deep": {"k": [1, {"v": 2}]}}, "list": [1, 2], "a/b": 2, "shape": [1]}`
+	want := []jsonChange{
+		{Op: "replace", Path: "/a~1b", Old: json.Number("1"), New: json.Number("2")},
+		{Op: "remove", Path: "/list/2", Old: json.Number("3")},
+		{Op: "replace", Path: "/meta/deep/k/1/v", Old: json.Number("1"), New: json.Number("2")},
+		{Op: "add", Path: "/meta/new", New: nil},
+		{Op: "remove", Path: "/meta/old", Old: true},
+		{Op: "replace", Path: "/name", Old: "a", New: "b"},
+		{Op: "replace", Path: "/shape", Old: map[string]interface{}{"x": json.Number("1")}, New: []interface{}{json.Number("1")}},
+		{Op: "replace", Path: "/tags/1", Old: "y", New: "z"},
+		{Op: "add", Path: "/tags/2", New: "w"},
+	}
+	result := diffJSON([]byte(a), []byte(b))
+	if result == nil || result.Identical || result.Truncated {
+		t.Fatalf("result %+v", result)
+	}
+	if got := result.Diff.([]jsonChange); !reflect.DeepEqual(got, want) {
+		t.Fatalf("changes:\n%+v\nwant:\n%+v", got, want)
+	}
+
+	if result := diffJSON([]byte(`{"a": [1, 2]}`), []byte("{\n  \"a\": [1,2]\n}\n")); result == nil || !result.Identical {
+		t.Fatalf("reformatted document: %+v", result)
+	}
+	if result := diffJSON([]byte(`{"a": 1.0}`), []byte(`{"a": 1}`)); result == nil || result.Identical {
+		t.Fatal("number spelling change was not reported")
+	}
+	for _, doc := range []string{`{"a": 1`, `{"a": 1} {"b": 2}`, ``} {
+		if diffJSON([]byte(doc), []byte(`{}`)) != nil {
+			t.Errorf("%q diffed as JSON", doc)
+		}
+	}
+
+	var big bytes.Buffer
+	big.WriteString("{")
+	for i := 0; i < maxDiffChanges+10; i++ {
+		if i > 0 {
+			big.WriteString(",")
+		}
+		fmt.Fprintf(&big, `"k%d": %d`, i, i)
+	}
+	big.WriteString("}")
+	result = diffJSON([]byte(`{}`), big.Bytes())
+	if !result.Truncated || len(result.Diff.([]jsonChange)) != maxDiffChanges {
+		t.Fatalf("truncated %v with %d changes", result.Truncated, len(result.Diff.([]jsonChange)))
+	}
+}
+
+func TestCompareContents(t *testing.T) {
+	defer func(store BlobStore) { blobStore = store }(blobStore)
+	blobStore = &localBlobStore{root: t.TempDir()}
+	put := func(key, content string) {
+		if err := blobStore.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("v1.txt", "one\ntwo\n")
+	put("v2.txt", "one\n2\n")
+	put("v1.bin", "\xFF\xFE\x00")
+	put("v1.json", `{"a": 1}`)
+	put("v2.json", `{"a": 2}`)
+	put("v1.csv", "id\n1\n")
+	file := &File{OriginalName: "f"}
+	side := func(key, mimeType, checksum string, size int64) *diffSide {
+		return &diffSide{storageKey: key, MimeType: mimeType, Checksum: checksum, Size: size}
+	}
+
+	tests := []struct {
+		name      string
+		from, to  *diffSide
+		format    string
+		identical bool
+		reason    string
+		delta     int64
+	}{
+		{"binary", side("", "image/png", "c1", 100), side("", "image/png", "c2", 150), diffFormatBinary, false, "", 50},
+		{"binary, same checksum", side("", "image/png", "c1", 100), side("", "image/png", "c1", 100), diffFormatBinary, true, "", 0},
+		{"binary, checksums unknown", side("", "application/pdf", "", 100), side("", "application/pdf", "", 100), diffFormatBinary, false, "", 0},
+		{"text and binary", side("v1.txt", "text/plain", "c1", 8), side("", "image/png", "c2", 3), diffFormatBinary, false, "", -5},
+		{"text, same checksum", side("v1.txt", "text/plain", "c1", 8), side("v1.txt", "text/plain", "c1", 8), diffFormatText, true, "", 0},
+		{"text too large", side("v1.txt", "text/plain", "c1", maxDiffInputBytes+1), side("v2.txt", "text/plain", "c2", 6), diffFormatBinary, false, "too large to diff", 5 - maxDiffInputBytes},
+		{"not utf-8", side("v1.bin", "text/plain", "c1", 3), side("v2.txt", "text/plain", "c2", 6), diffFormatBinary, false, "not valid UTF-8 text", 3},
+		{"text", side("v1.txt", "text/plain", "c1", 8), side("v2.txt", "text/plain; charset=utf-8", "c2", 6), diffFormatText, false, "", 0},
+		{"json", side("v1.json", "application/json", "c1", 8), side("v2.json", "application/json", "c2", 8), diffFormatJSON, false, "", 0},
+		{"csv renamed to txt", side("v1.csv", "text/csv", "c1", 5), side("v2.txt", "text/plain", "c2", 6), diffFormatText, false, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := compareContents(context.Background(), file, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Format != tt.format || result.Identical != tt.identical || result.Reason != tt.reason {
+				t.Fatalf("result %+v", result)
+			}
+			if tt.format == diffFormatBinary && result.Stats["size_delta"] != tt.delta {
+				t.Fatalf("size_delta %v, want %d", result.Stats["size_delta"], tt.delta)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How a file's content left the service, recorded on each FileDownloadLog
+const (
+	downloadChannelAPI       = "api"
+	downloadChannelShareLink = "share_link"
+	downloadChannelExport    = "export"
+)
+
+// Download logs are queued in memory and written in batches so that serving a file never
+// waits on Mongo. If the queue fills up while Mongo is slow, entries are dropped rather
+// than holding up downloads.
+const (
+	downloadLogQueueSize     = 10000
+	downloadLogBatchSize     = 500
+	downloadLogFlushInterval = 2 * time.Second
+)
+
+var downloadLogQueue = make(chan FileDownloadLog, downloadLogQueueSize)
+
+// recordDownload queues a download log for the current request. The Range header is kept
+// only if it was honoured, and only whole-file downloads count towards File.Downloads.
+func recordDownload(c *gin.Context, fileID, channel string, linkID *primitive.ObjectID) {
+	entry := FileDownloadLog{
+		FileID:     fileID,
+		UserID:     currentUserID(c),
+		LinkID:     linkID,
+		Channel:    channel,
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		DownloadAt: time.Now(),
+	}
+	if c.Writer.Status() == 206 {
+		entry.Range = c.GetHeader("Range")
+	}
+	select {
+	case downloadLogQueue <- entry:
+	default:
+		log.WithField("file_id", fileID).Warn("Download log queue full, dropping entry")
+	}
+}
+
+// runDownloadLogWriter drains the queue into Mongo until ctx is cancelled; whatever is
+// still queued then is written by flushDownloadLogs during shutdown
+func runDownloadLogWriter(ctx context.Context) {
+	ticker := time.NewTicker(downloadLogFlushInterval)
+	defer ticker.Stop()
+	batch := make([]FileDownloadLog, 0, downloadLogBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			// The request context is gone; finish the batch in hand on our own
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			writeDownloadLogs(flushCtx, batch)
+			cancel()
+			return
+		case entry := <-downloadLogQueue:
+			batch = append(batch, entry)
+			if len(batch) >= downloadLogBatchSize {
+				writeDownloadLogs(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				writeDownloadLogs(ctx, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flushDownloadLogs writes everything left in the queue
+func flushDownloadLogs(ctx context.Context) {
+	batch := make([]FileDownloadLog, 0, downloadLogBatchSize)
+	for {
+		select {
+		case entry := <-downloadLogQueue:
+			batch = append(batch, entry)
+			if len(batch) < downloadLogBatchSize {
+				continue
+			}
+		default:
+		}
+		if len(batch) == 0 {
+			return
+		}
+		writeDownloadLogs(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+func writeDownloadLogs(ctx context.Context, batch []FileDownloadLog) {
+	if len(batch) == 0 {
+		return
+	}
+	docs := make([]interface{}, len(batch))
+	counts := map[string]int64{}
+	for i, entry := range batch {
+		docs[i] = entry
+		if entry.Range == "" {
+			counts[entry.FileID]++
+		}
+	}
+	if _, err := fileDownloadsCol().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false)); err != nil {
+		log.Errorf("Failed to write %d download logs: %v", len(batch), err)
+	}
+	if len(counts) == 0 {
+		return
+	}
+	updates := make([]mongo.WriteModel, 0, len(counts))
+	for fileID, n := range counts {
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"file_id": fileID}).
+			SetUpdate(bson.M{"$inc": bson.M{"downloads": n}}))
+	}
+	if _, err := filesCol.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false)); err != nil {
+		log.Errorf("Failed to update download counts: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// runEventConsumer reads file events from the service's own topic under groupID and
+// passes those of the given types to handle. Offsets are committed once handle
+// returns, so each event is processed at least once; failures are logged, not retried.
+// A panic in handle fails that event rather than the whole service.
+func runEventConsumer(ctx context.Context, groupID string, types []string, handle func(context.Context, FileEvent) error) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     strings.Split(getEnv("KAFKA_BROKERS", "localhost:9092"), ","),
+		Topic:       getEnv("KAFKA_TOPIC", "file-events"),
+		GroupID:     groupID,
+		MaxWait:     time.Second,
+		StartOffset: kafka.LastOffset,
+	})
+	defer reader.Close()
+
+	wanted := make(map[string]bool, len(types))
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return
+			}
+			log.Errorf("Consumer %s failed to fetch event: %v", groupID, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var event FileEvent
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			log.Warnf("Consumer %s skipping malformed event at offset %d", groupID, msg.Offset)
+		} else if wanted[event.Type] {
+			if err := handleEvent(ctx, handle, event); err != nil {
+				log.WithFields(logrus.Fields{
+					"consumer":   groupID,
+					"event_type": event.Type,
+					"file_id":    event.FileID,
+				}).Errorf("Failed to handle event: %v", err)
+			}
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil && ctx.Err() == nil {
+			log.Errorf("Consumer %s failed to commit offset: %v", groupID, err)
+		}
+	}
+}
+
+// handleEvent calls handle, turning a panic (e.g. a parser choking on a malformed
+// upload) into an error
+func handleEvent(ctx context.Context, handle func(context.Context, FileEvent) error, event FileEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return handle(ctx, event)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHandleEventRecoversPanic(t *testing.T) {
+	err := handleEvent(context.Background(), func(context.Context, FileEvent) error {
+		var b []byte
+		_ = b[1]
+		return nil
+	}, FileEvent{Type: "file.uploaded"})
+	if err == nil || !strings.Contains(err.Error(), "index out of range") {
+		t.Fatalf("expected recovered panic, got %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"strconv"
 	"time"
 
@@ -15,15 +17,20 @@ import (
 // ── New models ──
 
 type FileVersion struct {
-	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	FileID      string             `json:"file_id" bson:"file_id"`
-	VersionNum  int                `json:"version_num" bson:"version_num"`
-	StorageKey  string             `json:"storage_key" bson:"storage_key"`
-	Size        int64              `json:"size" bson:"size"`
-	Checksum    string             `json:"checksum" bson:"checksum"`
-	UploadedBy  string             `json:"uploaded_by" bson:"uploaded_by"`
-	Comment     string             `json:"comment" bson:"comment"`
-	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	ID               primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FileID           string             `json:"file_id" bson:"file_id"`
+	VersionNum       int                `json:"version_num" bson:"version_num"`
+	WorkspaceID      string             `json:"workspace_id" bson:"workspace_id"`
+	OwnerID          string             `json:"owner_id" bson:"owner_id"` // charged for the version's bytes
+	StorageKey       string             `json:"storage_key" bson:"storage_key"`
+	Size             int64              `json:"size" bson:"size"`
+	Checksum         string             `json:"checksum" bson:"checksum"`
+	MimeType         string             `json:"mime_type" bson:"mime_type"`
+	DetectedMimeType string             `json:"detected_mime_type" bson:"detected_mime_type"`
+	FileType         string             `json:"file_type" bson:"file_type"`
+	UploadedBy       string             `json:"uploaded_by" bson:"uploaded_by"`
+	Comment          string             `json:"comment" bson:"comment"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
 }
 
 type FileComment struct {
@@ -69,8 +76,10 @@ type FilePreview struct {
 	PreviewURL   string             `json:"preview_url" bson:"preview_url"`
 	ThumbnailURL string             `json:"thumbnail_url" bson:"thumbnail_url"`
 	PreviewType  string             `json:"preview_type" bson:"preview_type"`
+	Size         int                `json:"size" bson:"size"` // configured longest edge
 	Width        int                `json:"width" bson:"width"`
 	Height       int                `json:"height" bson:"height"`
+	StorageKey   string             `json:"-" bson:"storage_key"`
 	GeneratedAt  time.Time          `json:"generated_at" bson:"generated_at"`
 }
 
@@ -94,16 +103,18 @@ type FilePermission struct {
 }
 
 type FileLink struct {
-	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	FileID    string             `json:"file_id" bson:"file_id"`
-	Token     string             `json:"token" bson:"token"`
-	CreatedBy string             `json:"created_by" bson:"created_by"`
-	ExpiresAt *time.Time         `json:"expires_at" bson:"expires_at"`
-	MaxViews  int                `json:"max_views" bson:"max_views"`
-	Views     int                `json:"views" bson:"views"`
-	Password  string             `json:"password" bson:"password"`
-	IsActive  bool               `json:"is_active" bson:"is_active"`
-	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FileID       string             `json:"file_id" bson:"file_id"`
+	Token        string             `json:"token" bson:"token"`
+	CreatedBy    string             `json:"created_by" bson:"created_by"`
+	ExpiresAt    *time.Time         `json:"expires_at" bson:"expires_at"`
+	MaxViews     int                `json:"max_views" bson:"max_views"`
+	Views        int                `json:"views" bson:"views"`
+	Password     string             `json:"-" bson:"password,omitempty"` // plain text, links created before hashing
+	PasswordHash string             `json:"-" bson:"password_hash,omitempty"`
+	HasPassword  bool               `json:"has_password" bson:"-"`
+	IsActive     bool               `json:"is_active" bson:"is_active"`
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
 }
 
 type FileScanResult struct {
@@ -137,6 +148,7 @@ func registerExtendedRoutes(api *gin.RouterGroup) {
 	api.GET("/:id/versions/:versionId", getVersion)
 	api.DELETE("/:id/versions/:versionId", deleteVersion)
 	api.POST("/:id/versions/:versionId/restore", restoreVersion)
+	api.GET("/:id/versions/:versionId/diff/:otherId", diffVersions)
 
 	// Comments
 	api.GET("/:id/comments", listComments)
@@ -166,6 +178,7 @@ func registerExtendedRoutes(api *gin.RouterGroup) {
 
 	// Previews
 	api.GET("/:id/preview", getPreview)
+	api.GET("/:id/thumbnail", getThumbnail)
 
 	// Activity
 	api.GET("/:id/activity", listActivity)
@@ -181,6 +194,7 @@ func registerExtendedRoutes(api *gin.RouterGroup) {
 	api.GET("/:id/links", listShareLinks)
 	api.DELETE("/:id/links/:linkId", deleteShareLink)
 	api.GET("/shared/:token", accessSharedFile)
+	api.POST("/shared/:token", accessSharedFile)
 
 	// Scans
 	api.GET("/:id/scan", getScanResult)
@@ -206,12 +220,18 @@ func registerExtendedRoutes(api *gin.RouterGroup) {
 
 	// Storage quota
 	api.GET("/quota/:workspaceId", getStorageQuota)
+	api.PUT("/quota/:workspaceId", setStorageQuota)
+	api.GET("/quota/:workspaceId/users/:userId", getUserStorageQuota)
+	api.PUT("/quota/:workspaceId/users/:userId", setUserStorageQuota)
 }
 
 // ── Version handlers ──
 
 func listVersions(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permRead) == nil {
+		return
+	}
 	ctx := c.Request.Context()
 	cursor, err := versionsCol().Find(ctx, bson.M{"file_id": fileID}, options.Find().SetSort(bson.D{{Key: "version_num", Value: -1}}))
 	if err != nil {
@@ -224,85 +244,30 @@ func listVersions(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "data": versions})
 }
 
-func createVersion(c *gin.Context) {
-	fileID := c.Param("id")
-	var req struct {
-		Comment string `json:"comment"`
-	}
-	c.ShouldBindJSON(&req)
-	ctx := c.Request.Context()
-
-	// Get current max version
-	var maxVer FileVersion
-	err := versionsCol().FindOne(ctx, bson.M{"file_id": fileID}, options.FindOne().SetSort(bson.D{{Key: "version_num", Value: -1}})).Decode(&maxVer)
-	nextVer := 1
-	if err == nil {
-		nextVer = maxVer.VersionNum + 1
-	}
-
-	version := FileVersion{
-		FileID:     fileID,
-		VersionNum: nextVer,
-		UploadedBy: c.Query("user_id"),
-		Comment:    req.Comment,
-		CreatedAt:  time.Now(),
-	}
-	result, err := versionsCol().InsertOne(ctx, version)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
-		return
-	}
-	version.ID = result.InsertedID.(primitive.ObjectID)
-	logFileActivity(ctx, fileID, c.Query("user_id"), "version_created", req.Comment)
-	c.JSON(201, gin.H{"success": true, "data": version})
-}
-
 func getVersion(c *gin.Context) {
 	versionID, err := primitive.ObjectIDFromHex(c.Param("versionId"))
 	if err != nil {
 		c.JSON(400, gin.H{"error": "invalid version ID"})
 		return
 	}
-	var version FileVersion
-	if err := versionsCol().FindOne(c.Request.Context(), bson.M{"_id": versionID}).Decode(&version); err != nil {
-		c.JSON(404, gin.H{"error": "version not found"})
-		return
-	}
-	c.JSON(200, gin.H{"success": true, "data": version})
-}
-
-func deleteVersion(c *gin.Context) {
-	versionID, err := primitive.ObjectIDFromHex(c.Param("versionId"))
-	if err != nil {
-		c.JSON(400, gin.H{"error": "invalid version ID"})
-		return
-	}
-	versionsCol().DeleteOne(c.Request.Context(), bson.M{"_id": versionID})
-	c.JSON(200, gin.H{"success": true})
-}
-
-func restoreVersion(c *gin.Context) {
-	versionID, err := primitive.ObjectIDFromHex(c.Param("versionId"))
-	if err != nil {
-		c.JSON(400, gin.H{"error": "invalid version ID"})
+	if authorizedFile(c, c.Param("id"), permRead) == nil {
 		return
 	}
 	var version FileVersion
-	if err := versionsCol().FindOne(c.Request.Context(), bson.M{"_id": versionID}).Decode(&version); err != nil {
+	if err := versionsCol().FindOne(c.Request.Context(), bson.M{"_id": versionID, "file_id": c.Param("id")}).Decode(&version); err != nil {
 		c.JSON(404, gin.H{"error": "version not found"})
 		return
 	}
-	filesCol.UpdateOne(c.Request.Context(), bson.M{"file_id": version.FileID}, bson.M{
-		"$set": bson.M{"storage_key": version.StorageKey, "size": version.Size, "checksum": version.Checksum, "updated_at": time.Now()},
-	})
-	logFileActivity(c.Request.Context(), version.FileID, c.Query("user_id"), "version_restored", strconv.Itoa(version.VersionNum))
-	c.JSON(200, gin.H{"success": true, "message": "version restored"})
+	c.JSON(200, gin.H{"success": true, "data": version})
 }
 
 // ── Comment handlers ──
 
 func listComments(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permRead) == nil {
+		return
+	}
 	ctx := c.Request.Context()
 	cursor, err := commentsCol().Find(ctx, bson.M{"file_id": fileID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
 	if err != nil {
@@ -317,6 +282,9 @@ func listComments(c *gin.Context) {
 
 func createComment(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permComment) == nil {
+		return
+	}
 	var req struct {
 		Content  string `json:"content" binding:"required"`
 		ParentID string `json:"parent_id"`
@@ -326,12 +294,12 @@ func createComment(c *gin.Context) {
 		return
 	}
 	comment := FileComment{
-		FileID: fileID, UserID: c.Query("user_id"), Content: req.Content,
+		FileID: fileID, UserID: currentUserID(c), Content: req.Content,
 		ParentID: req.ParentID, CreatedAt: time.Now(), UpdatedAt: time.Now(),
 	}
 	result, _ := commentsCol().InsertOne(c.Request.Context(), comment)
 	comment.ID = result.InsertedID.(primitive.ObjectID)
-	logFileActivity(c.Request.Context(), fileID, c.Query("user_id"), "comment_added", "")
+	logFileActivity(c.Request.Context(), fileID, currentUserID(c), "comment_added", "")
 	c.JSON(201, gin.H{"success": true, "data": comment})
 }
 
@@ -344,20 +312,47 @@ func updateComment(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if !authorizeComment(c, commentID, false) {
+		return
+	}
 	commentsCol().UpdateOne(c.Request.Context(), bson.M{"_id": commentID}, bson.M{"$set": bson.M{"content": req.Content, "updated_at": time.Now()}})
 	c.JSON(200, gin.H{"success": true})
 }
 
 func deleteComment(c *gin.Context) {
 	commentID, _ := primitive.ObjectIDFromHex(c.Param("commentId"))
+	if !authorizeComment(c, commentID, true) {
+		return
+	}
 	commentsCol().DeleteOne(c.Request.Context(), bson.M{"_id": commentID})
 	c.JSON(200, gin.H{"success": true})
 }
 
+// authorizeComment lets authors edit their own comments while they can still comment on
+// the file; moderators with manage permission may also delete others' comments
+func authorizeComment(c *gin.Context, commentID primitive.ObjectID, moderate bool) bool {
+	var comment FileComment
+	if err := commentsCol().FindOne(c.Request.Context(), bson.M{"_id": commentID, "file_id": c.Param("id")}).Decode(&comment); err != nil {
+		c.JSON(404, gin.H{"error": "comment not found"})
+		return false
+	}
+	if comment.UserID == currentUserID(c) {
+		return authorizedFile(c, comment.FileID, permComment) != nil
+	}
+	if moderate {
+		return authorizedFile(c, comment.FileID, permManage) != nil
+	}
+	c.JSON(403, gin.H{"error": "only the author can edit a comment"})
+	return false
+}
+
 // ── Tag handlers ──
 
 func listTags(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permRead) == nil {
+		return
+	}
 	ctx := c.Request.Context()
 	cursor, _ := tagsCol().Find(ctx, bson.M{"file_id": fileID})
 	var tags []FileTag
@@ -367,6 +362,9 @@ func listTags(c *gin.Context) {
 
 func addTag(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permEdit) == nil {
+		return
+	}
 	var req struct {
 		Tag string `json:"tag" binding:"required"`
 	}
@@ -374,13 +372,16 @@ func addTag(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	tag := FileTag{FileID: fileID, Tag: req.Tag, AddedBy: c.Query("user_id"), CreatedAt: time.Now()}
+	tag := FileTag{FileID: fileID, Tag: req.Tag, AddedBy: currentUserID(c), CreatedAt: time.Now()}
 	tagsCol().InsertOne(c.Request.Context(), tag)
 	c.JSON(201, gin.H{"success": true})
 }
 
 func removeTag(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permEdit) == nil {
+		return
+	}
 	tag := c.Param("tag")
 	tagsCol().DeleteOne(c.Request.Context(), bson.M{"file_id": fileID, "tag": tag})
 	c.JSON(200, gin.H{"success": true})
@@ -401,9 +402,14 @@ func searchByTag(c *gin.Context) {
 		c.JSON(200, gin.H{"success": true, "data": []File{}})
 		return
 	}
-	cursor2, _ := filesCol.Find(ctx, bson.M{"file_id": bson.M{"$in": fileIDs}})
+	filter := bson.M{"file_id": bson.M{"$in": fileIDs}, "deleted_at": nil}
+	if !restrictToVisible(c, filter) {
+		return
+	}
+	cursor2, _ := filesCol.Find(ctx, filter)
 	var files []File
 	cursor2.All(ctx, &files)
+	redactQuarantined(files)
 	c.JSON(200, gin.H{"success": true, "data": files})
 }
 
@@ -411,7 +417,10 @@ func searchByTag(c *gin.Context) {
 
 func addFavorite(c *gin.Context) {
 	fileID := c.Param("id")
-	userID := c.Query("user_id")
+	if authorizedFile(c, fileID, permRead) == nil {
+		return
+	}
+	userID := currentUserID(c)
 	fav := FileFavorite{FileID: fileID, UserID: userID, CreatedAt: time.Now()}
 	favoritesCol().InsertOne(c.Request.Context(), fav)
 	c.JSON(201, gin.H{"success": true})
@@ -419,13 +428,13 @@ func addFavorite(c *gin.Context) {
 
 func removeFavorite(c *gin.Context) {
 	fileID := c.Param("id")
-	userID := c.Query("user_id")
+	userID := currentUserID(c)
 	favoritesCol().DeleteOne(c.Request.Context(), bson.M{"file_id": fileID, "user_id": userID})
 	c.JSON(200, gin.H{"success": true})
 }
 
 func listFavorites(c *gin.Context) {
-	userID := c.Query("user_id")
+	userID := currentUserID(c)
 	ctx := c.Request.Context()
 	cursor, _ := favoritesCol().Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
 	var favs []FileFavorite
@@ -446,8 +455,11 @@ func createCollection(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if req.WorkspaceID != "" && !requireWorkspaceMember(c, req.WorkspaceID) {
+		return
+	}
 	col := FileCollection{
-		Name: req.Name, Description: req.Description, OwnerID: c.Query("user_id"),
+		Name: req.Name, Description: req.Description, OwnerID: currentUserID(c),
 		WorkspaceID: req.WorkspaceID, IsPublic: req.IsPublic, FileIDs: []string{},
 		CreatedAt: time.Now(), UpdatedAt: time.Now(),
 	}
@@ -457,7 +469,7 @@ func createCollection(c *gin.Context) {
 }
 
 func listCollections(c *gin.Context) {
-	userID := c.Query("user_id")
+	userID := currentUserID(c)
 	workspaceID := c.Query("workspace_id")
 	filter := bson.M{}
 	if userID != "" {
@@ -480,11 +492,20 @@ func getCollection(c *gin.Context) {
 		c.JSON(404, gin.H{"error": "collection not found"})
 		return
 	}
+	// Public collections are visible to the rest of their workspace
+	p := currentPrincipal(c)
+	if col.OwnerID != p.UserID && !p.IsAdmin() && !(col.IsPublic && col.WorkspaceID != "" && p.IsWorkspaceMember(col.WorkspaceID)) {
+		c.JSON(404, gin.H{"error": "collection not found"})
+		return
+	}
 	c.JSON(200, gin.H{"success": true, "data": col})
 }
 
 func updateCollection(c *gin.Context) {
 	id, _ := primitive.ObjectIDFromHex(c.Param("collectionId"))
+	if !ownsCollection(c, id) {
+		return
+	}
 	var req struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
@@ -507,12 +528,18 @@ func updateCollection(c *gin.Context) {
 
 func deleteCollection(c *gin.Context) {
 	id, _ := primitive.ObjectIDFromHex(c.Param("collectionId"))
+	if !ownsCollection(c, id) {
+		return
+	}
 	collectionsCol().DeleteOne(c.Request.Context(), bson.M{"_id": id})
 	c.JSON(200, gin.H{"success": true})
 }
 
 func addToCollection(c *gin.Context) {
 	id, _ := primitive.ObjectIDFromHex(c.Param("collectionId"))
+	if !ownsCollection(c, id) {
+		return
+	}
 	var req struct {
 		FileID string `json:"file_id" binding:"required"`
 	}
@@ -520,33 +547,65 @@ func addToCollection(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if authorizedFile(c, req.FileID, permRead) == nil {
+		return
+	}
 	collectionsCol().UpdateOne(c.Request.Context(), bson.M{"_id": id}, bson.M{"$addToSet": bson.M{"file_ids": req.FileID}})
 	c.JSON(200, gin.H{"success": true})
 }
 
 func removeFromCollection(c *gin.Context) {
 	id, _ := primitive.ObjectIDFromHex(c.Param("collectionId"))
+	if !ownsCollection(c, id) {
+		return
+	}
 	fileID := c.Param("fileId")
 	collectionsCol().UpdateOne(c.Request.Context(), bson.M{"_id": id}, bson.M{"$pull": bson.M{"file_ids": fileID}})
 	c.JSON(200, gin.H{"success": true})
 }
 
+// ownsCollection writes a 404 unless the caller owns the collection or is a service admin
+func ownsCollection(c *gin.Context, id primitive.ObjectID) bool {
+	var col FileCollection
+	err := collectionsCol().FindOne(c.Request.Context(), bson.M{"_id": id}).Decode(&col)
+	if err != nil || (col.OwnerID != currentUserID(c) && !currentPrincipal(c).IsAdmin()) {
+		c.JSON(404, gin.H{"error": "collection not found"})
+		return false
+	}
+	return true
+}
+
 // ── Preview handlers ──
 
 func getPreview(c *gin.Context) {
 	fileID := c.Param("id")
-	var preview FilePreview
-	if err := previewsCol().FindOne(c.Request.Context(), bson.M{"file_id": fileID}).Decode(&preview); err != nil {
+	ctx := c.Request.Context()
+	file := authorizedFile(c, fileID, permRead)
+	if file == nil || rejectQuarantined(c, file) {
+		return
+	}
+	cursor, err := previewsCol().Find(ctx, bson.M{"file_id": fileID}, options.Find().SetSort(bson.D{{Key: "width", Value: 1}}))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load previews"})
+		return
+	}
+	var previews []FilePreview
+	cursor.All(ctx, &previews)
+	if len(previews) == 0 {
 		c.JSON(404, gin.H{"error": "preview not found"})
 		return
 	}
-	c.JSON(200, gin.H{"success": true, "data": preview})
+	// data is the largest rendition; previews lists every size, smallest first
+	c.JSON(200, gin.H{"success": true, "data": previews[len(previews)-1], "previews": previews})
 }
 
 // ── Activity handlers ──
 
 func listActivity(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permRead) == nil {
+		return
+	}
 	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "50"), 10, 64)
 	ctx := c.Request.Context()
 	cursor, _ := activityCol().Find(ctx, bson.M{"file_id": fileID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit))
@@ -557,6 +616,9 @@ func listActivity(c *gin.Context) {
 
 func listUserActivity(c *gin.Context) {
 	userID := c.Param("userId")
+	if !requireSelfOrAdmin(c, userID) {
+		return
+	}
 	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "50"), 10, 64)
 	ctx := c.Request.Context()
 	cursor, _ := activityCol().Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit))
@@ -575,6 +637,9 @@ func logFileActivity(ctx context.Context, fileID, userID, action, details string
 
 func listPermissions(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permManage) == nil {
+		return
+	}
 	ctx := c.Request.Context()
 	cursor, _ := permissionsCol().Find(ctx, bson.M{"file_id": fileID})
 	var perms []FilePermission
@@ -585,16 +650,34 @@ func listPermissions(c *gin.Context) {
 func grantPermission(c *gin.Context) {
 	fileID := c.Param("id")
 	var req struct {
-		UserID     string `json:"user_id" binding:"required"`
-		Permission string `json:"permission" binding:"required"`
+		UserID     string     `json:"user_id" binding:"required"`
+		Permission string     `json:"permission" binding:"required"`
+		ExpiresAt  *time.Time `json:"expires_at"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	level, ok := parsePermission(req.Permission)
+	if !ok {
+		c.JSON(400, gin.H{"error": "permission must be read, comment, edit, manage or owner"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	// Nobody can grant more than they hold; only owners can grant manage or owner
+	grantLevel := permManage
+	if level >= permManage {
+		grantLevel = permOwner
+	}
+	if authorizedFile(c, fileID, grantLevel) == nil {
+		return
+	}
 	perm := FilePermission{
-		FileID: fileID, UserID: req.UserID, Permission: req.Permission,
-		GrantedBy: c.Query("user_id"), CreatedAt: time.Now(),
+		FileID: fileID, UserID: req.UserID, Permission: level.String(),
+		GrantedBy: currentUserID(c), ExpiresAt: req.ExpiresAt, CreatedAt: time.Now(),
 	}
 	result, _ := permissionsCol().InsertOne(c.Request.Context(), perm)
 	perm.ID = result.InsertedID.(primitive.ObjectID)
@@ -603,7 +686,10 @@ func grantPermission(c *gin.Context) {
 
 func revokePermission(c *gin.Context) {
 	permID, _ := primitive.ObjectIDFromHex(c.Param("permissionId"))
-	permissionsCol().DeleteOne(c.Request.Context(), bson.M{"_id": permID})
+	if authorizedFile(c, c.Param("id"), permManage) == nil {
+		return
+	}
+	permissionsCol().DeleteOne(c.Request.Context(), bson.M{"_id": permID, "file_id": c.Param("id")})
 	c.JSON(200, gin.H{"success": true})
 }
 
@@ -612,57 +698,107 @@ func revokePermission(c *gin.Context) {
 func createShareLink(c *gin.Context) {
 	fileID := c.Param("id")
 	var req struct {
-		MaxViews int    `json:"max_views"`
-		Password string `json:"password"`
+		MaxViews  int        `json:"max_views"`
+		Password  string     `json:"password"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MaxViews < 0 {
+		c.JSON(400, gin.H{"error": "max_views must not be negative"})
+		return
+	}
+	if len(req.Password) > maxSharePasswordBytes {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("password must be at most %d bytes", maxSharePasswordBytes)})
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(defaultShareLinkTTL())
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+	file := authorizedFile(c, fileID, permManage)
+	if file == nil || rejectQuarantined(c, file) {
+		return
+	}
+	token, err := newShareToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to create link"})
+		return
 	}
-	c.ShouldBindJSON(&req)
 	link := FileLink{
-		FileID: fileID, Token: primitive.NewObjectID().Hex(),
-		CreatedBy: c.Query("user_id"), MaxViews: req.MaxViews, Password: req.Password,
-		IsActive: true, CreatedAt: time.Now(),
+		FileID: fileID, Token: token,
+		CreatedBy: currentUserID(c), MaxViews: req.MaxViews, ExpiresAt: &expiresAt,
+		IsActive: true, CreatedAt: now,
+	}
+	if req.Password != "" {
+		if link.PasswordHash, err = hashSharePassword(req.Password); err != nil {
+			c.JSON(500, gin.H{"error": "failed to create link"})
+			return
+		}
+		link.HasPassword = true
+	}
+	result, err := linksCol().InsertOne(c.Request.Context(), link)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to create link"})
+		return
 	}
-	result, _ := linksCol().InsertOne(c.Request.Context(), link)
 	link.ID = result.InsertedID.(primitive.ObjectID)
 	c.JSON(201, gin.H{"success": true, "data": link})
 }
 
 func listShareLinks(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permManage) == nil {
+		return
+	}
 	ctx := c.Request.Context()
 	cursor, _ := linksCol().Find(ctx, bson.M{"file_id": fileID})
 	var links []FileLink
 	cursor.All(ctx, &links)
+	for i := range links {
+		links[i].HasPassword = links[i].hasPassword()
+	}
 	c.JSON(200, gin.H{"success": true, "data": links})
 }
 
 func deleteShareLink(c *gin.Context) {
 	linkID, _ := primitive.ObjectIDFromHex(c.Param("linkId"))
-	linksCol().DeleteOne(c.Request.Context(), bson.M{"_id": linkID})
+	if authorizedFile(c, c.Param("id"), permManage) == nil {
+		return
+	}
+	linksCol().DeleteOne(c.Request.Context(), bson.M{"_id": linkID, "file_id": c.Param("id")})
 	c.JSON(200, gin.H{"success": true})
 }
 
 func accessSharedFile(c *gin.Context) {
-	token := c.Param("token")
-	var link FileLink
-	if err := linksCol().FindOne(c.Request.Context(), bson.M{"token": token, "is_active": true}).Decode(&link); err != nil {
-		c.JSON(404, gin.H{"error": "link not found or expired"})
+	link, file, ok := openShareLink(c, true)
+	if !ok {
 		return
 	}
-	// Increment views
-	linksCol().UpdateOne(c.Request.Context(), bson.M{"_id": link.ID}, bson.M{"$inc": bson.M{"views": 1}})
-	// Get file
-	var file File
-	if err := filesCol.FindOne(c.Request.Context(), bson.M{"file_id": link.FileID}).Decode(&file); err != nil {
-		c.JSON(404, gin.H{"error": "file not found"})
+	view, err := newSharedFileView(c.Request.Context(), link, file)
+	if err != nil {
+		log.Errorf("Failed to generate shared download URL: %v", err)
+		c.JSON(500, gin.H{"error": "failed to generate download URL"})
 		return
 	}
-	c.JSON(200, gin.H{"success": true, "data": file})
+	recordDownload(c, file.FileID, downloadChannelShareLink, &link.ID)
+	c.JSON(200, gin.H{"success": true, "data": view})
 }
 
 // ── Scan handlers ──
 
 func getScanResult(c *gin.Context) {
 	fileID := c.Param("id")
+	if authorizedFile(c, fileID, permRead) == nil {
+		return
+	}
 	var scan FileScanResult
 	if err := scansCol().FindOne(c.Request.Context(), bson.M{"file_id": fileID}, options.FindOne().SetSort(bson.D{{Key: "scanned_at", Value: -1}})).Decode(&scan); err != nil {
 		c.JSON(404, gin.H{"error": "no scan results"})
@@ -673,11 +809,20 @@ func getScanResult(c *gin.Context) {
 
 func triggerScan(c *gin.Context) {
 	fileID := c.Param("id")
-	scan := FileScanResult{
-		FileID: fileID, ScanType: "antivirus", Status: "pending", Findings: []string{}, ScannedAt: time.Now(),
+	if fileScanner == nil {
+		c.JSON(503, gin.H{"error": "antivirus scanning is not configured"})
+		return
+	}
+	file := authorizedFile(c, fileID, permEdit)
+	if file == nil {
+		return
+	}
+	scan, err := newPendingScan(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
-	result, _ := scansCol().InsertOne(c.Request.Context(), scan)
-	scan.ID = result.InsertedID.(primitive.ObjectID)
+	scanFileAsync(*file, *scan)
 	c.JSON(202, gin.H{"success": true, "data": scan})
 }
 
@@ -693,10 +838,16 @@ func bulkMoveFiles(c *gin.Context) {
 		return
 	}
 	ctx := c.Request.Context()
-	for _, fid := range req.FileIDs {
-		filesCol.UpdateOne(ctx, bson.M{"file_id": fid}, bson.M{"$set": bson.M{"channel_id": req.TargetChannel, "updated_at": time.Now()}})
+	fileIDs, ok := authorizedFileIDs(c, req.FileIDs, permEdit)
+	if !ok {
+		return
 	}
-	c.JSON(200, gin.H{"success": true, "moved": len(req.FileIDs)})
+	fileIDs = skipLockedFiles(c, fileIDs)
+	for _, fid := range fileIDs {
+		filesCol.UpdateOne(ctx, bson.M{"file_id": fid}, bson.M{"$set": bson.M{"channel_id": req.TargetChannel, "updated_at": time.Now()}, "$inc": bson.M{"revision": 1}})
+		redisClient.Del(ctx, "file:"+fid)
+	}
+	c.JSON(200, gin.H{"success": true, "moved": len(fileIDs)})
 }
 
 func bulkCopyFiles(c *gin.Context) {
@@ -708,7 +859,21 @@ func bulkCopyFiles(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"success": true, "copied": len(req.FileIDs)})
+	ctx := c.Request.Context()
+	files, ok := authorizedFiles(c, bson.M{"file_id": bson.M{"$in": req.FileIDs}}, permRead)
+	if !ok {
+		return
+	}
+	copied := []string{}
+	for _, file := range files {
+		newFile, err := duplicateFile(ctx, file, currentUserID(c), &req.TargetChannel)
+		if err != nil {
+			log.Errorf("Failed to copy file %s: %v", file.FileID, err)
+			continue
+		}
+		copied = append(copied, newFile.FileID)
+	}
+	c.JSON(200, gin.H{"success": true, "copied": len(copied), "file_ids": copied})
 }
 
 func bulkAddTags(c *gin.Context) {
@@ -721,9 +886,13 @@ func bulkAddTags(c *gin.Context) {
 		return
 	}
 	ctx := c.Request.Context()
-	for _, fid := range req.FileIDs {
+	fileIDs, ok := authorizedFileIDs(c, req.FileIDs, permEdit)
+	if !ok {
+		return
+	}
+	for _, fid := range fileIDs {
 		for _, tag := range req.Tags {
-			tagsCol().InsertOne(ctx, FileTag{FileID: fid, Tag: tag, AddedBy: c.Query("user_id"), CreatedAt: time.Now()})
+			tagsCol().InsertOne(ctx, FileTag{FileID: fid, Tag: tag, AddedBy: currentUserID(c), CreatedAt: time.Now()})
 		}
 	}
 	c.JSON(200, gin.H{"success": true})
@@ -750,11 +919,24 @@ func searchFiles(c *gin.Context) {
 	if fileType != "" {
 		filter["file_type"] = fileType
 	}
+	if !restrictToVisible(c, filter) {
+		return
+	}
+	if err := applyMetadataFilters(c, filter); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	sort, err := listSort(c, "updated_at")
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 
 	ctx := c.Request.Context()
-	cursor, _ := filesCol.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}}).SetLimit(limit))
+	cursor, _ := filesCol.Find(ctx, filter, options.Find().SetSort(sort).SetLimit(limit))
 	var files []File
 	cursor.All(ctx, &files)
+	redactQuarantined(files)
 	c.JSON(200, gin.H{"success": true, "data": files})
 }
 
@@ -763,13 +945,16 @@ func searchFiles(c *gin.Context) {
 func findDuplicates(c *gin.Context) {
 	fileID := c.Param("id")
 	ctx := c.Request.Context()
-	var file File
-	if err := filesCol.FindOne(ctx, bson.M{"file_id": fileID}).Decode(&file); err != nil {
-		c.JSON(404, gin.H{"error": "file not found"})
+	file := authorizedFile(c, fileID, permRead)
+	if file == nil {
+		return
+	}
+	// Find by checksum, among files the caller can see
+	filter := bson.M{"$or": checksumMatch(file.Checksum, file.OriginalChecksum), "file_id": bson.M{"$ne": fileID}}
+	if !restrictToVisible(c, filter) {
 		return
 	}
-	// Find by checksum
-	cursor, _ := filesCol.Find(ctx, bson.M{"checksum": file.Checksum, "file_id": bson.M{"$ne": fileID}})
+	cursor, _ := filesCol.Find(ctx, filter)
 	var dupes []File
 	cursor.All(ctx, &dupes)
 	c.JSON(200, gin.H{"success": true, "data": dupes})
@@ -778,7 +963,7 @@ func findDuplicates(c *gin.Context) {
 // ── Recent files ──
 
 func listRecentFiles(c *gin.Context) {
-	userID := c.Query("user_id")
+	userID := currentUserID(c)
 	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "20"), 10, 64)
 	ctx := c.Request.Context()
 	filter := bson.M{"deleted_at": nil}
@@ -788,13 +973,14 @@ func listRecentFiles(c *gin.Context) {
 	cursor, _ := filesCol.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}}).SetLimit(limit))
 	var files []File
 	cursor.All(ctx, &files)
+	redactQuarantined(files)
 	c.JSON(200, gin.H{"success": true, "data": files})
 }
 
 // ── Trash ──
 
 func listTrash(c *gin.Context) {
-	userID := c.Query("user_id")
+	userID := currentUserID(c)
 	ctx := c.Request.Context()
 	filter := bson.M{"deleted_at": bson.M{"$ne": nil}}
 	if userID != "" {
@@ -803,12 +989,37 @@ func listTrash(c *gin.Context) {
 	cursor, _ := filesCol.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}}))
 	var files []File
 	cursor.All(ctx, &files)
+	redactQuarantined(files)
 	c.JSON(200, gin.H{"success": true, "data": files})
 }
 
 func restoreFromTrash(c *gin.Context) {
 	fileID := c.Param("id")
-	filesCol.UpdateOne(c.Request.Context(), bson.M{"file_id": fileID}, bson.M{"$set": bson.M{"deleted_at": nil, "updated_at": time.Now()}})
+	ctx := c.Request.Context()
+	var file File
+	if err := filesCol.FindOne(ctx, bson.M{"file_id": fileID, "deleted_at": bson.M{"$ne": nil}}).Decode(&file); err != nil {
+		c.JSON(404, gin.H{"error": "file not in trash"})
+		return
+	}
+	if !checkFileAccess(c, &file, permOwner) {
+		return
+	}
+	if err := reserveQuota(ctx, fileID, file.WorkspaceID, file.UploadedBy, file.Size, time.Minute); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	// Bulk deletes mark files "deleted"; restore the status the file had before
+	status := fileStatusActive
+	if file.Quarantine != nil {
+		status = fileStatusQuarantined
+	}
+	result, err := filesCol.UpdateOne(ctx, bson.M{"file_id": fileID, "deleted_at": bson.M{"$ne": nil}}, bson.M{"$set": bson.M{"deleted_at": nil, "status": status, "updated_at": time.Now()}, "$inc": bson.M{"revision": 1}})
+	if err != nil || result.ModifiedCount == 0 {
+		releaseQuota(ctx, fileID)
+		c.JSON(409, gin.H{"error": "file could not be restored"})
+		return
+	}
+	commitQuota(ctx, fileID, file.WorkspaceID, file.UploadedBy, file.Size)
 	c.JSON(200, gin.H{"success": true, "message": "file restored"})
 }
 
@@ -816,36 +1027,24 @@ func restoreFromTrash(c *gin.Context) {
 
 func getStorageQuota(c *gin.Context) {
 	workspaceID := c.Param("workspaceId")
+	if !requireWorkspaceMember(c, workspaceID) {
+		return
+	}
 	ctx := c.Request.Context()
 
-	pipeline := mongo.Pipeline{
-		{{Key: "$match", Value: bson.M{"workspace_id": workspaceID, "deleted_at": nil}}},
-		{{Key: "$group", Value: bson.M{"_id": nil, "total_size": bson.M{"$sum": "$size"}, "file_count": bson.M{"$sum": 1}}}},
+	limit, userLimit, err := quotaLimits(ctx, workspaceID, "")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load quota"})
+		return
 	}
-	cursor, _ := filesCol.Aggregate(ctx, pipeline)
-	defer cursor.Close(ctx)
-
-	var result []bson.M
-	cursor.All(ctx, &result)
-
-	totalSize := int64(0)
-	fileCount := 0
-	if len(result) > 0 {
-		if v, ok := result[0]["total_size"].(int64); ok {
-			totalSize = v
-		}
-		if v, ok := result[0]["file_count"].(int32); ok {
-			fileCount = int(v)
-		}
+	summary, err := quotaSummary(ctx, workspaceID, "", limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load usage"})
+		return
 	}
+	fileCount, _ := filesCol.CountDocuments(ctx, bson.M{"workspace_id": workspaceID, "deleted_at": nil})
+	summary["file_count"] = fileCount
+	summary["default_user_limit"] = userLimit
 
-	c.JSON(200, gin.H{
-		"success": true,
-		"data": gin.H{
-			"workspace_id": workspaceID,
-			"total_size":   totalSize,
-			"file_count":   fileCount,
-			"quota_limit":  10 * 1024 * 1024 * 1024, // 10GB default
-		},
-	})
+	c.JSON(200, gin.H{"success": true, "data": summary})
 }
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -38,12 +45,15 @@ type FileReaction struct {
 }
 
 type FileDownloadLog struct {
-	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	FileID     string             `json:"file_id" bson:"file_id"`
-	UserID     string             `json:"user_id" bson:"user_id"`
-	IP         string             `json:"ip" bson:"ip"`
-	UserAgent  string             `json:"user_agent" bson:"user_agent"`
-	DownloadAt time.Time          `json:"download_at" bson:"download_at"`
+	ID         primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	FileID     string              `json:"file_id" bson:"file_id"`
+	UserID     string              `json:"user_id" bson:"user_id"`
+	LinkID     *primitive.ObjectID `json:"link_id,omitempty" bson:"link_id,omitempty"` // set for share link downloads
+	Channel    string              `json:"channel" bson:"channel"`                     // api, share_link, export
+	IP         string              `json:"ip" bson:"ip"`
+	UserAgent  string              `json:"user_agent" bson:"user_agent"`
+	Range      string              `json:"range,omitempty" bson:"range,omitempty"`
+	DownloadAt time.Time           `json:"download_at" bson:"download_at"`
 }
 
 type FileAccessRequest struct {
@@ -79,14 +89,15 @@ type FileLabel struct {
 }
 
 type FileExport struct {
-	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	FileIDs     []string           `json:"file_ids" bson:"file_ids"`
-	Format      string             `json:"format" bson:"format"` // zip, tar
-	Status      string             `json:"status" bson:"status"`
-	URL         string             `json:"url" bson:"url"`
-	CreatedBy   string             `json:"created_by" bson:"created_by"`
-	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
-	CompletedAt *time.Time         `json:"completed_at" bson:"completed_at"`
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FileIDs      []string           `json:"file_ids" bson:"file_ids"`
+	Format       string             `json:"format" bson:"format"` // zip, tar
+	Status       string             `json:"status" bson:"status"`
+	URL          string             `json:"url" bson:"url"`
+	CreatedBy    string             `json:"created_by" bson:"created_by"`
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+	CompletedAt  *time.Time         `json:"completed_at" bson:"completed_at"`
+	DownloadedAt *time.Time         `json:"downloaded_at,omitempty" bson:"downloaded_at,omitempty"` // first download URL issued
 }
 
 type FileNotificationPref struct {
@@ -184,8 +195,9 @@ func registerExtendedRoutes2(api *gin.RouterGroup) {
 // ── Handlers ──
 
 func addFileWatcher(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	w := FileWatcher{
-		FileID: c.Param("id"), UserID: c.GetHeader("X-User-ID"), NotifyOn: "all", CreatedAt: time.Now(),
+		FileID: c.Param("id"), UserID: currentUserID(c), NotifyOn: "all", CreatedAt: time.Now(),
 	}
 	res, err := fileWatchersCol().InsertOne(context.TODO(), w)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
@@ -194,12 +206,13 @@ func addFileWatcher(c *gin.Context) {
 }
 
 func removeFileWatcher(c *gin.Context) {
-	_, err := fileWatchersCol().DeleteOne(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": c.GetHeader("X-User-ID")})
+	_, err := fileWatchersCol().DeleteOne(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": currentUserID(c)})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	c.JSON(200, gin.H{"success": true})
 }
 
 func listFileWatchers(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	cur, err := fileWatchersCol().Find(context.TODO(), bson.M{"file_id": c.Param("id")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	defer cur.Close(context.TODO())
@@ -209,14 +222,15 @@ func listFileWatchers(c *gin.Context) {
 }
 
 func isWatchingFile(c *gin.Context) {
-	count, _ := fileWatchersCol().CountDocuments(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": c.GetHeader("X-User-ID")})
+	count, _ := fileWatchersCol().CountDocuments(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": currentUserID(c)})
 	c.JSON(200, gin.H{"success": true, "watching": count > 0})
 }
 
 func pinFile(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	var req struct{ ChannelID string `json:"channel_id"` }
 	_ = c.ShouldBindJSON(&req)
-	p := FilePin{FileID: c.Param("id"), ChannelID: req.ChannelID, PinnedBy: c.GetHeader("X-User-ID"), PinnedAt: time.Now()}
+	p := FilePin{FileID: c.Param("id"), ChannelID: req.ChannelID, PinnedBy: currentUserID(c), PinnedAt: time.Now()}
 	res, err := filePinsCol().InsertOne(context.TODO(), p)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	p.ID = res.InsertedID.(primitive.ObjectID)
@@ -224,6 +238,7 @@ func pinFile(c *gin.Context) {
 }
 
 func unpinFile(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	_, err := filePinsCol().DeleteOne(context.TODO(), bson.M{"file_id": c.Param("id")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	c.JSON(200, gin.H{"success": true})
@@ -235,18 +250,25 @@ func listChannelPins(c *gin.Context) {
 	defer cur.Close(context.TODO())
 	var pins []FilePin
 	_ = cur.All(context.TODO(), &pins)
+	fileIDs := make([]string, len(pins))
+	for i, p := range pins { fileIDs[i] = p.FileID }
+	visible, ok := authorizedFileIDs(c, fileIDs, permRead)
+	if !ok { return }
+	pins = filterByFileID(pins, visible, func(p FilePin) string { return p.FileID })
 	c.JSON(200, gin.H{"success": true, "data": pins})
 }
 
 func isFilePinned(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	count, _ := filePinsCol().CountDocuments(context.TODO(), bson.M{"file_id": c.Param("id")})
 	c.JSON(200, gin.H{"success": true, "pinned": count > 0})
 }
 
 func addFileReaction(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permComment) == nil { return }
 	var req struct{ Emoji string `json:"emoji"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
-	r := FileReaction{FileID: c.Param("id"), UserID: c.GetHeader("X-User-ID"), Emoji: req.Emoji, CreatedAt: time.Now()}
+	r := FileReaction{FileID: c.Param("id"), UserID: currentUserID(c), Emoji: req.Emoji, CreatedAt: time.Now()}
 	res, err := fileReactionsCol().InsertOne(context.TODO(), r)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	r.ID = res.InsertedID.(primitive.ObjectID)
@@ -254,12 +276,13 @@ func addFileReaction(c *gin.Context) {
 }
 
 func removeFileReaction(c *gin.Context) {
-	_, err := fileReactionsCol().DeleteOne(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": c.GetHeader("X-User-ID"), "emoji": c.Query("emoji")})
+	_, err := fileReactionsCol().DeleteOne(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": currentUserID(c), "emoji": c.Query("emoji")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	c.JSON(200, gin.H{"success": true})
 }
 
 func listFileReactions(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	cur, err := fileReactionsCol().Find(context.TODO(), bson.M{"file_id": c.Param("id")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	defer cur.Close(context.TODO())
@@ -269,6 +292,7 @@ func listFileReactions(c *gin.Context) {
 }
 
 func getFileReactionSummary(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	pipeline := mongo.Pipeline{
 		{{Key: "$match", Value: bson.M{"file_id": c.Param("id")}}},
 		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$emoji"}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
@@ -282,6 +306,7 @@ func getFileReactionSummary(c *gin.Context) {
 }
 
 func listFileDownloads(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permManage) == nil { return }
 	opts := options.Find().SetSort(bson.D{{Key: "download_at", Value: -1}}).SetLimit(50)
 	cur, err := fileDownloadsCol().Find(context.TODO(), bson.M{"file_id": c.Param("id")}, opts)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
@@ -292,13 +317,14 @@ func listFileDownloads(c *gin.Context) {
 }
 
 func countFileDownloads(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	count, _ := fileDownloadsCol().CountDocuments(context.TODO(), bson.M{"file_id": c.Param("id")})
 	c.JSON(200, gin.H{"success": true, "count": count})
 }
 
 func listRecentDownloads(c *gin.Context) {
 	opts := options.Find().SetSort(bson.D{{Key: "download_at", Value: -1}}).SetLimit(50)
-	cur, err := fileDownloadsCol().Find(context.TODO(), bson.M{"user_id": c.GetHeader("X-User-ID")}, opts)
+	cur, err := fileDownloadsCol().Find(context.TODO(), bson.M{"user_id": currentUserID(c)}, opts)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	defer cur.Close(context.TODO())
 	var logs []FileDownloadLog
@@ -309,7 +335,8 @@ func listRecentDownloads(c *gin.Context) {
 func createAccessRequest(c *gin.Context) {
 	var req struct{ Reason string `json:"reason"` }
 	_ = c.ShouldBindJSON(&req)
-	ar := FileAccessRequest{FileID: c.Param("id"), RequesterID: c.GetHeader("X-User-ID"), Reason: req.Reason, Status: "pending", CreatedAt: time.Now()}
+	if n, _ := filesCol.CountDocuments(context.TODO(), bson.M{"file_id": c.Param("id"), "deleted_at": nil}); n == 0 { c.JSON(404, gin.H{"error": "file not found"}); return }
+	ar := FileAccessRequest{FileID: c.Param("id"), RequesterID: currentUserID(c), Reason: req.Reason, Status: "pending", CreatedAt: time.Now()}
 	res, err := fileAccessReqsCol().InsertOne(context.TODO(), ar)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	ar.ID = res.InsertedID.(primitive.ObjectID)
@@ -317,6 +344,7 @@ func createAccessRequest(c *gin.Context) {
 }
 
 func listAccessRequests(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permManage) == nil { return }
 	cur, err := fileAccessReqsCol().Find(context.TODO(), bson.M{"file_id": c.Param("id")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	defer cur.Close(context.TODO())
@@ -329,8 +357,11 @@ func reviewAccessRequest(c *gin.Context) {
 	var req struct{ Status string `json:"status"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
 	objID, _ := primitive.ObjectIDFromHex(c.Param("requestId"))
+	var ar FileAccessRequest
+	if err := fileAccessReqsCol().FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&ar); err != nil { c.JSON(404, gin.H{"error": "access request not found"}); return }
+	if authorizedFile(c, ar.FileID, permManage) == nil { return }
 	now := time.Now()
-	_, err := fileAccessReqsCol().UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$set": bson.M{"status": req.Status, "reviewed_by": c.GetHeader("X-User-ID"), "reviewed_at": now}})
+	_, err := fileAccessReqsCol().UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$set": bson.M{"status": req.Status, "reviewed_by": currentUserID(c), "reviewed_at": now}})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	c.JSON(200, gin.H{"success": true})
 }
@@ -341,13 +372,19 @@ func listPendingAccessRequests(c *gin.Context) {
 	defer cur.Close(context.TODO())
 	var reqs []FileAccessRequest
 	_ = cur.All(context.TODO(), &reqs)
+	// Only requests the caller can act on
+	fileIDs := make([]string, len(reqs))
+	for i, r := range reqs { fileIDs[i] = r.FileID }
+	managed, ok := authorizedFileIDs(c, fileIDs, permManage)
+	if !ok { return }
+	reqs = filterByFileID(reqs, managed, func(r FileAccessRequest) string { return r.FileID })
 	c.JSON(200, gin.H{"success": true, "data": reqs})
 }
 
 func createFileTemplate(c *gin.Context) {
 	var t FileTemplate
 	if err := c.ShouldBindJSON(&t); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
-	t.CreatedBy = c.GetHeader("X-User-ID")
+	t.CreatedBy = currentUserID(c)
 	t.CreatedAt = time.Now()
 	res, err := fileTemplatesCol().InsertOne(context.TODO(), t)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
@@ -375,6 +412,7 @@ func getFileTemplate(c *gin.Context) {
 
 func updateFileTemplate(c *gin.Context) {
 	objID, _ := primitive.ObjectIDFromHex(c.Param("templateId"))
+	if !ownsTemplate(c, objID) { return }
 	var req bson.M
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
 	_, err := fileTemplatesCol().UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$set": req})
@@ -384,11 +422,20 @@ func updateFileTemplate(c *gin.Context) {
 
 func deleteFileTemplate(c *gin.Context) {
 	objID, _ := primitive.ObjectIDFromHex(c.Param("templateId"))
+	if !ownsTemplate(c, objID) { return }
 	_, err := fileTemplatesCol().DeleteOne(context.TODO(), bson.M{"_id": objID})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	c.JSON(200, gin.H{"success": true})
 }
 
+// ownsTemplate writes a 403 unless the caller created the template or is an admin
+func ownsTemplate(c *gin.Context, id primitive.ObjectID) bool {
+	var t FileTemplate
+	if err := fileTemplatesCol().FindOne(context.TODO(), bson.M{"_id": id}).Decode(&t); err != nil { c.JSON(404, gin.H{"error": "template not found"}); return false }
+	if t.CreatedBy != currentUserID(c) && !currentPrincipal(c).IsAdmin() { c.JSON(403, gin.H{"error": "only the template's creator can change it"}); return false }
+	return true
+}
+
 func useFileTemplate(c *gin.Context) {
 	objID, _ := primitive.ObjectIDFromHex(c.Param("templateId"))
 	_, _ = fileTemplatesCol().UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$inc": bson.M{"use_count": 1}})
@@ -398,9 +445,10 @@ func useFileTemplate(c *gin.Context) {
 }
 
 func addFileLabel(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permEdit) == nil { return }
 	var req struct{ Label string `json:"label"`; Color string `json:"color"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
-	l := FileLabel{FileID: c.Param("id"), Label: req.Label, Color: req.Color, AddedBy: c.GetHeader("X-User-ID"), CreatedAt: time.Now()}
+	l := FileLabel{FileID: c.Param("id"), Label: req.Label, Color: req.Color, AddedBy: currentUserID(c), CreatedAt: time.Now()}
 	res, err := fileLabelsCol().InsertOne(context.TODO(), l)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	l.ID = res.InsertedID.(primitive.ObjectID)
@@ -408,12 +456,14 @@ func addFileLabel(c *gin.Context) {
 }
 
 func removeFileLabel(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permEdit) == nil { return }
 	_, err := fileLabelsCol().DeleteOne(context.TODO(), bson.M{"file_id": c.Param("id"), "label": c.Param("label")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	c.JSON(200, gin.H{"success": true})
 }
 
 func listFileLabels(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	cur, err := fileLabelsCol().Find(context.TODO(), bson.M{"file_id": c.Param("id")})
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	defer cur.Close(context.TODO())
@@ -429,14 +479,20 @@ func searchByLabel(c *gin.Context) {
 	defer cur.Close(context.TODO())
 	var labels []FileLabel
 	_ = cur.All(context.TODO(), &labels)
+	fileIDs := make([]string, len(labels))
+	for i, l := range labels { fileIDs[i] = l.FileID }
+	visible, ok := authorizedFileIDs(c, fileIDs, permRead)
+	if !ok { return }
+	labels = filterByFileID(labels, visible, func(l FileLabel) string { return l.FileID })
 	c.JSON(200, gin.H{"success": true, "data": labels})
 }
 
 func setFileNotifPref(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	var req FileNotificationPref
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
 	req.FileID = c.Param("id")
-	req.UserID = c.GetHeader("X-User-ID")
+	req.UserID = currentUserID(c)
 	opts := options.Update().SetUpsert(true)
 	_, err := fileNotifPrefsCol().UpdateOne(context.TODO(), bson.M{"file_id": req.FileID, "user_id": req.UserID}, bson.M{"$set": req}, opts)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
@@ -444,8 +500,9 @@ func setFileNotifPref(c *gin.Context) {
 }
 
 func getFileNotifPref(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	var pref FileNotificationPref
-	err := fileNotifPrefsCol().FindOne(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": c.GetHeader("X-User-ID")}).Decode(&pref)
+	err := fileNotifPrefsCol().FindOne(context.TODO(), bson.M{"file_id": c.Param("id"), "user_id": currentUserID(c)}).Decode(&pref)
 	if err != nil { c.JSON(200, gin.H{"success": true, "data": nil}); return }
 	c.JSON(200, gin.H{"success": true, "data": pref})
 }
@@ -454,18 +511,117 @@ func createFileExport(c *gin.Context) {
 	var req struct{ FileIDs []string `json:"file_ids"`; Format string `json:"format"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
 	if req.Format == "" { req.Format = "zip" }
-	export := FileExport{FileIDs: req.FileIDs, Format: req.Format, Status: "pending", CreatedBy: c.GetHeader("X-User-ID"), CreatedAt: time.Now()}
+	export := FileExport{FileIDs: req.FileIDs, Format: req.Format, Status: "pending", CreatedBy: currentUserID(c), CreatedAt: time.Now()}
+	if export.Format != "zip" && export.Format != "tar" { c.JSON(400, gin.H{"error": "format must be zip or tar"}); return }
+	if readable, ok := authorizedFileIDs(c, req.FileIDs, permRead); !ok { return } else if len(readable) < len(req.FileIDs) { c.JSON(404, gin.H{"error": "file not found"}); return }
+	if n, _ := filesCol.CountDocuments(context.TODO(), bson.M{"file_id": bson.M{"$in": req.FileIDs}, "status": fileStatusQuarantined}); n > 0 { c.JSON(403, gin.H{"error": "export includes quarantined files"}); return }
 	res, err := fileExportsCol().InsertOne(context.TODO(), export)
 	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
 	export.ID = res.InsertedID.(primitive.ObjectID)
+	go runFileExport(export)
 	c.JSON(202, gin.H{"success": true, "data": export})
 }
 
+// runFileExport bundles the exported files into a single archive in the storage backend
+func runFileExport(export FileExport) {
+	ctx := context.Background()
+	setStatus := func(status, url string) {
+		set := bson.M{"status": status}
+		if status == "completed" || status == "failed" {
+			now := time.Now()
+			set["completed_at"] = now
+		}
+		if url != "" { set["url"] = url }
+		_, _ = fileExportsCol().UpdateOne(ctx, bson.M{"_id": export.ID}, bson.M{"$set": set})
+	}
+	setStatus("processing", "")
+
+	tmp, err := os.CreateTemp("", "export-*")
+	if err != nil { log.Errorf("Export %s failed: %v", export.ID.Hex(), err); setStatus("failed", ""); return }
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Files quarantined after the export was requested are left out
+	cur, err := filesCol.Find(ctx, bson.M{"file_id": bson.M{"$in": export.FileIDs}, "deleted_at": nil, "status": bson.M{"$ne": fileStatusQuarantined}})
+	if err != nil { log.Errorf("Export %s failed: %v", export.ID.Hex(), err); setStatus("failed", ""); return }
+	var files []File
+	_ = cur.All(ctx, &files)
+
+	if err := writeExportArchive(ctx, tmp, export.Format, files); err != nil {
+		log.Errorf("Export %s failed: %v", export.ID.Hex(), err)
+		setStatus("failed", "")
+		return
+	}
+	size, _ := tmp.Seek(0, io.SeekCurrent)
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil { setStatus("failed", ""); return }
+
+	key := fmt.Sprintf("exports/%s.%s", export.ID.Hex(), export.Format)
+	contentType := "application/zip"
+	if export.Format == "tar" { contentType = "application/x-tar" }
+	if err := blobStore.Put(ctx, key, tmp, size, contentType); err != nil {
+		log.Errorf("Export %s failed: %v", export.ID.Hex(), err)
+		setStatus("failed", "")
+		return
+	}
+	setStatus("completed", blobStore.URL(key))
+}
+
+func writeExportArchive(ctx context.Context, w io.Writer, format string, files []File) error {
+	names := map[string]int{}
+	uniqueName := func(name string) string {
+		names[name]++
+		if n := names[name]; n > 1 {
+			ext := filepath.Ext(name)
+			return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n-1, ext)
+		}
+		return name
+	}
+
+	if format == "tar" {
+		tw := tar.NewWriter(w)
+		for _, f := range files {
+			body, err := blobStore.Get(ctx, f.StorageKey)
+			if err != nil { return fmt.Errorf("read %s: %w", f.FileID, err) }
+			err = tw.WriteHeader(&tar.Header{Name: uniqueName(f.OriginalName), Mode: 0644, Size: f.Size, ModTime: f.UpdatedAt})
+			if err == nil { _, err = io.Copy(tw, body) }
+			body.Close()
+			if err != nil { return err }
+		}
+		return tw.Close()
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		body, err := blobStore.Get(ctx, f.StorageKey)
+		if err != nil { return fmt.Errorf("read %s: %w", f.FileID, err) }
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: uniqueName(f.OriginalName), Method: zip.Deflate, Modified: f.UpdatedAt})
+		if err == nil { _, err = io.Copy(entry, body) }
+		body.Close()
+		if err != nil { return err }
+	}
+	return zw.Close()
+}
+
 func getFileExportStatus(c *gin.Context) {
 	objID, _ := primitive.ObjectIDFromHex(c.Param("exportId"))
 	var export FileExport
 	err := fileExportsCol().FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&export)
-	if err != nil { c.JSON(404, gin.H{"error": "export not found"}); return }
+	if err != nil || export.CreatedBy != currentUserID(c) { c.JSON(404, gin.H{"error": "export not found"}); return }
+	if export.Status == "completed" && export.URL != "" {
+		key := fmt.Sprintf("exports/%s.%s", export.ID.Hex(), export.Format)
+		disposition := fmt.Sprintf("attachment; filename=\"export-%s.%s\"", export.ID.Hex(), export.Format)
+		downloadURL, err := blobStore.PresignGet(c.Request.Context(), key, disposition, 1*time.Hour)
+		if err != nil { c.JSON(500, gin.H{"error": "failed to generate download URL"}); return }
+		// The files count as downloaded once, when the first download URL is issued, not on every poll
+		now := time.Now()
+		res, err := fileExportsCol().UpdateOne(context.TODO(), bson.M{"_id": export.ID, "downloaded_at": nil}, bson.M{"$set": bson.M{"downloaded_at": now}})
+		if err == nil && res.ModifiedCount > 0 {
+			export.DownloadedAt = &now
+			for _, fileID := range export.FileIDs { recordDownload(c, fileID, downloadChannelExport, nil) }
+		}
+		c.JSON(200, gin.H{"success": true, "data": export, "download_url": downloadURL})
+		return
+	}
 	c.JSON(200, gin.H{"success": true, "data": export})
 }
 
@@ -477,31 +633,41 @@ func bulkDeleteFiles(c *gin.Context) {
 		objID, err := primitive.ObjectIDFromHex(id)
 		if err == nil { objIDs = append(objIDs, objID) }
 	}
-	_, _ = filesCol.UpdateMany(context.TODO(), bson.M{"_id": bson.M{"$in": objIDs}}, bson.M{"$set": bson.M{"status": "deleted", "deleted_at": time.Now()}})
-	c.JSON(200, gin.H{"success": true, "deleted": len(req.IDs)})
+	files, ok := authorizedFiles(c, bson.M{"_id": bson.M{"$in": objIDs}}, permOwner)
+	if !ok { return }
+	var fileIDs []string
+	for _, f := range files { fileIDs = append(fileIDs, f.FileID) }
+	fileIDs = skipLockedFiles(c, fileIDs)
+	_, _ = softDeleteFiles(context.TODO(), bson.M{"file_id": bson.M{"$in": fileIDs}}, bson.M{"status": "deleted"})
+	c.JSON(200, gin.H{"success": true, "deleted": len(fileIDs)})
 }
 
 func bulkFavoriteFiles(c *gin.Context) {
 	var req struct{ IDs []string `json:"ids"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
-	for _, id := range req.IDs {
-		f := FileFavorite{FileID: id, UserID: c.GetHeader("X-User-ID"), CreatedAt: time.Now()}
+	ids, ok := authorizedFileIDs(c, req.IDs, permRead)
+	if !ok { return }
+	for _, id := range ids {
+		f := FileFavorite{FileID: id, UserID: currentUserID(c), CreatedAt: time.Now()}
 		_, _ = favoritesCol().InsertOne(context.TODO(), f)
 	}
-	c.JSON(200, gin.H{"success": true, "favorited": len(req.IDs)})
+	c.JSON(200, gin.H{"success": true, "favorited": len(ids)})
 }
 
 func bulkLabelFiles(c *gin.Context) {
 	var req struct{ IDs []string `json:"ids"`; Label string `json:"label"`; Color string `json:"color"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
-	for _, id := range req.IDs {
-		l := FileLabel{FileID: id, Label: req.Label, Color: req.Color, AddedBy: c.GetHeader("X-User-ID"), CreatedAt: time.Now()}
+	ids, ok := authorizedFileIDs(c, req.IDs, permEdit)
+	if !ok { return }
+	for _, id := range ids {
+		l := FileLabel{FileID: id, Label: req.Label, Color: req.Color, AddedBy: currentUserID(c), CreatedAt: time.Now()}
 		_, _ = fileLabelsCol().InsertOne(context.TODO(), l)
 	}
-	c.JSON(200, gin.H{"success": true, "labeled": len(req.IDs)})
+	c.JSON(200, gin.H{"success": true, "labeled": len(ids)})
 }
 
 func getFileStats(c *gin.Context) {
+	if authorizedFile(c, c.Param("id"), permRead) == nil { return }
 	fileID := c.Param("id")
 	downloads, _ := fileDownloadsCol().CountDocuments(context.TODO(), bson.M{"file_id": fileID})
 	reactions, _ := fileReactionsCol().CountDocuments(context.TODO(), bson.M{"file_id": fileID})
@@ -512,6 +678,7 @@ func getFileStats(c *gin.Context) {
 
 func getWorkspaceFileStats(c *gin.Context) {
 	wsID := c.Param("workspaceId")
+	if !requireWorkspaceMember(c, wsID) { return }
 	total, _ := filesCol.CountDocuments(context.TODO(), bson.M{"workspace_id": wsID, "status": bson.M{"$ne": "deleted"}})
 	pipeline := mongo.Pipeline{
 		{{Key: "$match", Value: bson.M{"workspace_id": wsID, "status": bson.M{"$ne": "deleted"}}}},
@@ -525,12 +692,15 @@ func getWorkspaceFileStats(c *gin.Context) {
 
 func getChannelFileStats(c *gin.Context) {
 	chID := c.Param("channelId")
-	total, _ := filesCol.CountDocuments(context.TODO(), bson.M{"channel_id": chID, "status": bson.M{"$ne": "deleted"}})
+	filter := bson.M{"channel_id": chID, "status": bson.M{"$ne": "deleted"}}
+	if !restrictToVisible(c, filter) { return }
+	total, _ := filesCol.CountDocuments(context.TODO(), filter)
 	c.JSON(200, gin.H{"success": true, "data": gin.H{"total_files": total}})
 }
 
 func getFileUserStats(c *gin.Context) {
 	userID := c.Param("userId")
+	if !requireSelfOrAdmin(c, userID) { return }
 	total, _ := filesCol.CountDocuments(context.TODO(), bson.M{"uploaded_by": userID, "status": bson.M{"$ne": "deleted"}})
 	downloads, _ := fileDownloadsCol().CountDocuments(context.TODO(), bson.M{"user_id": userID})
 	c.JSON(200, gin.H{"success": true, "data": gin.H{"total_files": total, "total_downloads": downloads}})
@@ -540,32 +710,61 @@ func renameFile(c *gin.Context) {
 	var req struct{ Name string `json:"name"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
 	objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
-	_, err := filesCol.UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$set": bson.M{"original_name": req.Name, "updated_at": time.Now()}})
-	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
+	file := authorizedFileBy(c, bson.M{"_id": objID}, permEdit)
+	if file == nil || rejectLocked(c, file) || !checkIfMatch(c, file) { return }
+	err := updateFileRevision(context.TODO(), file, bson.M{"$set": bson.M{"original_name": req.Name, "updated_at": time.Now()}})
+	if err != nil { respondUpdateError(c, err, "failed to rename file"); return }
+	c.Header("ETag", revisionETag(file.Revision))
 	c.JSON(200, gin.H{"success": true})
 }
 
 func copyFile(c *gin.Context) {
 	objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
-	var file bson.M
-	err := filesCol.FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&file)
-	if err != nil { c.JSON(404, gin.H{"error": "file not found"}); return }
-	file["_id"] = primitive.NewObjectID()
-	file["created_at"] = time.Now()
-	file["updated_at"] = time.Now()
-	res, err := filesCol.InsertOne(context.TODO(), file)
-	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
-	c.JSON(201, gin.H{"success": true, "new_id": res.InsertedID})
+	file := authorizedFileBy(c, bson.M{"_id": objID}, permRead)
+	if file == nil { return }
+	newFile, err := duplicateFile(c.Request.Context(), *file, currentUserID(c), nil)
+	if err != nil { respondPolicyError(c, err); return }
+	c.JSON(201, gin.H{"success": true, "new_id": newFile.ID, "data": newFile})
 }
 
 func moveFile(c *gin.Context) {
 	var req struct{ ChannelID string `json:"channel_id"`; WorkspaceID string `json:"workspace_id"` }
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
 	objID, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	var file File
+	if err := filesCol.FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&file); err != nil { c.JSON(404, gin.H{"error": "file not found"}); return }
+	// Moving to another workspace charges the file to that workspace's quota
+	crossWorkspace := req.WorkspaceID != "" && req.WorkspaceID != file.WorkspaceID && file.DeletedAt == nil
+	if crossWorkspace {
+		if !checkFileAccess(c, &file, permOwner) || !requireWorkspaceMember(c, req.WorkspaceID) { return }
+	} else if !checkFileAccess(c, &file, permEdit) { return }
+	if rejectLocked(c, &file) || !checkIfMatch(c, &file) { return }
 	update := bson.M{"updated_at": time.Now()}
 	if req.ChannelID != "" { update["channel_id"] = req.ChannelID }
 	if req.WorkspaceID != "" { update["workspace_id"] = req.WorkspaceID }
-	_, err := filesCol.UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$set": update})
-	if err != nil { c.JSON(500, gin.H{"error": err.Error()}); return }
+	if crossWorkspace {
+		if err := reserveQuota(context.TODO(), file.FileID, req.WorkspaceID, file.UploadedBy, file.Size, time.Minute); err != nil { respondPolicyError(c, err); return }
+	}
+	err := updateFileRevision(context.TODO(), &file, bson.M{"$set": update})
+	if err != nil {
+		if crossWorkspace { releaseQuota(context.TODO(), file.FileID) }
+		respondUpdateError(c, err, "failed to move file"); return
+	}
+	if crossWorkspace {
+		commitQuota(context.TODO(), file.FileID, req.WorkspaceID, file.UploadedBy, file.Size)
+		creditQuota(context.TODO(), &file)
+	}
+	c.Header("ETag", revisionETag(file.Revision))
 	c.JSON(200, gin.H{"success": true})
 }
+
+// filterByFileID keeps the items whose file ID is in fileIDs
+func filterByFileID[T any](items []T, fileIDs []string, fileID func(T) string) []T {
+	keep := make(map[string]bool, len(fileIDs))
+	for _, id := range fileIDs { keep[id] = true }
+	out := []T{}
+	for _, item := range items {
+		if keep[fileID(item)] { out = append(out, item) }
+	}
+	return out
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A file can be checked out by one user at a time so collaborators editing a document
+// don't overwrite each other. While it is locked, only the holder may upload versions,
+// restore, rename, move or delete it. Locks live in Redis (file_lock:<id>) and expire on
+// their own unless refreshed; the lock is mirrored on the File so listings can show who
+// holds it, but Redis is what's enforced.
+const (
+	defaultFileLockTTL = 30 * time.Minute
+	maxFileLockTTL     = 8 * time.Hour
+)
+
+// FileLock records who has a file checked out and until when
+type FileLock struct {
+	UserID     string    `json:"user_id" bson:"user_id"`
+	AcquiredAt time.Time `json:"acquired_at" bson:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+func fileLockKey(fileID string) string {
+	return "file_lock:" + fileID
+}
+
+// lockScript takes or extends a lock for ARGV[1]. A lock held by someone else is left
+// alone and returned with status 0; refreshing (ARGV[4] = 1) a lock that has expired
+// returns status 2. On success it returns status 1 and the lock now held.
+var lockScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+local lock
+if current then
+	lock = cjson.decode(current)
+	if lock.user_id ~= ARGV[1] then
+		return {0, current}
+	end
+	lock.expires_at = ARGV[3]
+elseif ARGV[4] == '1' then
+	return {2, ''}
+else
+	lock = cjson.decode(ARGV[2])
+end
+local value = cjson.encode(lock)
+redis.call('SET', KEYS[1], value, 'PX', ARGV[5])
+return {1, value}
+`)
+
+// unlockScript releases a lock held by ARGV[1], or whoever holds it when ARGV[1] is
+// empty. Returns 1 if released, 0 if there was no lock and -1 if someone else holds it.
+var unlockScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+if ARGV[1] ~= '' and cjson.decode(current).user_id ~= ARGV[1] then
+	return -1
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+func registerLockRoutes(api *gin.RouterGroup) {
+	api.GET("/:id/lock", getFileLock)
+	api.POST("/:id/lock", lockFile)
+	api.PUT("/:id/lock", refreshFileLock)
+	api.DELETE("/:id/lock", unlockFile)
+}
+
+// activeFileLock returns the lock held on a file, or nil. If Redis can't be reached the
+// lock mirrored on the file is used instead.
+func activeFileLock(ctx context.Context, file *File) *FileLock {
+	data, err := redisClient.Get(ctx, fileLockKey(file.FileID)).Bytes()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		if file.Lock != nil && file.Lock.ExpiresAt.After(time.Now()) {
+			return file.Lock
+		}
+		return nil
+	}
+	var lock FileLock
+	if json.Unmarshal(data, &lock) != nil {
+		return nil
+	}
+	return &lock
+}
+
+// rejectLocked writes a 423 and returns true if someone other than the caller holds the
+// file's lock
+func rejectLocked(c *gin.Context, file *File) bool {
+	lock := activeFileLock(c.Request.Context(), file)
+	if lock == nil || lock.UserID == currentUserID(c) {
+		return false
+	}
+	c.JSON(423, gin.H{"error": "file is locked by another user", "lock": lock})
+	return true
+}
+
+// skipLockedFiles drops the files locked by someone other than the caller from a bulk
+// operation
+func skipLockedFiles(c *gin.Context, fileIDs []string) []string {
+	if len(fileIDs) == 0 {
+		return fileIDs
+	}
+	keys := make([]string, len(fileIDs))
+	for i, id := range fileIDs {
+		keys[i] = fileLockKey(id)
+	}
+	values, err := redisClient.MGet(c.Request.Context(), keys...).Result()
+	if err != nil {
+		log.Warnf("Failed to check file locks: %v", err)
+		return fileIDs
+	}
+	userID := currentUserID(c)
+	unlocked := []string{}
+	for i, value := range values {
+		var lock FileLock
+		if s, ok := value.(string); ok && json.Unmarshal([]byte(s), &lock) == nil && lock.UserID != userID {
+			continue
+		}
+		unlocked = append(unlocked, fileIDs[i])
+	}
+	return unlocked
+}
+
+// mirrorFileLock copies a lock change onto the File document; a nil lock clears the
+// mirror if it still names holder
+func mirrorFileLock(ctx context.Context, fileID, holder string, lock *FileLock) {
+	var err error
+	if lock != nil {
+		_, err = filesCol.UpdateOne(ctx, bson.M{"file_id": fileID}, bson.M{"$set": bson.M{"lock": lock}})
+	} else {
+		_, err = filesCol.UpdateOne(ctx, bson.M{"file_id": fileID, "lock.user_id": holder}, bson.M{"$unset": bson.M{"lock": ""}})
+	}
+	if err != nil {
+		log.WithField("file_id", fileID).Warnf("Failed to mirror file lock: %v", err)
+	}
+	redisClient.Del(ctx, "file:"+fileID)
+}
+
+func lockTTL(c *gin.Context) (time.Duration, bool) {
+	var req struct {
+		TTLSeconds int `json:"ttl_seconds"`
+	}
+	c.ShouldBindJSON(&req)
+	if req.TTLSeconds == 0 {
+		return defaultFileLockTTL, true
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl < time.Minute || ttl > maxFileLockTTL {
+		c.JSON(400, gin.H{"error": "ttl_seconds must be between 60 and " + strconv.Itoa(int(maxFileLockTTL.Seconds()))})
+		return 0, false
+	}
+	return ttl, true
+}
+
+// takeFileLock acquires or, with refresh set, extends the caller's lock and writes the
+// response
+func takeFileLock(c *gin.Context, refresh bool) {
+	file := authorizedFile(c, c.Param("id"), permEdit)
+	if file == nil {
+		return
+	}
+	ttl, ok := lockTTL(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	userID := currentUserID(c)
+	now := time.Now().UTC()
+	lock := FileLock{UserID: userID, AcquiredAt: now, ExpiresAt: now.Add(ttl)}
+	data, _ := json.Marshal(lock)
+	expiresAt, _ := lock.ExpiresAt.MarshalText()
+	flag := "0"
+	if refresh {
+		flag = "1"
+	}
+	res, err := lockScript.Run(ctx, redisClient, []string{fileLockKey(file.FileID)},
+		userID, data, string(expiresAt), flag, ttl.Milliseconds()).Slice()
+	if err != nil || len(res) != 2 {
+		log.Errorf("Failed to lock file %s: %v", file.FileID, err)
+		c.JSON(500, gin.H{"error": "failed to lock file"})
+		return
+	}
+	status, _ := res[0].(int64)
+	value, _ := res[1].(string)
+	if status == 2 {
+		c.JSON(409, gin.H{"error": "lock has expired, lock the file again"})
+		return
+	}
+	if err := json.Unmarshal([]byte(value), &lock); err != nil {
+		c.JSON(500, gin.H{"error": "failed to lock file"})
+		return
+	}
+	if status == 0 {
+		c.JSON(423, gin.H{"error": "file is locked by another user", "lock": lock})
+		return
+	}
+
+	mirrorFileLock(ctx, file.FileID, userID, &lock)
+	if !refresh {
+		logFileActivity(ctx, file.FileID, userID, "locked", "")
+		publishEvent(FileEvent{
+			Type:        "file.locked",
+			FileID:      file.FileID,
+			WorkspaceID: file.WorkspaceID,
+			UserID:      userID,
+			Data:        lock,
+			Timestamp:   now,
+		})
+	}
+	c.JSON(200, gin.H{"success": true, "data": lock})
+}
+
+// ── Lock handlers ──
+
+func getFileLock(c *gin.Context) {
+	file := authorizedFile(c, c.Param("id"), permRead)
+	if file == nil {
+		return
+	}
+	lock := activeFileLock(c.Request.Context(), file)
+	c.JSON(200, gin.H{"success": true, "locked": lock != nil, "data": lock})
+}
+
+// lockFile checks a file out to the caller; locking a file the caller already holds
+// extends the lock. Body: {"ttl_seconds": n}, optional.
+func lockFile(c *gin.Context) {
+	takeFileLock(c, false)
+}
+
+func refreshFileLock(c *gin.Context) {
+	takeFileLock(c, true)
+}
+
+// unlockFile releases the caller's lock. Workspace admins can release anyone's with
+// ?force=true.
+func unlockFile(c *gin.Context) {
+	force := c.Query("force") == "true"
+	action := permEdit
+	if force {
+		action = permRead
+	}
+	file := authorizedFile(c, c.Param("id"), action)
+	if file == nil || (force && !requireWorkspaceAdmin(c, file.WorkspaceID)) {
+		return
+	}
+	ctx := c.Request.Context()
+	holder := currentUserID(c)
+	lock := activeFileLock(ctx, file)
+	if force && lock != nil {
+		holder = lock.UserID
+	}
+	owner := holder
+	if force {
+		owner = ""
+	}
+	released, err := unlockScript.Run(ctx, redisClient, []string{fileLockKey(file.FileID)}, owner).Int()
+	if err != nil {
+		log.Errorf("Failed to unlock file %s: %v", file.FileID, err)
+		c.JSON(500, gin.H{"error": "failed to unlock file"})
+		return
+	}
+	switch released {
+	case 0:
+		c.JSON(404, gin.H{"error": "file is not locked"})
+		return
+	case -1:
+		c.JSON(423, gin.H{"error": "file is locked by another user", "lock": lock})
+		return
+	}
+
+	mirrorFileLock(ctx, file.FileID, holder, nil)
+	by := currentUserID(c)
+	details := ""
+	if force {
+		details = "forced, held by " + holder
+	}
+	logFileActivity(ctx, file.FileID, by, "unlocked", details)
+	publishEvent(FileEvent{
+		Type:        "file.unlocked",
+		FileID:      file.FileID,
+		WorkspaceID: file.WorkspaceID,
+		UserID:      by,
+		Data:        map[string]interface{}{"holder": holder, "forced": force},
+		Timestamp:   time.Now(),
+	})
+	c.JSON(200, gin.H{"success": true, "message": "file unlocked"})
+}
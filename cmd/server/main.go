@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,9 +20,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
@@ -33,36 +34,56 @@ import (
 
 // File represents a file stored in the system
 type File struct {
-	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	FileID       string             `json:"file_id" bson:"file_id"`
-	Name         string             `json:"name" bson:"name"`
-	OriginalName string             `json:"original_name" bson:"original_name"`
-	MimeType     string             `json:"mime_type" bson:"mime_type"`
-	Size         int64              `json:"size" bson:"size"`
-	StorageKey   string             `json:"storage_key" bson:"storage_key"`
-	URL          string             `json:"url" bson:"url"`
-	ThumbnailURL *string            `json:"thumbnail_url" bson:"thumbnail_url"`
-	WorkspaceID  string             `json:"workspace_id" bson:"workspace_id"`
-	ChannelID    *string            `json:"channel_id" bson:"channel_id"`
-	MessageID    *string            `json:"message_id" bson:"message_id"`
-	UploadedBy   string             `json:"uploaded_by" bson:"uploaded_by"`
-	Checksum     string             `json:"checksum" bson:"checksum"`
-	FileType     string             `json:"file_type" bson:"file_type"` // image, video, audio, document
-	Metadata     FileMetadata       `json:"metadata" bson:"metadata"`
-	IsPublic     bool               `json:"is_public" bson:"is_public"`
-	SharedWith   []string           `json:"shared_with" bson:"shared_with"`
-	Downloads    int64              `json:"downloads" bson:"downloads"`
-	DeletedAt    *time.Time         `json:"deleted_at" bson:"deleted_at"`
-	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt    time.Time          `json:"updated_at" bson:"updated_at"`
+	ID               primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FileID           string             `json:"file_id" bson:"file_id"`
+	Name             string             `json:"name" bson:"name"`
+	OriginalName     string             `json:"original_name" bson:"original_name"`
+	MimeType         string             `json:"mime_type" bson:"mime_type"`
+	DetectedMimeType string             `json:"detected_mime_type" bson:"detected_mime_type"`
+	Size             int64              `json:"size" bson:"size"`
+	StorageKey       string             `json:"storage_key" bson:"storage_key"`
+	URL              string             `json:"url" bson:"url"`
+	ThumbnailURL     *string            `json:"thumbnail_url" bson:"thumbnail_url"`
+	WorkspaceID      string             `json:"workspace_id" bson:"workspace_id"`
+	ChannelID        *string            `json:"channel_id" bson:"channel_id"`
+	MessageID        *string            `json:"message_id" bson:"message_id"`
+	UploadedBy       string             `json:"uploaded_by" bson:"uploaded_by"`
+	ModifiedBy       string             `json:"modified_by,omitempty" bson:"modified_by,omitempty"` // last to replace the content
+	Checksum         string             `json:"checksum" bson:"checksum"`
+	OriginalChecksum string             `json:"original_checksum,omitempty" bson:"original_checksum,omitempty"`
+	FileType         string             `json:"file_type" bson:"file_type"` // image, video, audio, document
+	Metadata         FileMetadata       `json:"metadata" bson:"metadata"`
+	IsPublic         bool               `json:"is_public" bson:"is_public"`
+	SharedWith       []string           `json:"shared_with" bson:"shared_with"`
+	Downloads        int64              `json:"downloads" bson:"downloads"`
+	Status           string             `json:"status" bson:"status"` // active, quarantined
+	Quarantine       *FileQuarantine    `json:"quarantine,omitempty" bson:"quarantine,omitempty"`
+	Revision         int64              `json:"revision" bson:"revision"`             // bumped by every user change, see revision.go
+	VersionCounter   int                `json:"-" bson:"version_counter,omitempty"`   // last version number handed out
+	Lock             *FileLock          `json:"lock,omitempty" bson:"lock,omitempty"` // mirror of the Redis lock, see locks.go
+	DeletedAt        *time.Time         `json:"deleted_at" bson:"deleted_at"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at" bson:"updated_at"`
 }
 
 // FileMetadata stores type-specific metadata
 type FileMetadata struct {
-	Width    *int     `json:"width,omitempty" bson:"width,omitempty"`
-	Height   *int     `json:"height,omitempty" bson:"height,omitempty"`
-	Duration *float64 `json:"duration,omitempty" bson:"duration,omitempty"`
-	Pages    *int     `json:"pages,omitempty" bson:"pages,omitempty"`
+	Width       *int       `json:"width,omitempty" bson:"width,omitempty"`
+	Height      *int       `json:"height,omitempty" bson:"height,omitempty"`
+	Duration    *float64   `json:"duration,omitempty" bson:"duration,omitempty"` // seconds
+	Pages       *int       `json:"pages,omitempty" bson:"pages,omitempty"`
+	Orientation *int       `json:"orientation,omitempty" bson:"orientation,omitempty"` // EXIF orientation, 1-8
+	CameraMake  *string    `json:"camera_make,omitempty" bson:"camera_make,omitempty"`
+	CameraModel *string    `json:"camera_model,omitempty" bson:"camera_model,omitempty"`
+	CapturedAt  *time.Time `json:"captured_at,omitempty" bson:"captured_at,omitempty"`
+	GPS         *GeoPoint  `json:"gps,omitempty" bson:"gps,omitempty"`
+}
+
+// FileQuarantine records why a file was quarantined, by whom and when
+type FileQuarantine struct {
+	Reason string    `json:"reason" bson:"reason"`
+	By     string    `json:"by" bson:"by"`
+	At     time.Time `json:"at" bson:"at"`
 }
 
 // FileEvent for Kafka publishing
@@ -75,6 +96,20 @@ type FileEvent struct {
 	Timestamp   time.Time   `json:"timestamp"`
 }
 
+// PendingUpload is the Redis-held state of an upload whose content has not been confirmed yet
+type PendingUpload struct {
+	FileID           string `json:"file_id"`
+	Filename         string `json:"filename"`
+	ContentType      string `json:"content_type"`
+	Size             int64  `json:"size"`
+	WorkspaceID      string `json:"workspace_id"`
+	UploadedBy       string `json:"uploaded_by"`
+	ChannelID        string `json:"channel_id"`
+	StorageKey       string `json:"storage_key"`
+	FileType         string `json:"file_type"`
+	DetectedMimeType string `json:"detected_mime_type,omitempty"`
+}
+
 // PresignedURLResponse for upload URL generation
 type PresignedURLResponse struct {
 	UploadURL string `json:"upload_url"`
@@ -84,15 +119,12 @@ type PresignedURLResponse struct {
 }
 
 var (
-	log           *logrus.Logger
-	mongoClient   *mongo.Client
-	mongoDB       *mongo.Database
-	filesCol      *mongo.Collection
-	redisClient   *redis.Client
-	s3Client      *s3.Client
-	s3PresignClient *s3.PresignClient
-	kafkaWriter   *kafka.Writer
-	s3Bucket      string
+	log         *logrus.Logger
+	mongoClient *mongo.Client
+	mongoDB     *mongo.Database
+	filesCol    *mongo.Collection
+	redisClient *redis.Client
+	kafkaWriter *kafka.Writer
 )
 
 // Allowed MIME types
@@ -108,22 +140,22 @@ var allowedMimeTypes = map[string]string{
 	"video/webm":      "video",
 	"video/quicktime": "video",
 	// Audio
-	"audio/mpeg":  "audio",
-	"audio/wav":   "audio",
-	"audio/ogg":   "audio",
-	"audio/webm":  "audio",
+	"audio/mpeg": "audio",
+	"audio/wav":  "audio",
+	"audio/ogg":  "audio",
+	"audio/webm": "audio",
 	// Documents
 	"application/pdf":    "document",
 	"application/msword": "document",
 	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "document",
 	"application/vnd.ms-excel": "document",
-	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       "document",
-	"application/vnd.ms-powerpoint": "document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         "document",
+	"application/vnd.ms-powerpoint":                                             "document",
 	"application/vnd.openxmlformats-officedocument.presentationml.presentation": "document",
-	"text/plain":      "document",
-	"text/csv":        "document",
-	"application/json": "document",
-	"application/zip": "archive",
+	"text/plain":                   "document",
+	"text/csv":                     "document",
+	"application/json":             "document",
+	"application/zip":              "archive",
 	"application/x-rar-compressed": "archive",
 	"application/x-7z-compressed":  "archive",
 }
@@ -167,17 +199,13 @@ func main() {
 	})
 	defer redisClient.Close()
 
-	// Initialize S3
-	s3Bucket = getEnv("S3_BUCKET", "quckapp-files")
-	awsCfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(getEnv("AWS_REGION", "us-east-1")),
-	)
-	if err != nil {
-		log.Warnf("Failed to load AWS config: %v (S3 features disabled)", err)
-	} else {
-		s3Client = s3.NewFromConfig(awsCfg)
-		s3PresignClient = s3.NewPresignClient(s3Client)
-	}
+	// Initialize storage backend (S3 or local filesystem)
+	initBlobStore(ctx)
+	initMimePolicy()
+	initQuotas()
+	initThumbnails()
+	initScanner()
+	initAuth(ctx)
 
 	// Initialize Kafka
 	kafkaWriter = &kafka.Writer{
@@ -188,6 +216,19 @@ func main() {
 	}
 	defer kafkaWriter.Close()
 
+	// Background workers stop when the service shuts down
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	go runMultipartJanitor(workerCtx)
+	go runResumableJanitor(workerCtx)
+	go runQuotaJanitor(workerCtx)
+	go runVersionPruner(workerCtx)
+	go runThumbnailWorker(workerCtx)
+	go runMetadataWorker(workerCtx)
+	go runScanWorker(workerCtx)
+	go runScanRetrier(workerCtx)
+	go runDownloadLogWriter(workerCtx)
+
 	// Setup router
 	r := gin.New()
 	r.Use(gin.Recovery())
@@ -201,14 +242,31 @@ func main() {
 	r.GET("/health", healthCheck)
 	r.GET("/ready", readinessCheck)
 
+	// Local storage backend serves its own signed URLs
+	registerLocalStorageRoutes(r)
+	registerSignedDownloadRoutes(r)
+
+	// Share link recipients fetch content here, without a token
+	registerShareRoutes(r)
+
 	api := r.Group("/api/v1/files")
+	// Share links are opened by recipients without an account
+	api.Use(authMiddleware("/api/v1/files/shared/:token"))
 	{
 		// File operations
 		api.POST("/upload", uploadFile)
 		api.POST("/upload/presigned", getPresignedUploadURL)
 		api.POST("/upload/complete", completeUpload)
+		registerResumableRoutes(api)
+		registerMultipartRoutes(api)
+		registerPolicyRoutes(api)
+		registerRetentionRoutes(api)
+		registerLockRoutes(api)
+		registerQuarantineRoutes(api)
 		api.GET("/:id", getFile)
 		api.GET("/:id/download", downloadFile)
+		api.GET("/:id/content", getFileContent)
+		api.HEAD("/:id/content", getFileContent)
 		api.DELETE("/:id", deleteFile)
 		api.PUT("/:id", updateFile)
 
@@ -251,12 +309,14 @@ func main() {
 	<-quit
 
 	log.Info("Shutting down file service...")
+	stopWorkers()
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Errorf("Server shutdown error: %v", err)
 	}
+	flushDownloadLogs(shutdownCtx)
 	log.Info("File service stopped")
 }
 
@@ -276,8 +336,28 @@ func createIndexes(ctx context.Context) {
 		{Keys: bson.D{{Key: "created_at", Value: -1}}},
 		{Keys: bson.D{{Key: "deleted_at", Value: 1}}},
 		{Keys: bson.D{{Key: "checksum", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "workspace_id", Value: 1}}},
+		{Keys: bson.D{{Key: "original_checksum", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "metadata.captured_at", Value: -1}}},
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "metadata.duration", Value: 1}}},
 	}
 	filesCol.Indexes().CreateMany(ctx, indexes)
+	fileDownloadsCol().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "download_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "download_at", Value: -1}}},
+	})
+	versionsCol().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "owner_id", Value: 1}},
+	})
+	// Versions numbered before the counter existed may have duplicates to clean up first
+	if _, err := versionsCol().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "version_num", Value: 1}}, Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Errorf("Failed to create unique version number index: %v", err)
+	}
+	linksCol().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
 }
 
 func requestLogger() gin.HandlerFunc {
@@ -296,9 +376,13 @@ func requestLogger() gin.HandlerFunc {
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Defer-Length")
+		c.Header("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Upload-File-ID")
 		if c.Request.Method == "OPTIONS" {
+			if strings.HasPrefix(c.Request.URL.Path, tusBasePath) {
+				setTusDiscoveryHeaders(c)
+			}
 			c.AbortWithStatus(204)
 			return
 		}
@@ -333,64 +417,89 @@ func readinessCheck(c *gin.Context) {
 	c.JSON(200, gin.H{"status": "ready"})
 }
 
-// Upload file directly (multipart)
+// Upload file directly (multipart). The file part is streamed to the storage
+// backend while its checksum is computed, so form fields must precede it.
 func uploadFile(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "no file provided"})
+	fields, part, ok := readUploadPart(c)
+	if !ok {
 		return
 	}
-	defer file.Close()
+	defer part.Close()
 
-	workspaceID := c.PostForm("workspace_id")
-	uploadedBy := c.PostForm("uploaded_by")
-	channelID := c.PostForm("channel_id")
-	messageID := c.PostForm("message_id")
+	filename := part.FileName()
+	workspaceID := fields["workspace_id"]
+	uploadedBy := currentUserID(c)
+	channelID := fields["channel_id"]
+	messageID := fields["message_id"]
 
-	if workspaceID == "" || uploadedBy == "" {
-		c.JSON(400, gin.H{"error": "workspace_id and uploaded_by are required"})
+	if workspaceID == "" {
+		c.JSON(400, gin.H{"error": "workspace_id is required and must precede the file part"})
 		return
 	}
-
-	// Validate MIME type
-	mimeType := header.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = detectMimeType(header.Filename)
+	if !requireWorkspaceMember(c, workspaceID) {
+		return
 	}
 
-	fileType, ok := allowedMimeTypes[mimeType]
+	// Classify the content from its leading bytes, then validate MIME type
+	content, classified, ok := classifyUploadPart(c, part)
 	if !ok {
-		c.JSON(400, gin.H{"error": "file type not allowed", "mime_type": mimeType})
 		return
 	}
+	mimeType := classified.MimeType
 
-	// Validate size
-	maxSize := maxFileSizes[fileType]
-	if header.Size > maxSize {
-		c.JSON(400, gin.H{"error": fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))})
+	// Enforce the workspace upload policy
+	policy := getUploadPolicy(c.Request.Context(), workspaceID)
+	fileType, err := policy.Check(filename, mimeType, -1)
+	if err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	if err := policy.CheckMessageLimit(c.Request.Context(), messageID); err != nil {
+		respondPolicyError(c, err)
 		return
 	}
 
-	// Read file content
-	content, err := io.ReadAll(file)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "failed to read file"})
+	// Validate size (the request length bounds the part size when it is known)
+	maxSize := policy.MaxSize(fileType)
+	if c.Request.ContentLength > 0 && c.Request.ContentLength > maxSize+1024*1024 {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))})
 		return
 	}
 
-	// Calculate checksum
-	hash := sha256.Sum256(content)
-	checksum := hex.EncodeToString(hash[:])
+	// Generate file ID and storage key
+	fileID := uuid.New().String()
+	ext := filepath.Ext(filename)
+	storageKey := fmt.Sprintf("files/%s/%s/%s%s", workspaceID, uploadedBy, fileID, ext)
+
+	// Reserve quota for the largest size this request can carry
+	reserve := maxSize
+	if c.Request.ContentLength > 0 && c.Request.ContentLength < reserve {
+		reserve = c.Request.ContentLength
+	}
+	if err := reserveQuota(c.Request.Context(), fileID, workspaceID, uploadedBy, reserve, time.Hour); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	defer releaseQuota(context.Background(), fileID)
+
+	stored, ok := storeUpload(c, content, storageKey, mimeType, policy, maxSize)
+	if !ok {
+		return
+	}
+	size, checksum, originalChecksum := stored.Size, stored.Checksum, stored.OriginalChecksum
+	fileURL := blobStore.URL(storageKey)
 
-	// Check for duplicate
+	// Check for duplicate. Files the uploader can't read are not disclosed; the upload
+	// is stored as a new file instead.
 	var existingFile File
 	err = filesCol.FindOne(c.Request.Context(), bson.M{
-		"checksum":     checksum,
+		"$or":          checksumMatch(checksum, originalChecksum),
 		"workspace_id": workspaceID,
 		"deleted_at":   nil,
 	}).Decode(&existingFile)
-	if err == nil {
-		// Return existing file
+	if err == nil && authorize(c.Request.Context(), currentPrincipal(c), &existingFile, permRead) == nil {
+		// Return existing file and drop the copy we just stored
+		blobStore.Delete(c.Request.Context(), storageKey)
 		c.JSON(200, gin.H{
 			"file":      existingFile,
 			"duplicate": true,
@@ -399,56 +508,28 @@ func uploadFile(c *gin.Context) {
 		return
 	}
 
-	// Generate file ID and storage key
-	fileID := uuid.New().String()
-	ext := filepath.Ext(header.Filename)
-	storageKey := fmt.Sprintf("files/%s/%s/%s%s", workspaceID, uploadedBy, fileID, ext)
-
-	// Upload to S3
-	var fileURL string
-	if s3Client != nil {
-		_, err = s3Client.PutObject(c.Request.Context(), &s3.PutObjectInput{
-			Bucket:      aws.String(s3Bucket),
-			Key:         aws.String(storageKey),
-			Body:        strings.NewReader(string(content)),
-			ContentType: aws.String(mimeType),
-		})
-		if err != nil {
-			log.Errorf("Failed to upload to S3: %v", err)
-			c.JSON(500, gin.H{"error": "failed to store file"})
-			return
-		}
-		fileURL = fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s3Bucket, storageKey)
-	} else {
-		// Fallback: store locally (for development)
-		localPath := filepath.Join("uploads", storageKey)
-		os.MkdirAll(filepath.Dir(localPath), 0755)
-		if err := os.WriteFile(localPath, content, 0644); err != nil {
-			c.JSON(500, gin.H{"error": "failed to store file locally"})
-			return
-		}
-		fileURL = fmt.Sprintf("/uploads/%s", storageKey)
-	}
-
 	now := time.Now()
 	newFile := File{
-		FileID:       fileID,
-		Name:         fileID + ext,
-		OriginalName: header.Filename,
-		MimeType:     mimeType,
-		Size:         header.Size,
-		StorageKey:   storageKey,
-		URL:          fileURL,
-		WorkspaceID:  workspaceID,
-		UploadedBy:   uploadedBy,
-		Checksum:     checksum,
-		FileType:     fileType,
-		Metadata:     FileMetadata{},
-		IsPublic:     false,
-		SharedWith:   []string{},
-		Downloads:    0,
-		CreatedAt:    now,
-		UpdatedAt:    now,
+		FileID:           fileID,
+		Name:             fileID + ext,
+		OriginalName:     filename,
+		MimeType:         mimeType,
+		DetectedMimeType: classified.DetectedMimeType,
+		Size:             size,
+		StorageKey:       storageKey,
+		URL:              fileURL,
+		WorkspaceID:      workspaceID,
+		UploadedBy:       uploadedBy,
+		Checksum:         checksum,
+		OriginalChecksum: originalChecksum,
+		FileType:         fileType,
+		Metadata:         FileMetadata{},
+		IsPublic:         false,
+		SharedWith:       []string{},
+		Downloads:        0,
+		Status:           fileStatusActive,
+		CreatedAt:        now,
+		UpdatedAt:        now,
 	}
 
 	if channelID != "" {
@@ -461,11 +542,13 @@ func uploadFile(c *gin.Context) {
 	result, err := filesCol.InsertOne(c.Request.Context(), newFile)
 	if err != nil {
 		log.Errorf("Failed to save file metadata: %v", err)
+		blobStore.Delete(c.Request.Context(), storageKey)
 		c.JSON(500, gin.H{"error": "failed to save file"})
 		return
 	}
 
 	newFile.ID = result.InsertedID.(primitive.ObjectID)
+	commitQuota(c.Request.Context(), fileID, workspaceID, uploadedBy, size)
 
 	// Publish event
 	publishEvent(FileEvent{
@@ -474,8 +557,8 @@ func uploadFile(c *gin.Context) {
 		WorkspaceID: workspaceID,
 		UserID:      uploadedBy,
 		Data: map[string]interface{}{
-			"filename":  header.Filename,
-			"size":      header.Size,
+			"filename":  filename,
+			"size":      size,
 			"mime_type": mimeType,
 		},
 		Timestamp: now,
@@ -484,76 +567,178 @@ func uploadFile(c *gin.Context) {
 	// Cache file metadata
 	cacheFile(c.Request.Context(), &newFile)
 
-	log.WithFields(logrus.Fields{"file_id": fileID, "size": header.Size}).Info("File uploaded")
+	log.WithFields(logrus.Fields{"file_id": fileID, "size": size}).Info("File uploaded")
 	c.JSON(201, newFile)
 }
 
+// readUploadPart reads the form fields that precede the "file" part of a multipart
+// upload and returns them with the part itself, which streams straight from the request
+func readUploadPart(c *gin.Context) (map[string]string, *multipart.Part, bool) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "multipart body required"})
+		return nil, nil, false
+	}
+
+	fields := map[string]string{}
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(400, gin.H{"error": "malformed multipart body"})
+			return nil, nil, false
+		}
+		if p.FormName() == "file" {
+			return fields, p, true
+		}
+		value, _ := io.ReadAll(io.LimitReader(p, 4096))
+		fields[p.FormName()] = string(value)
+	}
+	c.JSON(400, gin.H{"error": "no file provided"})
+	return nil, nil, false
+}
+
+// classifyUploadPart sniffs the leading bytes of an uploaded part. The returned reader
+// still yields the whole content.
+func classifyUploadPart(c *gin.Context, part *multipart.Part) (*bufio.Reader, *ContentClassification, bool) {
+	content := bufio.NewReaderSize(part, sniffLen)
+	head, err := content.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		c.JSON(400, gin.H{"error": "failed to read file"})
+		return nil, nil, false
+	}
+	classified, err := classifyUpload(head, part.FileName(), part.Header.Get("Content-Type"))
+	if err != nil {
+		var verr *UploadVerificationError
+		if errors.As(err, &verr) {
+			c.JSON(verr.Status, gin.H{"error": verr.Message})
+			return nil, nil, false
+		}
+		c.JSON(500, gin.H{"error": "failed to classify file"})
+		return nil, nil, false
+	}
+	return content, classified, true
+}
+
+// storedUpload describes content written to the storage backend by storeUpload
+type storedUpload struct {
+	Size             int64
+	Checksum         string
+	OriginalChecksum string // checksum before sanitizing, empty if untouched
+}
+
+// storeUpload streams content to storageKey, sanitizing images first when the policy
+// asks for it, and rejects content over maxSize. On failure it writes the response,
+// removes anything it stored and returns false.
+func storeUpload(c *gin.Context, content io.Reader, storageKey, mimeType string, policy *WorkspaceUploadPolicy, maxSize int64) (*storedUpload, bool) {
+	// Photos are scrubbed in memory before storage when the workspace opted in
+	var source io.Reader = content
+	limit := maxSize
+	originalChecksum := ""
+	if policy.SanitizeImages && sanitizableImageTypes[mimeType] {
+		data, err := io.ReadAll(io.LimitReader(content, maxSize+1))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "failed to read file"})
+			return nil, false
+		}
+		if int64(len(data)) > maxSize {
+			c.JSON(413, gin.H{"error": fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))})
+			return nil, false
+		}
+		sum := sha256.Sum256(data)
+		originalChecksum = hex.EncodeToString(sum[:])
+		if data, err = sanitizeImage(data, mimeType); err != nil {
+			c.JSON(422, gin.H{"error": "failed to sanitize image: " + err.Error()})
+			return nil, false
+		}
+		source = bytes.NewReader(data)
+		limit = max(limit, int64(len(data)))
+	}
+
+	// Stream to storage backend, hashing and counting on the way through
+	hasher := sha256.New()
+	body := &countingReader{r: io.LimitReader(source, limit+1)}
+	err := blobStore.Put(c.Request.Context(), storageKey, io.TeeReader(body, hasher), -1, mimeType)
+	if err != nil {
+		log.Errorf("Failed to store file: %v", err)
+		blobStore.Delete(context.Background(), storageKey)
+		c.JSON(500, gin.H{"error": "failed to store file"})
+		return nil, false
+	}
+	if body.n > limit {
+		blobStore.Delete(c.Request.Context(), storageKey)
+		c.JSON(413, gin.H{"error": fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))})
+		return nil, false
+	}
+	return &storedUpload{
+		Size:             body.n,
+		Checksum:         hex.EncodeToString(hasher.Sum(nil)),
+		OriginalChecksum: originalChecksum,
+	}, true
+}
+
 // Get presigned URL for direct upload to S3
 func getPresignedUploadURL(c *gin.Context) {
 	var req struct {
 		Filename    string `json:"filename" binding:"required"`
 		ContentType string `json:"content_type" binding:"required"`
-		Size        int64  `json:"size" binding:"required"`
+		Size        int64  `json:"size" binding:"required,gt=0"`
 		WorkspaceID string `json:"workspace_id" binding:"required"`
-		UploadedBy  string `json:"uploaded_by" binding:"required"`
 		ChannelID   string `json:"channel_id"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Validate MIME type
-	fileType, ok := allowedMimeTypes[req.ContentType]
-	if !ok {
-		c.JSON(400, gin.H{"error": "file type not allowed"})
-		return
-	}
-
-	// Validate size
-	maxSize := maxFileSizes[fileType]
-	if req.Size > maxSize {
-		c.JSON(400, gin.H{"error": fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))})
+	uploadedBy := currentUserID(c)
+	if !requireWorkspaceMember(c, req.WorkspaceID) {
 		return
 	}
 
-	if s3PresignClient == nil {
-		c.JSON(503, gin.H{"error": "S3 not configured"})
+	// Validate MIME type and size against the workspace upload policy
+	fileType, err := getUploadPolicy(c.Request.Context(), req.WorkspaceID).Check(req.Filename, req.ContentType, req.Size)
+	if err != nil {
+		respondPolicyError(c, err)
 		return
 	}
 
 	fileID := uuid.New().String()
 	ext := filepath.Ext(req.Filename)
-	storageKey := fmt.Sprintf("files/%s/%s/%s%s", req.WorkspaceID, req.UploadedBy, fileID, ext)
+	storageKey := fmt.Sprintf("files/%s/%s/%s%s", req.WorkspaceID, uploadedBy, fileID, ext)
 
-	presignResult, err := s3PresignClient.PresignPutObject(c.Request.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(s3Bucket),
-		Key:         aws.String(storageKey),
-		ContentType: aws.String(req.ContentType),
-	}, s3.WithPresignExpires(15*time.Minute))
+	// Hold the declared size against the quota until the upload is completed or expires
+	if err := reserveQuota(c.Request.Context(), fileID, req.WorkspaceID, uploadedBy, req.Size, 20*time.Minute); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+
+	uploadURL, err := blobStore.PresignPut(c.Request.Context(), storageKey, req.ContentType, 15*time.Minute)
 	if err != nil {
+		releaseQuota(c.Request.Context(), fileID)
 		log.Errorf("Failed to generate presigned URL: %v", err)
 		c.JSON(500, gin.H{"error": "failed to generate upload URL"})
 		return
 	}
 
 	// Store pending upload info in Redis
-	pendingUpload := map[string]interface{}{
-		"file_id":       fileID,
-		"filename":      req.Filename,
-		"content_type":  req.ContentType,
-		"size":          req.Size,
-		"workspace_id":  req.WorkspaceID,
-		"uploaded_by":   req.UploadedBy,
-		"channel_id":    req.ChannelID,
-		"storage_key":   storageKey,
-		"file_type":     fileType,
+	pendingUpload := PendingUpload{
+		FileID:      fileID,
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		WorkspaceID: req.WorkspaceID,
+		UploadedBy:  uploadedBy,
+		ChannelID:   req.ChannelID,
+		StorageKey:  storageKey,
+		FileType:    fileType,
 	}
 	pendingJSON, _ := json.Marshal(pendingUpload)
 	redisClient.Set(c.Request.Context(), "pending_upload:"+fileID, pendingJSON, 20*time.Minute)
 
 	c.JSON(200, PresignedURLResponse{
-		UploadURL: presignResult.URL,
+		UploadURL: uploadURL,
 		FileID:    fileID,
 		Key:       storageKey,
 		ExpiresAt: time.Now().Add(15 * time.Minute).Unix(),
@@ -578,53 +763,106 @@ func completeUpload(c *gin.Context) {
 		return
 	}
 
-	var pending map[string]interface{}
-	json.Unmarshal(pendingJSON, &pending)
-
-	now := time.Now()
-	storageKey := pending["storage_key"].(string)
-	fileURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s3Bucket, storageKey)
+	var pending PendingUpload
+	if err := json.Unmarshal(pendingJSON, &pending); err != nil {
+		c.JSON(500, gin.H{"error": "corrupt upload session"})
+		return
+	}
+	if !ownsUpload(c, &pending) {
+		c.JSON(404, gin.H{"error": "upload session not found or expired"})
+		return
+	}
 
-	newFile := File{
-		FileID:       req.FileID,
-		Name:         filepath.Base(storageKey),
-		OriginalName: pending["filename"].(string),
-		MimeType:     pending["content_type"].(string),
-		Size:         int64(pending["size"].(float64)),
-		StorageKey:   storageKey,
-		URL:          fileURL,
-		WorkspaceID:  pending["workspace_id"].(string),
-		UploadedBy:   pending["uploaded_by"].(string),
-		Checksum:     req.Checksum,
-		FileType:     pending["file_type"].(string),
-		Metadata:     FileMetadata{},
-		IsPublic:     false,
-		SharedWith:   []string{},
-		Downloads:    0,
-		CreatedAt:    now,
-		UpdatedAt:    now,
-	}
-
-	if channelID, ok := pending["channel_id"].(string); ok && channelID != "" {
-		newFile.ChannelID = &channelID
+	// Verify the object the client uploaded instead of trusting the session
+	verified, err := verifyStoredUpload(c.Request.Context(), pending, req.Checksum)
+	if err != nil {
+		var verr *UploadVerificationError
+		if errors.As(err, &verr) {
+			discardUpload(c.Request.Context(), pending, "pending_upload:"+req.FileID)
+			c.JSON(verr.Status, gin.H{"error": verr.Message})
+			return
+		}
+		log.Errorf("Failed to verify upload: %v", err)
+		c.JSON(500, gin.H{"error": "failed to verify upload"})
+		return
 	}
 
-	result, err := filesCol.InsertOne(c.Request.Context(), newFile)
+	pending.applyContent(verified.Content)
+	newFile, err := createFileRecord(c.Request.Context(), pending, verified.Checksum)
 	if err != nil {
+		var verr *UploadVerificationError
+		if errors.As(err, &verr) {
+			discardUpload(c.Request.Context(), pending, "pending_upload:"+req.FileID)
+			c.JSON(verr.Status, gin.H{"error": verr.Message})
+			return
+		}
 		log.Errorf("Failed to save file metadata: %v", err)
 		c.JSON(500, gin.H{"error": "failed to complete upload"})
 		return
 	}
 
-	newFile.ID = result.InsertedID.(primitive.ObjectID)
-
 	// Clean up Redis
 	redisClient.Del(c.Request.Context(), "pending_upload:"+req.FileID)
 
+	log.WithFields(logrus.Fields{"file_id": req.FileID}).Info("Upload completed")
+	c.JSON(201, newFile)
+}
+
+// createFileRecord inserts the File document for an upload whose content is
+// already in storage, then publishes file.uploaded and caches the record
+func createFileRecord(ctx context.Context, pending PendingUpload, checksum string) (*File, error) {
+	// Direct-to-storage uploads can only be sanitized once they have landed
+	originalChecksum := ""
+	if getUploadPolicy(ctx, pending.WorkspaceID).SanitizeImages && sanitizableImageTypes[pending.ContentType] {
+		sanitized, err := sanitizeStoredObject(ctx, pending.StorageKey, pending.ContentType)
+		if err != nil {
+			return nil, &UploadVerificationError{Status: 422, Message: "failed to sanitize image: " + err.Error()}
+		}
+		originalChecksum, checksum = checksum, sanitized.Checksum
+		pending.Size = sanitized.Size
+	}
+
+	now := time.Now()
+	newFile := File{
+		FileID:           pending.FileID,
+		Name:             filepath.Base(pending.StorageKey),
+		OriginalName:     pending.Filename,
+		MimeType:         pending.ContentType,
+		DetectedMimeType: pending.DetectedMimeType,
+		Size:             pending.Size,
+		StorageKey:       pending.StorageKey,
+		URL:              blobStore.URL(pending.StorageKey),
+		WorkspaceID:      pending.WorkspaceID,
+		UploadedBy:       pending.UploadedBy,
+		Checksum:         checksum,
+		OriginalChecksum: originalChecksum,
+		FileType:         pending.FileType,
+		Metadata:         FileMetadata{},
+		IsPublic:         false,
+		SharedWith:       []string{},
+		Downloads:        0,
+		Status:           fileStatusActive,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+
+	if pending.ChannelID != "" {
+		channelID := pending.ChannelID
+		newFile.ChannelID = &channelID
+	}
+
+	result, err := filesCol.InsertOne(ctx, newFile)
+	if err != nil {
+		return nil, err
+	}
+
+	newFile.ID = result.InsertedID.(primitive.ObjectID)
+	commitQuota(ctx, newFile.FileID, newFile.WorkspaceID, newFile.UploadedBy, newFile.Size)
+
 	// Publish event
 	publishEvent(FileEvent{
 		Type:        "file.uploaded",
-		FileID:      req.FileID,
+		FileID:      newFile.FileID,
 		WorkspaceID: newFile.WorkspaceID,
 		UserID:      newFile.UploadedBy,
 		Data: map[string]interface{}{
@@ -636,10 +874,9 @@ func completeUpload(c *gin.Context) {
 	})
 
 	// Cache file metadata
-	cacheFile(c.Request.Context(), &newFile)
+	cacheFile(ctx, &newFile)
 
-	log.WithFields(logrus.Fields{"file_id": req.FileID}).Info("Upload completed")
-	c.JSON(201, newFile)
+	return &newFile, nil
 }
 
 // Get file metadata
@@ -649,6 +886,10 @@ func getFile(c *gin.Context) {
 	// Try cache first
 	cachedFile := getCachedFile(c.Request.Context(), fileID)
 	if cachedFile != nil {
+		if !checkFileAccess(c, cachedFile, permRead) || rejectQuarantined(c, cachedFile) {
+			return
+		}
+		c.Header("ETag", revisionETag(cachedFile.Revision))
 		c.JSON(200, cachedFile)
 		return
 	}
@@ -665,7 +906,11 @@ func getFile(c *gin.Context) {
 
 	// Cache for future requests
 	cacheFile(c.Request.Context(), &file)
+	if !checkFileAccess(c, &file, permRead) || rejectQuarantined(c, &file) {
+		return
+	}
 
+	c.Header("ETag", revisionETag(file.Revision))
 	c.JSON(200, file)
 }
 
@@ -673,38 +918,20 @@ func getFile(c *gin.Context) {
 func downloadFile(c *gin.Context) {
 	fileID := c.Param("id")
 
-	var file File
-	err := filesCol.FindOne(c.Request.Context(), bson.M{
-		"file_id":    fileID,
-		"deleted_at": nil,
-	}).Decode(&file)
-	if err != nil {
-		c.JSON(404, gin.H{"error": "file not found"})
+	file := authorizedFile(c, fileID, permRead)
+	if file == nil || rejectQuarantined(c, file) {
 		return
 	}
 
 	// Generate presigned download URL
-	var downloadURL string
-	if s3PresignClient != nil {
-		presignResult, err := s3PresignClient.PresignGetObject(c.Request.Context(), &s3.GetObjectInput{
-			Bucket:                     aws.String(s3Bucket),
-			Key:                        aws.String(file.StorageKey),
-			ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=\"%s\"", file.OriginalName)),
-		}, s3.WithPresignExpires(1*time.Hour))
-		if err != nil {
-			log.Errorf("Failed to generate download URL: %v", err)
-			c.JSON(500, gin.H{"error": "failed to generate download URL"})
-			return
-		}
-		downloadURL = presignResult.URL
-	} else {
-		downloadURL = file.URL
+	downloadURL, err := fileDownloadURL(c.Request.Context(), file, c.Query("inline") == "1", 1*time.Hour)
+	if err != nil {
+		log.Errorf("Failed to generate download URL: %v", err)
+		c.JSON(500, gin.H{"error": "failed to generate download URL"})
+		return
 	}
 
-	// Increment download count
-	filesCol.UpdateOne(c.Request.Context(),
-		bson.M{"file_id": fileID},
-		bson.M{"$inc": bson.M{"downloads": 1}})
+	recordDownload(c, fileID, downloadChannelAPI, nil)
 
 	c.JSON(200, gin.H{
 		"download_url": downloadURL,
@@ -717,27 +944,18 @@ func downloadFile(c *gin.Context) {
 func deleteFile(c *gin.Context) {
 	fileID := c.Param("id")
 
-	var file File
-	err := filesCol.FindOne(c.Request.Context(), bson.M{
-		"file_id":    fileID,
-		"deleted_at": nil,
-	}).Decode(&file)
-	if err != nil {
-		c.JSON(404, gin.H{"error": "file not found"})
+	file := authorizedFile(c, fileID, permOwner)
+	if file == nil || rejectLocked(c, file) || !checkIfMatch(c, file) {
 		return
 	}
 
 	now := time.Now()
-	_, err = filesCol.UpdateOne(c.Request.Context(),
-		bson.M{"file_id": fileID},
-		bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}})
+	err := updateFileRevision(c.Request.Context(), file, bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}})
 	if err != nil {
-		c.JSON(500, gin.H{"error": "failed to delete file"})
+		respondUpdateError(c, err, "failed to delete file")
 		return
 	}
-
-	// Remove from cache
-	redisClient.Del(c.Request.Context(), "file:"+fileID)
+	creditQuota(c.Request.Context(), file)
 
 	// Publish event
 	publishEvent(FileEvent{
@@ -765,6 +983,16 @@ func updateFile(c *gin.Context) {
 		return
 	}
 
+	// Making a file public shares it, which needs more than edit permission
+	action := permEdit
+	if req.IsPublic != nil {
+		action = permManage
+	}
+	file := authorizedFile(c, fileID, action)
+	if file == nil || rejectLocked(c, file) || !checkIfMatch(c, file) {
+		return
+	}
+
 	update := bson.M{"updated_at": time.Now()}
 	if req.OriginalName != nil {
 		update["original_name"] = *req.OriginalName
@@ -773,23 +1001,13 @@ func updateFile(c *gin.Context) {
 		update["is_public"] = *req.IsPublic
 	}
 
-	result, err := filesCol.UpdateOne(c.Request.Context(),
-		bson.M{"file_id": fileID, "deleted_at": nil},
-		bson.M{"$set": update})
-	if err != nil {
-		c.JSON(500, gin.H{"error": "failed to update file"})
-		return
-	}
-	if result.MatchedCount == 0 {
-		c.JSON(404, gin.H{"error": "file not found"})
+	if err := updateFileRevision(c.Request.Context(), file, bson.M{"$set": update}); err != nil {
+		respondUpdateError(c, err, "failed to update file")
 		return
 	}
 
-	// Invalidate cache
-	redisClient.Del(c.Request.Context(), "file:"+fileID)
-
-	var file File
-	filesCol.FindOne(c.Request.Context(), bson.M{"file_id": fileID}).Decode(&file)
+	filesCol.FindOne(c.Request.Context(), bson.M{"file_id": fileID}).Decode(file)
+	c.Header("ETag", revisionETag(file.Revision))
 	c.JSON(200, file)
 }
 
@@ -805,11 +1023,17 @@ func shareFile(c *gin.Context) {
 		return
 	}
 
+	file := authorizedFile(c, fileID, permManage)
+	if file == nil || rejectQuarantined(c, file) {
+		return
+	}
+
 	result, err := filesCol.UpdateOne(c.Request.Context(),
-		bson.M{"file_id": fileID, "deleted_at": nil},
+		bson.M{"file_id": fileID, "deleted_at": nil, "status": bson.M{"$ne": fileStatusQuarantined}},
 		bson.M{
 			"$addToSet": bson.M{"shared_with": bson.M{"$each": req.UserIDs}},
 			"$set":      bson.M{"updated_at": time.Now()},
+			"$inc":      bson.M{"revision": 1},
 		})
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to share file"})
@@ -831,11 +1055,21 @@ func unshareFile(c *gin.Context) {
 	fileID := c.Param("id")
 	userID := c.Param("userId")
 
+	// Anyone may remove themselves from a file shared with them
+	action := permManage
+	if userID == currentUserID(c) {
+		action = permRead
+	}
+	if authorizedFile(c, fileID, action) == nil {
+		return
+	}
+
 	result, err := filesCol.UpdateOne(c.Request.Context(),
 		bson.M{"file_id": fileID, "deleted_at": nil},
 		bson.M{
 			"$pull": bson.M{"shared_with": userID},
 			"$set":  bson.M{"updated_at": time.Now()},
+			"$inc":  bson.M{"revision": 1},
 		})
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to unshare file"})
@@ -870,9 +1104,21 @@ func getUserFiles(c *gin.Context) {
 	if fileType != "" {
 		filter["file_type"] = fileType
 	}
+	if !restrictToVisible(c, filter) {
+		return
+	}
+	if err := applyMetadataFilters(c, filter); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	sort, err := listSort(c, "created_at")
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 
 	opts := options.Find().
-		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSort(sort).
 		SetLimit(int64(limit)).
 		SetSkip(int64(offset))
 
@@ -885,6 +1131,7 @@ func getUserFiles(c *gin.Context) {
 
 	var files []File
 	cursor.All(c.Request.Context(), &files)
+	redactQuarantined(files)
 
 	total, _ := filesCol.CountDocuments(c.Request.Context(), filter)
 
@@ -910,9 +1157,21 @@ func getWorkspaceFiles(c *gin.Context) {
 		"workspace_id": workspaceID,
 		"deleted_at":   nil,
 	}
+	if !restrictToVisible(c, filter) {
+		return
+	}
+	if err := applyMetadataFilters(c, filter); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	sort, err := listSort(c, "created_at")
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 
 	opts := options.Find().
-		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSort(sort).
 		SetLimit(int64(limit)).
 		SetSkip(int64(offset))
 
@@ -925,6 +1184,7 @@ func getWorkspaceFiles(c *gin.Context) {
 
 	var files []File
 	cursor.All(c.Request.Context(), &files)
+	redactQuarantined(files)
 
 	total, _ := filesCol.CountDocuments(c.Request.Context(), filter)
 
@@ -950,9 +1210,21 @@ func getChannelFiles(c *gin.Context) {
 		"channel_id": channelID,
 		"deleted_at": nil,
 	}
+	if !restrictToVisible(c, filter) {
+		return
+	}
+	if err := applyMetadataFilters(c, filter); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	sort, err := listSort(c, "created_at")
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 
 	opts := options.Find().
-		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSort(sort).
 		SetLimit(int64(limit)).
 		SetSkip(int64(offset))
 
@@ -965,6 +1237,7 @@ func getChannelFiles(c *gin.Context) {
 
 	var files []File
 	cursor.All(c.Request.Context(), &files)
+	redactQuarantined(files)
 
 	total, _ := filesCol.CountDocuments(c.Request.Context(), filter)
 
@@ -991,10 +1264,14 @@ func batchGetFiles(c *gin.Context) {
 		return
 	}
 
-	cursor, err := filesCol.Find(c.Request.Context(), bson.M{
+	filter := bson.M{
 		"file_id":    bson.M{"$in": req.FileIDs},
 		"deleted_at": nil,
-	})
+	}
+	if !restrictToVisible(c, filter) {
+		return
+	}
+	cursor, err := filesCol.Find(c.Request.Context(), filter)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to fetch files"})
 		return
@@ -1003,6 +1280,7 @@ func batchGetFiles(c *gin.Context) {
 
 	var files []File
 	cursor.All(c.Request.Context(), &files)
+	redactQuarantined(files)
 
 	c.JSON(200, gin.H{"files": files})
 }
@@ -1017,25 +1295,26 @@ func batchDeleteFiles(c *gin.Context) {
 		return
 	}
 
-	now := time.Now()
-	result, err := filesCol.UpdateMany(c.Request.Context(),
-		bson.M{"file_id": bson.M{"$in": req.FileIDs}, "deleted_at": nil},
-		bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}})
+	// Files the caller may not delete are skipped
+	fileIDs, ok := authorizedFileIDs(c, req.FileIDs, permOwner)
+	if !ok {
+		return
+	}
+	fileIDs = skipLockedFiles(c, fileIDs)
+	deleted, err := softDeleteFiles(c.Request.Context(), bson.M{"file_id": bson.M{"$in": fileIDs}}, bson.M{})
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to delete files"})
 		return
 	}
 
-	// Invalidate cache
-	for _, fileID := range req.FileIDs {
-		redisClient.Del(c.Request.Context(), "file:"+fileID)
-	}
-
-	c.JSON(200, gin.H{"deleted": result.ModifiedCount})
+	c.JSON(200, gin.H{"deleted": deleted})
 }
 
 // Get stats
 func getStats(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
 	ctx := c.Request.Context()
 
 	totalFiles, _ := filesCol.CountDocuments(ctx, bson.M{"deleted_at": nil})
@@ -1063,16 +1342,19 @@ func getStats(c *gin.Context) {
 	}
 
 	c.JSON(200, gin.H{
-		"total_files":    totalFiles,
-		"total_size":     totalSize,
-		"total_size_mb":  float64(totalSize) / (1024 * 1024),
-		"files_by_type":  typeCounts,
+		"total_files":   totalFiles,
+		"total_size":    totalSize,
+		"total_size_mb": float64(totalSize) / (1024 * 1024),
+		"files_by_type": typeCounts,
 	})
 }
 
 // Get user stats
 func getUserStats(c *gin.Context) {
 	userID := c.Param("userId")
+	if !requireSelfOrAdmin(c, userID) {
+		return
+	}
 	ctx := c.Request.Context()
 
 	totalFiles, _ := filesCol.CountDocuments(ctx, bson.M{"uploaded_by": userID, "deleted_at": nil})
@@ -1136,6 +1418,113 @@ func detectMimeType(filename string) string {
 	return "application/octet-stream"
 }
 
+// duplicateFile copies a file's content and metadata under a new file ID. The copy
+// belongs to copier, is charged to their quota and starts out unshared.
+func duplicateFile(ctx context.Context, file File, copier string, channelID *string) (*File, error) {
+	if file.IsQuarantined() {
+		return nil, &UploadVerificationError{Status: 403, Message: "file is quarantined"}
+	}
+	newID := uuid.New().String()
+	ext := filepath.Ext(file.StorageKey)
+	storageKey := fmt.Sprintf("files/%s/%s/%s%s", file.WorkspaceID, copier, newID, ext)
+	if err := reserveQuota(ctx, newID, file.WorkspaceID, copier, file.Size, time.Hour); err != nil {
+		return nil, err
+	}
+	defer releaseQuota(context.Background(), newID)
+	if err := copyBlob(ctx, file.StorageKey, storageKey); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	file.ID = primitive.NilObjectID
+	file.FileID = newID
+	file.Name = newID + ext
+	file.StorageKey = storageKey
+	file.URL = blobStore.URL(storageKey)
+	file.UploadedBy = copier
+	file.ModifiedBy = ""
+	file.IsPublic = false
+	file.SharedWith = []string{}
+	file.Downloads = 0
+	file.Revision = 0
+	file.VersionCounter = 0
+	file.Lock = nil
+	file.CreatedAt = now
+	file.UpdatedAt = now
+	if channelID != nil {
+		file.ChannelID = channelID
+	}
+
+	result, err := filesCol.InsertOne(ctx, file)
+	if err != nil {
+		blobStore.Delete(ctx, storageKey)
+		return nil, err
+	}
+	file.ID = result.InsertedID.(primitive.ObjectID)
+	commitQuota(ctx, newID, file.WorkspaceID, file.UploadedBy, file.Size)
+	return &file, nil
+}
+
+// softDeleteFiles moves the live files matching filter to the trash one at a time,
+// so each file's bytes are credited back to the quota exactly once
+func softDeleteFiles(ctx context.Context, filter bson.M, set bson.M) (int64, error) {
+	filter["deleted_at"] = nil
+	cursor, err := filesCol.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var files []File
+	if err := cursor.All(ctx, &files); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	update := bson.M{"deleted_at": now, "updated_at": now}
+	for k, v := range set {
+		update[k] = v
+	}
+	var deleted int64
+	for i := range files {
+		result, err := filesCol.UpdateOne(ctx, bson.M{"_id": files[i].ID, "deleted_at": nil}, bson.M{"$set": update, "$inc": bson.M{"revision": 1}})
+		if err != nil {
+			return deleted, err
+		}
+		if result.ModifiedCount > 0 {
+			creditQuota(ctx, &files[i])
+			redisClient.Del(ctx, "file:"+files[i].FileID)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// checksumMatch matches files whose stored or pre-sanitization content had any of
+// the given checksums
+func checksumMatch(checksums ...string) []bson.M {
+	var sums []string
+	for _, sum := range checksums {
+		if sum != "" {
+			sums = append(sums, sum)
+		}
+	}
+	return []bson.M{
+		{"checksum": bson.M{"$in": sums}},
+		{"original_checksum": bson.M{"$in": sums}},
+	}
+}
+
+// countingReader tracks how many bytes have been read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
 func cacheFile(ctx context.Context, file *File) {
 	data, _ := json.Marshal(file)
 	redisClient.Set(ctx, "file:"+file.FileID, data, 1*time.Hour)
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Metadata is extracted off the upload path by a worker consuming file.uploaded
+// events, so direct, presigned, multipart and resumable uploads are all covered.
+// The object is spooled to a temp file first because several formats keep what we
+// need near the end (MP4 moov boxes, the last Ogg page).
+
+const metadataConsumerGroup = "file-service-metadata"
+
+// GeoPoint is a WGS84 position taken from EXIF GPS tags
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude" bson:"longitude"`
+}
+
+type metadataExtractor func(r io.ReaderAt, size int64, meta *FileMetadata) error
+
+func metadataExtractorFor(mimeType string) metadataExtractor {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return extractImageMetadata
+	case "application/pdf":
+		return extractPDFMetadata
+	case "video/mp4", "video/quicktime":
+		return extractMP4Metadata
+	case "video/webm", "audio/webm":
+		return extractWebMMetadata
+	case "audio/ogg":
+		return extractOggMetadata
+	case "audio/wav":
+		return extractWAVMetadata
+	}
+	return nil
+}
+
+func runMetadataWorker(ctx context.Context) {
+	runEventConsumer(ctx, metadataConsumerGroup, []string{"file.uploaded", "file.version_created"}, handleMetadataEvent)
+}
+
+func handleMetadataEvent(ctx context.Context, event FileEvent) error {
+	var file File
+	err := filesCol.FindOne(ctx, bson.M{"file_id": event.FileID, "deleted_at": nil}).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	meta, err := extractFileMetadata(ctx, &file)
+	if err != nil || meta == nil {
+		return err
+	}
+	// Set fields individually so values written concurrently (e.g. by the thumbnail
+	// worker) are not clobbered
+	fields, err := bson.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	var values bson.M
+	if err := bson.Unmarshal(fields, &values); err != nil {
+		return err
+	}
+	set := bson.M{"updated_at": time.Now()}
+	for k, v := range values {
+		set["metadata."+k] = v
+	}
+	_, err = filesCol.UpdateOne(ctx, bson.M{"file_id": file.FileID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	redisClient.Del(ctx, "file:"+file.FileID)
+	log.WithField("file_id", file.FileID).Info("Extracted file metadata")
+	return nil
+}
+
+// extractFileMetadata reads a stored file and returns its metadata, or nil if the
+// type has no extractor
+func extractFileMetadata(ctx context.Context, file *File) (*FileMetadata, error) {
+	extract := metadataExtractorFor(file.MimeType)
+	if extract == nil {
+		return nil, nil
+	}
+
+	body, err := blobStore.Get(ctx, file.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp("", "metadata-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := file.Metadata
+	if err := extract(tmp, size, &meta); err != nil {
+		return nil, fmt.Errorf("extract %s metadata: %w", file.MimeType, err)
+	}
+	return &meta, nil
+}
+
+// ── Images and EXIF ──
+
+func extractImageMetadata(r io.ReaderAt, size int64, meta *FileMetadata) error {
+	if cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size)); err == nil {
+		meta.Width, meta.Height = &cfg.Width, &cfg.Height
+	}
+	if tiff := findExif(r, size); tiff != nil {
+		parseExif(tiff, meta)
+	}
+	return nil
+}
+
+// maxExifLen bounds how much of an EXIF block is read into memory
+const maxExifLen = 1 << 20
+
+// findExif returns the TIFF-structured EXIF payload of a JPEG, PNG or WebP image
+func findExif(r io.ReaderAt, size int64) []byte {
+	head := make([]byte, 12)
+	if n, _ := r.ReadAt(head, 0); n < 12 {
+		return nil
+	}
+	var loc exifLocation
+	switch {
+	case head[0] == 0xFF && head[1] == 0xD8:
+		loc = findJPEGExif(r, size)
+	case string(head[:8]) == "\x89PNG\r\n\x1a\n":
+		loc = findPNGExif(r, size)
+	case string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		loc = findWebPExif(r, size)
+	}
+	if loc.length <= 0 || loc.length > maxExifLen {
+		return nil
+	}
+	data := make([]byte, loc.length)
+	if _, err := r.ReadAt(data, loc.offset); err != nil {
+		return nil
+	}
+	return bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+}
+
+// exifLocation is where an image keeps its EXIF payload (offset/length of the data)
+// and the container block holding it (blockOffset/blockLength, header included)
+type exifLocation struct {
+	offset, length           int64
+	blockOffset, blockLength int64
+}
+
+func findJPEGExif(r io.ReaderAt, size int64) exifLocation {
+	hdr := make([]byte, 10)
+	for off := int64(2); off+4 <= size; {
+		if _, err := r.ReadAt(hdr[:4], off); err != nil || hdr[0] != 0xFF {
+			break
+		}
+		marker := hdr[1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan / end of image
+			break
+		}
+		segLen := int64(binary.BigEndian.Uint16(hdr[2:4]))
+		if marker == 0xE1 && segLen >= 8 {
+			if _, err := r.ReadAt(hdr[4:10], off+4); err == nil && string(hdr[4:10]) == "Exif\x00\x00" {
+				return exifLocation{offset: off + 10, length: segLen - 8, blockOffset: off, blockLength: segLen + 2}
+			}
+		}
+		off += 2 + segLen
+	}
+	return exifLocation{}
+}
+
+func findPNGExif(r io.ReaderAt, size int64) exifLocation {
+	hdr := make([]byte, 8)
+	for off := int64(8); off+12 <= size; {
+		if _, err := r.ReadAt(hdr, off); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:8]) {
+		case "eXIf":
+			return exifLocation{offset: off + 8, length: length, blockOffset: off, blockLength: length + 12}
+		case "IEND":
+			return exifLocation{}
+		}
+		off += length + 12
+	}
+	return exifLocation{}
+}
+
+func findWebPExif(r io.ReaderAt, size int64) exifLocation {
+	hdr := make([]byte, 8)
+	for off := int64(12); off+8 <= size; {
+		if _, err := r.ReadAt(hdr, off); err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		padded := length + length%2
+		if string(hdr[:4]) == "EXIF" {
+			return exifLocation{offset: off + 8, length: length, blockOffset: off, blockLength: padded + 8}
+		}
+		off += padded + 8
+	}
+	return exifLocation{}
+}
+
+// tiffEntry is one IFD entry of a TIFF/EXIF structure
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffReader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (t *tiffReader) ifd(offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if int64(offset)+2 > int64(len(t.b)) {
+		return entries
+	}
+	n := int(t.order.Uint16(t.b[offset:]))
+	for i := 0; i < n; i++ {
+		pos := int64(offset) + 2 + int64(i)*12
+		if pos+12 > int64(len(t.b)) {
+			break
+		}
+		e := t.b[pos : pos+12]
+		typ, count := t.order.Uint16(e[2:4]), t.order.Uint32(e[4:8])
+		size := int64(tiffTypeSizes[typ]) * int64(count)
+		if size == 0 {
+			continue
+		}
+		var value []byte
+		if size <= 4 {
+			value = e[8 : 8+size]
+		} else {
+			start := int64(t.order.Uint32(e[8:12]))
+			if start+size > int64(len(t.b)) {
+				continue
+			}
+			value = t.b[start : start+size]
+		}
+		entries[t.order.Uint16(e[0:2])] = tiffEntry{typ: typ, count: count, value: value}
+	}
+	return entries
+}
+
+func (t *tiffReader) uint(e tiffEntry) (uint32, bool) {
+	switch e.typ {
+	case 3:
+		return uint32(t.order.Uint16(e.value)), true
+	case 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+func (t *tiffReader) str(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	out := make([]float64, 0, e.count)
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := t.order.Uint32(e.value[i:]), t.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		out = append(out, float64(num)/float64(den))
+	}
+	return out
+}
+
+// parseExif fills camera, orientation, capture time and GPS position from a TIFF payload
+func parseExif(b []byte, meta *FileMetadata) {
+	if len(b) < 8 {
+		return
+	}
+	t := &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return
+	}
+	if t.order.Uint16(b[2:4]) != 42 {
+		return
+	}
+
+	ifd0 := t.ifd(t.order.Uint32(b[4:8]))
+	if v := t.str(ifd0[0x010F]); v != "" {
+		meta.CameraMake = &v
+	}
+	if v := t.str(ifd0[0x0110]); v != "" {
+		meta.CameraModel = &v
+	}
+	if v, ok := t.uint(ifd0[0x0112]); ok && v >= 1 && v <= 8 {
+		orientation := int(v)
+		meta.Orientation = &orientation
+	}
+
+	captured, offset := t.str(ifd0[0x0132]), ""
+	if ptr, ok := t.uint(ifd0[0x8769]); ok {
+		exif := t.ifd(ptr)
+		if v := t.str(exif[0x9003]); v != "" {
+			captured = v
+		}
+		offset = t.str(exif[0x9011])
+	}
+	if captured != "" {
+		var ts time.Time
+		var err error
+		if offset != "" {
+			ts, err = time.Parse("2006:01:02 15:04:05-07:00", captured+offset)
+		} else {
+			ts, err = time.Parse("2006:01:02 15:04:05", captured)
+		}
+		if err == nil {
+			meta.CapturedAt = &ts
+		}
+	}
+
+	if ptr, ok := t.uint(ifd0[0x8825]); ok {
+		gps := t.ifd(ptr)
+		lat, lon := t.rationals(gps[0x0002]), t.rationals(gps[0x0004])
+		if len(lat) == 3 && len(lon) == 3 {
+			point := GeoPoint{
+				Latitude:  lat[0] + lat[1]/60 + lat[2]/3600,
+				Longitude: lon[0] + lon[1]/60 + lon[2]/3600,
+			}
+			if t.str(gps[0x0001]) == "S" {
+				point.Latitude = -point.Latitude
+			}
+			if t.str(gps[0x0003]) == "W" {
+				point.Longitude = -point.Longitude
+			}
+			if math.Abs(point.Latitude) <= 90 && math.Abs(point.Longitude) <= 180 {
+				meta.GPS = &point
+			}
+		}
+	}
+}
+
+// ── PDF ──
+
+var (
+	pdfPagesCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+	pdfPage       = regexp.MustCompile(`/Type\s*/Page\b`)
+)
+
+// extractPDFMetadata reads the page count from the page tree root (the /Pages node
+// with the largest /Count), falling back to counting /Page objects
+func extractPDFMetadata(r io.ReaderAt, size int64, meta *FileMetadata) error {
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return errors.New("not a PDF")
+	}
+	pages := 0
+	for _, m := range pdfPagesCount.FindAllSubmatch(data, -1) {
+		count := m[1]
+		if count == nil {
+			count = m[2]
+		}
+		if n, err := strconv.Atoi(string(count)); err == nil && n > pages {
+			pages = n
+		}
+	}
+	if pages == 0 {
+		pages = len(pdfPage.FindAllIndex(data, -1))
+	}
+	if pages > 0 {
+		meta.Pages = &pages
+	}
+	return nil
+}
+
+// ── MP4 / QuickTime ──
+
+// findMP4Box returns the payload range of the first box named name within [start, end)
+func findMP4Box(r io.ReaderAt, start, end int64, name string) (int64, int64, bool) {
+	hdr := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return 0, 0, false
+		}
+		boxSize, headerLen := int64(binary.BigEndian.Uint32(hdr[:4])), int64(8)
+		switch boxSize {
+		case 0: // extends to the end of the file
+			boxSize = end - off
+		case 1: // 64-bit size follows the type
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return 0, 0, false
+			}
+			boxSize, headerLen = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if boxSize < headerLen || off+boxSize > end {
+			return 0, 0, false
+		}
+		if string(hdr[4:8]) == name {
+			return off + headerLen, off + boxSize, true
+		}
+		off += boxSize
+	}
+	return 0, 0, false
+}
+
+func extractMP4Metadata(r io.ReaderAt, size int64, meta *FileMetadata) error {
+	moovStart, moovEnd, ok := findMP4Box(r, 0, size, "moov")
+	if !ok {
+		return errors.New("moov box not found")
+	}
+	start, end, ok := findMP4Box(r, moovStart, moovEnd, "mvhd")
+	if !ok || end-start < 20 {
+		return errors.New("mvhd box not found")
+	}
+	mvhd := make([]byte, 32)
+	n, _ := r.ReadAt(mvhd[:min(32, end-start)], start)
+	if n < 20 {
+		return errors.New("short mvhd box")
+	}
+	mvhd = mvhd[:n]
+
+	var timescale uint32
+	var duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return errors.New("short mvhd box")
+		}
+		timescale, duration = binary.BigEndian.Uint32(mvhd[20:24]), binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale, duration = binary.BigEndian.Uint32(mvhd[12:16]), uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if timescale > 0 && duration > 0 && duration != math.MaxUint32 && duration != math.MaxUint64 {
+		seconds := float64(duration) / float64(timescale)
+		meta.Duration = &seconds
+	}
+	return nil
+}
+
+// ── WebM / Matroska ──
+
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+)
+
+// readEBMLVint reads a variable-length integer at off. Element IDs keep their length
+// marker; sizes drop it, and an all-ones size (unknown) is returned as -1.
+func readEBMLVint(r io.ReaderAt, off int64, isID bool) (int64, int, error) {
+	b := make([]byte, 8)
+	if _, err := r.ReadAt(b[:1], off); err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("invalid EBML vint")
+	}
+	if length > 1 {
+		if _, err := r.ReadAt(b[1:length], off+1); err != nil {
+			return 0, 0, err
+		}
+	}
+	var v uint64
+	if isID {
+		v = uint64(b[0])
+	} else {
+		v = uint64(b[0] & (0xFF >> length))
+	}
+	allOnes := v == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+		allOnes = allOnes && b[i] == 0xFF
+	}
+	if !isID && allOnes {
+		return -1, length, nil
+	}
+	return int64(v), length, nil
+}
+
+// ebmlElement reads the ID and payload range of the element at off
+func ebmlElement(r io.ReaderAt, off, end int64) (id, start, stop int64, err error) {
+	id, idLen, err := readEBMLVint(r, off, true)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size, sizeLen, err := readEBMLVint(r, off+int64(idLen), false)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	start = off + int64(idLen+sizeLen)
+	if start > end {
+		return 0, 0, 0, errors.New("EBML element header overruns its parent")
+	}
+	stop = end
+	if size >= 0 && start+size < end {
+		stop = start + size
+	}
+	return id, start, stop, nil
+}
+
+func extractWebMMetadata(r io.ReaderAt, size int64, meta *FileMetadata) error {
+	for off := int64(0); off < size; {
+		id, start, stop, err := ebmlElement(r, off, size)
+		if err != nil {
+			return err
+		}
+		if id == ebmlSegment {
+			return extractWebMSegment(r, start, stop, meta)
+		}
+		off = stop
+	}
+	return errors.New("segment not found")
+}
+
+func extractWebMSegment(r io.ReaderAt, segStart, segEnd int64, meta *FileMetadata) error {
+	for off := segStart; off < segEnd; {
+		id, start, stop, err := ebmlElement(r, off, segEnd)
+		if err != nil {
+			return err
+		}
+		if id != ebmlInfo {
+			off = stop
+			continue
+		}
+
+		scale := 1000000.0 // nanoseconds per timecode tick
+		var duration float64
+		for child := start; child < stop; {
+			cid, cstart, cstop, err := ebmlElement(r, child, stop)
+			if err != nil {
+				return err
+			}
+			if cstop-cstart <= 8 {
+				value := make([]byte, cstop-cstart)
+				r.ReadAt(value, cstart)
+				switch cid {
+				case ebmlTimecodeScale:
+					var v uint64
+					for _, b := range value {
+						v = v<<8 | uint64(b)
+					}
+					if v > 0 {
+						scale = float64(v)
+					}
+				case ebmlDuration:
+					switch len(value) {
+					case 4:
+						duration = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+					case 8:
+						duration = math.Float64frombits(binary.BigEndian.Uint64(value))
+					}
+				}
+			}
+			child = cstop
+		}
+		// Live recordings (e.g. MediaRecorder) often omit the duration
+		if duration > 0 {
+			seconds := duration * scale / 1e9
+			meta.Duration = &seconds
+		}
+		return nil
+	}
+	return nil
+}
+
+// ── Ogg ──
+
+// extractOggMetadata derives the duration from the last page's granule position and
+// the sample rate in the Vorbis or Opus identification header
+func extractOggMetadata(r io.ReaderAt, size int64, meta *FileMetadata) error {
+	first := make([]byte, 27+255+32)
+	n, _ := r.ReadAt(first, 0)
+	first = first[:n]
+	if n < 28 || string(first[:4]) != "OggS" {
+		return errors.New("not an Ogg stream")
+	}
+	packetStart := 27 + int(first[26])
+	if packetStart+20 > len(first) {
+		return errors.New("short Ogg page")
+	}
+	packet := first[packetStart:]
+
+	var rate, preSkip float64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		rate = float64(binary.LittleEndian.Uint32(packet[12:16]))
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		rate, preSkip = 48000, float64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return nil
+	}
+	if rate == 0 {
+		return nil
+	}
+
+	tailLen := min(size, 65536)
+	tail := make([]byte, tailLen)
+	if _, err := r.ReadAt(tail, size-tailLen); err != nil && err != io.EOF {
+		return err
+	}
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if last < 0 || last+14 > len(tail) {
+		return nil
+	}
+	granule := int64(binary.LittleEndian.Uint64(tail[last+6 : last+14]))
+	if granule <= 0 {
+		return nil
+	}
+	seconds := (float64(granule) - preSkip) / rate
+	if seconds > 0 {
+		meta.Duration = &seconds
+	}
+	return nil
+}
+
+// ── WAV ──
+
+func extractWAVMetadata(r io.ReaderAt, size int64, meta *FileMetadata) error {
+	hdr := make([]byte, 12)
+	if _, err := r.ReadAt(hdr, 0); err != nil || string(hdr[:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return errors.New("not a WAV file")
+	}
+	var byteRate uint32
+	for off := int64(12); off+8 <= size; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		switch string(hdr[:4]) {
+		case "fmt ":
+			format := make([]byte, 12)
+			if _, err := r.ReadAt(format, off+8); err != nil {
+				return err
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:12])
+		case "data":
+			// Streamed recordings may leave the size unset
+			if length == 0 || length == math.MaxUint32 || off+8+length > size {
+				length = size - off - 8
+			}
+			if byteRate > 0 {
+				seconds := float64(length) / float64(byteRate)
+				meta.Duration = &seconds
+			}
+			return nil
+		}
+		off += 8 + length + length%2
+	}
+	return nil
+}
+
+// ── Filtering and sorting ──
+
+// metadataSortFields maps the sort query parameter to document fields
+var metadataSortFields = map[string]string{
+	"created_at":  "created_at",
+	"updated_at":  "updated_at",
+	"name":        "original_name",
+	"size":        "size",
+	"width":       "metadata.width",
+	"height":      "metadata.height",
+	"duration":    "metadata.duration",
+	"pages":       "metadata.pages",
+	"captured_at": "metadata.captured_at",
+}
+
+// applyMetadataFilters adds the metadata query parameters of a list request to filter:
+// min_/max_ width, height, duration and pages; captured_after/captured_before (RFC 3339);
+// camera (make or model substring); orientation; has_gps.
+func applyMetadataFilters(c *gin.Context, filter bson.M) error {
+	ranges := []struct{ param, field string }{
+		{"width", "metadata.width"},
+		{"height", "metadata.height"},
+		{"duration", "metadata.duration"},
+		{"pages", "metadata.pages"},
+	}
+	for _, rg := range ranges {
+		cond := bson.M{}
+		for _, bound := range []struct{ prefix, op string }{{"min_", "$gte"}, {"max_", "$lte"}} {
+			v := c.Query(bound.prefix + rg.param)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s", bound.prefix, rg.param)
+			}
+			cond[bound.op] = n
+		}
+		if len(cond) > 0 {
+			filter[rg.field] = cond
+		}
+	}
+
+	captured := bson.M{}
+	for _, bound := range []struct{ param, op string }{{"captured_after", "$gte"}, {"captured_before", "$lte"}} {
+		if v := c.Query(bound.param); v != "" {
+			ts, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return fmt.Errorf("invalid %s, expected RFC 3339", bound.param)
+			}
+			captured[bound.op] = ts
+		}
+	}
+	if len(captured) > 0 {
+		filter["metadata.captured_at"] = captured
+	}
+
+	if v := c.Query("camera"); v != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(v), "$options": "i"}
+		filter["$and"] = append(andClauses(filter), bson.M{"$or": []bson.M{
+			{"metadata.camera_make": pattern},
+			{"metadata.camera_model": pattern},
+		}})
+	}
+	if v := c.Query("orientation"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("invalid orientation")
+		}
+		filter["metadata.orientation"] = n
+	}
+	if v := c.Query("has_gps"); v != "" {
+		has, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("invalid has_gps")
+		}
+		filter["metadata.gps"] = bson.M{"$exists": has}
+	}
+	return nil
+}
+
+func andClauses(filter bson.M) []bson.M {
+	if clauses, ok := filter["$and"].([]bson.M); ok {
+		return clauses
+	}
+	return nil
+}
+
+// listSort reads sort (see metadataSortFields) and order (asc/desc) query parameters
+func listSort(c *gin.Context, defaultField string) (bson.D, error) {
+	field, ok := metadataSortFields[c.DefaultQuery("sort", defaultField)]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort field %q", c.Query("sort"))
+	}
+	direction := -1
+	switch c.DefaultQuery("order", "desc") {
+	case "asc":
+		direction = 1
+	case "desc":
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+	return bson.D{{Key: field, Value: direction}, {Key: "_id", Value: direction}}, nil
+}
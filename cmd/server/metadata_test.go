@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func sampleWebM() []byte {
+	info := []byte{
+		0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40, // TimecodeScale 1000000
+		0x44, 0x89, 0x84, 0, 0, 0, 0, // Duration, float32 filled in below
+	}
+	binary.BigEndian.PutUint32(info[10:], math.Float32bits(2000))
+	b := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x80}   // EBML header, empty
+	b = append(b, 0x18, 0x53, 0x80, 0x67, 0xFF) // Segment, unknown size
+	b = append(b, 0x15, 0x49, 0xA9, 0x66, 0x80|byte(len(info)))
+	return append(b, info...)
+}
+
+func sampleMP4() []byte {
+	mvhd := make([]byte, 40)
+	binary.BigEndian.PutUint32(mvhd[0:], 40)
+	copy(mvhd[4:], "mvhd")
+	binary.BigEndian.PutUint32(mvhd[20:], 1000) // timescale
+	binary.BigEndian.PutUint32(mvhd[24:], 5000) // duration
+	b := []byte{0, 0, 0, 16, 'f', 't', 'y', 'p', 'i', 's', 'o', 'm', 0, 0, 0, 0}
+	b = append(b, 0, 0, 0, 48, 'm', 'o', 'o', 'v')
+	return append(b, mvhd...)
+}
+
+func oggPage(granule uint64, packet []byte) []byte {
+	page := make([]byte, 27)
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	if len(packet) == 0 {
+		return page
+	}
+	page[26] = 1
+	page = append(page, byte(len(packet)))
+	return append(page, packet...)
+}
+
+func sampleOgg() []byte {
+	packet := make([]byte, 30)
+	copy(packet, "\x01vorbis")
+	binary.LittleEndian.PutUint32(packet[12:], 44100)
+	return append(oggPage(0, packet), oggPage(3*44100, nil)...)
+}
+
+func sampleWAV() []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+	format := make([]byte, 16)
+	binary.LittleEndian.PutUint16(format[0:], 1)
+	binary.LittleEndian.PutUint16(format[2:], 1)
+	binary.LittleEndian.PutUint32(format[4:], 8000)
+	binary.LittleEndian.PutUint32(format[8:], 16000) // byte rate
+	b = append(b, format...)
+	b = append(b, "data\x40\x06\x00\x00"...) // 1600 bytes
+	return append(b, make([]byte, 1600)...)
+}
+
+func sampleExifJPEG() []byte {
+	tiff := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0, // header, IFD0 at 8
+		1, 0, // one entry
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0, // Orientation = 6
+		0, 0, 0, 0, // no next IFD
+	}
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	b := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(app1)+2))
+	b = append(b, app1...)
+	return append(b, 0xFF, 0xD9)
+}
+
+func TestExtractMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		extract metadataExtractor
+		data    []byte
+		check   func(*FileMetadata) bool
+	}{
+		{"webm", extractWebMMetadata, sampleWebM(), func(m *FileMetadata) bool { return m.Duration != nil && *m.Duration == 2 }},
+		{"mp4", extractMP4Metadata, sampleMP4(), func(m *FileMetadata) bool { return m.Duration != nil && *m.Duration == 5 }},
+		{"ogg", extractOggMetadata, sampleOgg(), func(m *FileMetadata) bool { return m.Duration != nil && *m.Duration == 3 }},
+		{"wav", extractWAVMetadata, sampleWAV(), func(m *FileMetadata) bool { return m.Duration != nil && *m.Duration == 0.1 }},
+		{"exif", extractImageMetadata, sampleExifJPEG(), func(m *FileMetadata) bool { return m.Orientation != nil && *m.Orientation == 6 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var meta FileMetadata
+			if err := tt.extract(bytes.NewReader(tt.data), int64(len(tt.data)), &meta); err != nil {
+				t.Fatalf("extract: %v", err)
+			}
+			if !tt.check(&meta) {
+				t.Fatalf("unexpected metadata %+v", meta)
+			}
+		})
+	}
+}
+
+// Extractors run on arbitrary uploads in a worker, so malformed input must fail
+// cleanly instead of panicking
+func TestExtractMetadataMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		extract metadataExtractor
+		data    []byte
+	}{
+		// Info's child header runs past the end of Info
+		{"webm child overruns info", extractWebMMetadata, []byte{
+			0x18, 0x53, 0x80, 0x67, 0xFF,
+			0x15, 0x49, 0xA9, 0x66, 0x81,
+			0x2A, 0xD7, 0xB1, 0x81, 0x01,
+		}},
+		{"webm huge child", extractWebMMetadata, []byte{
+			0x18, 0x53, 0x80, 0x67, 0xFF,
+			0x15, 0x49, 0xA9, 0x66, 0xFF,
+			0x44, 0x89, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE,
+		}},
+		{"webm invalid vint", extractWebMMetadata, []byte{0x18, 0x53, 0x80, 0x67, 0x00}},
+		{"mp4 zero-length mvhd", extractMP4Metadata, []byte{0, 0, 0, 16, 'm', 'o', 'o', 'v', 0, 0, 0, 8, 'm', 'v', 'h', 'd'}},
+		{"mp4 64-bit negative size", extractMP4Metadata, []byte{0, 0, 0, 1, 'm', 'o', 'o', 'v', 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"ogg segment table past page", extractOggMetadata, append([]byte("OggS"), make([]byte, 22)...)},
+		{"wav fmt chunk truncated", extractWAVMetadata, []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00")},
+		{"wav data size past end", extractWAVMetadata, []byte("RIFF\x00\x00\x00\x00WAVEdata\xFF\xFF\xFF\x7F")},
+		{"exif ifd past end", extractImageMetadata, []byte{
+			0xFF, 0xD8, 0xFF, 0xE1, 0, 16, 'E', 'x', 'i', 'f', 0, 0,
+			'M', 'M', 0, 42, 0xFF, 0xFF, 0xFF, 0xF0,
+		}},
+		{"exif entry value past end", extractImageMetadata, []byte{
+			0xFF, 0xD8, 0xFF, 0xE1, 0, 30, 'E', 'x', 'i', 'f', 0, 0,
+			'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0,
+			0x0F, 0x01, 2, 0, 0xFF, 0, 0, 0, 0xF0, 0xFF, 0, 0,
+		}},
+		{"exif short segment length", extractImageMetadata, []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 1, 'E', 'x', 'i', 'f', 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var meta FileMetadata
+			tt.extract(bytes.NewReader(tt.data), int64(len(tt.data)), &meta)
+		})
+	}
+}
+
+// TestExtractMetadataMutated runs every extractor over truncated and byte-corrupted
+// copies of a valid sample
+func TestExtractMetadataMutated(t *testing.T) {
+	samples := []struct {
+		name    string
+		extract metadataExtractor
+		data    []byte
+	}{
+		{"webm", extractWebMMetadata, sampleWebM()},
+		{"mp4", extractMP4Metadata, sampleMP4()},
+		{"ogg", extractOggMetadata, sampleOgg()},
+		{"wav", extractWAVMetadata, sampleWAV()[:64]},
+		{"exif", extractImageMetadata, sampleExifJPEG()},
+	}
+	for _, s := range samples {
+		t.Run(s.name, func(t *testing.T) {
+			for n := 0; n < len(s.data); n++ {
+				var meta FileMetadata
+				s.extract(bytes.NewReader(s.data[:n]), int64(n), &meta)
+			}
+			for i := range s.data {
+				for _, v := range []byte{0x00, 0x01, 0x7F, 0x80, 0xFF} {
+					data := bytes.Clone(s.data)
+					data[i] = v
+					var meta FileMetadata
+					s.extract(bytes.NewReader(data), int64(len(data)), &meta)
+				}
+			}
+		})
+	}
+}
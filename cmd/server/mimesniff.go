@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Uploads are classified by their leading bytes rather than by the client's
+// Content-Type header or the file extension. The detected type is reconciled
+// against both; what happens on a mismatch is governed by MIME_MISMATCH_POLICY:
+//
+//	reject   - refuse the upload (default)
+//	detected - store the file under the detected type
+//	declared - keep the declared type and only log the mismatch
+//
+// Executables, including scripts with an interpreter line, are refused under
+// every policy.
+
+const sniffLen = 4096
+
+var mimeMismatchPolicy = "reject"
+
+// executableMimeTypes are never accepted, whatever they are named
+var executableMimeTypes = map[string]bool{
+	"application/x-msdownload":  true,
+	"application/x-executable":  true,
+	"application/x-mach-binary": true,
+	"application/x-sh":          true,
+	"application/java-archive":  true,
+}
+
+// contentAliases lists the declared types a detected container/encoding can legitimately carry
+var contentAliases = map[string][]string{
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	},
+	"application/x-ole-storage": {"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint"},
+	"text/plain":                {"text/csv", "application/json"},
+	"video/webm":                {"audio/webm"},
+	"video/mp4":                 {"video/quicktime"},
+}
+
+// ContentClassification is the outcome of reconciling detected, declared and extension types
+type ContentClassification struct {
+	MimeType         string // type the file is stored under
+	DetectedMimeType string
+	FileType         string
+}
+
+func initMimePolicy() {
+	switch p := getEnv("MIME_MISMATCH_POLICY", "reject"); p {
+	case "reject", "detected", "declared":
+		mimeMismatchPolicy = p
+	default:
+		log.Warnf("Unknown MIME_MISMATCH_POLICY %q, using reject", p)
+	}
+}
+
+// detectContentType identifies a file from its first bytes (up to sniffLen)
+func detectContentType(head []byte) string {
+	has := func(offset int, sig string) bool {
+		return len(head) >= offset+len(sig) && string(head[offset:offset+len(sig)]) == sig
+	}
+	switch {
+	case has(0, "\xFF\xD8\xFF"):
+		return "image/jpeg"
+	case has(0, "\x89PNG\r\n\x1a\n"):
+		return "image/png"
+	case has(0, "GIF87a"), has(0, "GIF89a"):
+		return "image/gif"
+	case has(0, "RIFF") && has(8, "WEBP"):
+		return "image/webp"
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return "audio/wav"
+	case has(4, "ftyp"):
+		if has(8, "qt  ") {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case has(0, "\x1A\x45\xDF\xA3"):
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case has(0, "OggS"):
+		return "audio/ogg"
+	case has(0, "ID3"), has(0, "\xFF\xFB"), has(0, "\xFF\xF3"), has(0, "\xFF\xF2"):
+		return "audio/mpeg"
+	case has(0, "%PDF-"):
+		return "application/pdf"
+	case has(0, "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"):
+		return "application/x-ole-storage"
+	case has(0, "PK\x03\x04"):
+		switch {
+		case bytes.Contains(head, []byte("word/")):
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		case bytes.Contains(head, []byte("xl/")):
+			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case bytes.Contains(head, []byte("ppt/")):
+			return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+		case bytes.Contains(head, []byte("META-INF/MANIFEST.MF")):
+			return "application/java-archive"
+		}
+		return "application/zip"
+	case has(0, "Rar!\x1A\x07"):
+		return "application/x-rar-compressed"
+	case has(0, "7z\xBC\xAF\x27\x1C"):
+		return "application/x-7z-compressed"
+	case has(0, "MZ") && isPE(head):
+		return "application/x-msdownload"
+	case has(0, "\x7FELF"):
+		return "application/x-executable"
+	case has(0, "\xFE\xED\xFA\xCE"), has(0, "\xFE\xED\xFA\xCF"), has(0, "\xCE\xFA\xED\xFE"), has(0, "\xCF\xFA\xED\xFE"), has(0, "\xCA\xFE\xBA\xBE"):
+		return "application/x-mach-binary"
+	case has(0, "#!") && isShebang(head):
+		return "application/x-sh"
+	}
+
+	if isText(head) {
+		trimmed := bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")))
+		lower := bytes.ToLower(trimmed)
+		if bytes.Contains(lower, []byte("<svg")) && (bytes.HasPrefix(lower, []byte("<?xml")) || bytes.HasPrefix(lower, []byte("<svg")) || bytes.HasPrefix(lower, []byte("<!doctype svg"))) {
+			return "image/svg+xml"
+		}
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
+
+// isPE reports whether the DOS header's e_lfanew points at a PE signature within head
+func isPE(head []byte) bool {
+	if len(head) < 0x40 {
+		return false
+	}
+	offset := int64(binary.LittleEndian.Uint32(head[0x3C:]))
+	return offset+4 <= int64(len(head)) && string(head[offset:offset+4]) == "PE\x00\x00"
+}
+
+// isShebang reports whether head starts with an interpreter line ("#!/bin/sh",
+// "#! /usr/bin/env python"). Scripts are refused like other executables, but text
+// that merely starts with "#!" is not a script.
+func isShebang(head []byte) bool {
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimLeft(line, " \t")
+	interpreter := line
+	if i := bytes.IndexAny(line, " \t"); i >= 0 {
+		interpreter = line[:i]
+	}
+	return len(interpreter) > 1 && interpreter[0] == '/' && isText(line)
+}
+
+// isText reports whether head looks like UTF-8 text without control bytes
+func isText(head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+	if !utf8.Valid(head) {
+		// A multi-byte rune may be cut off at the sniff boundary
+		valid := false
+		for i := 1; i < utf8.UTFMax && i < len(head); i++ {
+			if utf8.Valid(head[:len(head)-i]) {
+				head, valid = head[:len(head)-i], true
+				break
+			}
+		}
+		if !valid {
+			return false
+		}
+	}
+	for _, b := range head {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' {
+			return false
+		}
+	}
+	return true
+}
+
+// contentMatches reports whether content detected as detected can carry the claimed type
+func contentMatches(claimed, detected string) bool {
+	if claimed == detected {
+		return true
+	}
+	for _, alias := range contentAliases[detected] {
+		if alias == claimed {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyUpload reconciles the sniffed type of head with the declared Content-Type
+// and the filename extension, applying the configured mismatch policy. The result's
+// FileType is empty when the final type is not in allowedMimeTypes.
+func classifyUpload(head []byte, filename, declared string) (*ContentClassification, error) {
+	detected := detectContentType(head)
+	if executableMimeTypes[detected] {
+		return nil, &UploadVerificationError{Status: 415, Message: fmt.Sprintf("executable content is not allowed (detected %s)", detected)}
+	}
+
+	extType := detectMimeType(filename)
+	if declared == "" || declared == "application/octet-stream" {
+		declared = extType
+	}
+	declared = strings.ToLower(strings.TrimSpace(strings.SplitN(declared, ";", 2)[0]))
+
+	mismatch := ""
+	switch {
+	case len(head) == 0:
+		// An empty file has no content to contradict its name or declared type
+	case !contentMatches(declared, detected):
+		mismatch = fmt.Sprintf("content does not match declared type %s (detected %s)", declared, detected)
+	case extType != "application/octet-stream" && !contentMatches(extType, detected):
+		mismatch = fmt.Sprintf("content does not match file extension %s (detected %s)", extType, detected)
+	}
+
+	final := declared
+	if mismatch != "" {
+		switch mimeMismatchPolicy {
+		case "reject":
+			return nil, &UploadVerificationError{Status: 415, Message: mismatch}
+		case "detected":
+			if detected == "application/octet-stream" {
+				return nil, &UploadVerificationError{Status: 415, Message: mismatch}
+			}
+			final = detected
+		default:
+			log.Warnf("MIME mismatch accepted by policy: %s", mismatch)
+		}
+	}
+
+	return &ContentClassification{
+		MimeType:         final,
+		DetectedMimeType: detected,
+		FileType:         allowedMimeTypes[final],
+	}, nil
+}
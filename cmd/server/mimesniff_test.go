@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func samplePE() []byte {
+	b := make([]byte, 0x80)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint32(b[0x3C:], 0x40)
+	copy(b[0x40:], "PE\x00\x00")
+	return b
+}
+
+func TestDetectContentType(t *testing.T) {
+	cut := bytes.Repeat([]byte("héllo "), 10)
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"pe", samplePE(), "application/x-msdownload"},
+		{"elf", []byte("\x7FELF\x02\x01\x01\x00"), "application/x-executable"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0DIHDR"), "image/png"},
+		{"jpeg", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF"), "image/jpeg"},
+		{"zip", []byte("PK\x03\x04\x14\x00\x00\x00[Content_Types].xml"), "application/zip"},
+		{"docx", []byte("PK\x03\x04\x14\x00\x00\x00word/document.xml"), "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"ole", []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1\x00\x00"), "application/x-ole-storage"},
+		{"csv", []byte("name,age\nada,36\n"), "text/plain"},
+		{"json", []byte(`{"a": [1, 2]}`), "text/plain"},
+		{"svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), "image/svg+xml"},
+		{"rune cut at the sniff boundary", cut[:len(cut)-5], "text/plain"},
+		{"invalid utf-8", []byte("abc\xFF\xFEdef"), "application/octet-stream"},
+		{"control bytes", []byte("abc\x00def"), "application/octet-stream"},
+		{"empty", nil, "application/octet-stream"},
+		{"mz text", []byte("MZ is the start of this line\n"), "text/plain"},
+		{"mz without pe signature", append([]byte("MZ"), make([]byte, 0x7E)...), "application/octet-stream"},
+		{"e_lfanew past the head", func() []byte { b := samplePE(); b[0x3C] = 0x7E; return b }(), "application/octet-stream"},
+		{"shebang", []byte("#!/bin/sh\necho hi\n"), "application/x-sh"},
+		{"shebang with space", []byte("#! /usr/bin/env python3\nprint()\n"), "application/x-sh"},
+		{"hash-bang text", []byte("#!important: read me first\n"), "text/plain"},
+		{"bare hash-bang", []byte("#!"), "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectContentType(tt.head); got != tt.want {
+				t.Fatalf("detectContentType = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyUpload(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0DIHDR")
+	const rejected = "415"
+	tests := []struct {
+		name     string
+		head     []byte
+		filename string
+		declared string
+		// stored type under the reject, detected and declared policies
+		onReject, onDetected, onDeclared string
+	}{
+		{"pe renamed to png", samplePE(), "cat.png", "image/png", rejected, rejected, rejected},
+		{"elf renamed to png", []byte("\x7FELF\x02\x01\x01\x00"), "cat.png", "", rejected, rejected, rejected},
+		{"shebang script as txt", []byte("#!/bin/sh\nrm -rf /\n"), "notes.txt", "text/plain", rejected, rejected, rejected},
+		{"docx detected as zip", []byte("PK\x03\x04\x14\x00\x00\x00[Content_Types].xml"), "report.docx", "",
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"ole declared as doc", []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1\x00\x00"), "old.doc", "application/msword",
+			"application/msword", "application/msword", "application/msword"},
+		{"csv", []byte("name,age\nada,36\n"), "people.csv", "text/csv", "text/csv", "text/csv", "text/csv"},
+		{"json", []byte(`{"a": [1, 2]}`), "data.json", "", "application/json", "application/json", "application/json"},
+		{"png declared as jpeg", png, "photo.jpg", "image/jpeg", rejected, "image/png", "image/jpeg"},
+		{"png with a jpg extension", png, "photo.jpg", "image/png", rejected, "image/png", "image/png"},
+		{"content type parameters", []byte("plain"), "a.txt", "Text/Plain; charset=utf-8", "text/plain", "text/plain", "text/plain"},
+		{"empty txt", nil, "notes.txt", "", "text/plain", "text/plain", "text/plain"},
+		{"empty png", []byte{}, "blank.png", "image/png", "image/png", "image/png", "image/png"},
+		{"mz text", []byte("MZ is the start of this line\n"), "notes.txt", "", "text/plain", "text/plain", "text/plain"},
+		{"hash-bang csv", []byte("#!,total\n1,2\n"), "sheet.csv", "", "text/csv", "text/csv", "text/csv"},
+		{"binary declared as txt", []byte("\x00\x01\x02\x03"), "notes.txt", "", rejected, rejected, "text/plain"},
+	}
+	defer func(policy string) { mimeMismatchPolicy = policy }(mimeMismatchPolicy)
+	for _, tt := range tests {
+		for _, policy := range []struct{ name, want string }{
+			{"reject", tt.onReject}, {"detected", tt.onDetected}, {"declared", tt.onDeclared},
+		} {
+			t.Run(tt.name+"/"+policy.name, func(t *testing.T) {
+				mimeMismatchPolicy = policy.name
+				got, err := classifyUpload(tt.head, tt.filename, tt.declared)
+				if policy.want == rejected {
+					var verr *UploadVerificationError
+					if !errors.As(err, &verr) || verr.Status != 415 {
+						t.Fatalf("expected 415, got %+v, %v", got, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("classify: %v", err)
+				}
+				if got.MimeType != policy.want {
+					t.Fatalf("stored as %s, want %s", got.MimeType, policy.want)
+				}
+				if got.FileType != allowedMimeTypes[policy.want] {
+					t.Fatalf("file type %q, want %q", got.FileType, allowedMimeTypes[policy.want])
+				}
+			})
+		}
+	}
+}
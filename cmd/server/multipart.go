@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Presigned multipart uploads let clients PUT large files in parallel parts
+// straight to storage. Sessions live in Redis under multipart_upload:<file_id>;
+// every session is also indexed in the multipart_uploads sorted set (scored by
+// expiry) so the janitor can abort uploads whose session expired.
+
+const (
+	multipartMinPartSize     = 5 * 1024 * 1024
+	multipartDefaultPartSize = 16 * 1024 * 1024
+	multipartMaxParts        = 10000
+	multipartURLExpiry       = 6 * time.Hour
+	multipartSessionTTL      = 24 * time.Hour
+	multipartJanitorInterval = 10 * time.Minute
+)
+
+// CompletedPart is a part number and the ETag storage returned for it
+type CompletedPart struct {
+	PartNumber int32  `json:"part_number" binding:"required"`
+	ETag       string `json:"etag" binding:"required"`
+}
+
+// MultipartBlobStore is implemented by backends that support presigned multipart uploads
+type MultipartBlobStore interface {
+	CreateMultipart(ctx context.Context, key, contentType string) (string, error)
+	PresignPart(ctx context.Context, key, uploadID string, partNumber int32, expires time.Duration) (string, error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
+
+// MultipartUpload is the Redis-held state of a presigned multipart upload
+type MultipartUpload struct {
+	PendingUpload
+	UploadID  string    `json:"upload_id"`
+	PartSize  int64     `json:"part_size"`
+	PartCount int       `json:"part_count"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// multipartIndexEntry is the janitor's view of a session, kept after the session expires
+type multipartIndexEntry struct {
+	FileID     string `json:"file_id"`
+	StorageKey string `json:"storage_key"`
+	UploadID   string `json:"upload_id"`
+}
+
+func registerMultipartRoutes(api *gin.RouterGroup) {
+	api.POST("/upload/multipart", initiateMultipartUpload)
+	api.POST("/upload/multipart/:fileId/complete", completeMultipartUpload)
+	api.DELETE("/upload/multipart/:fileId", abortMultipartUpload)
+}
+
+// ── S3 backend ──
+
+func (s *s3BlobStore) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *s3BlobStore) PresignPart(ctx context.Context, key, uploadID string, partNumber int32, expires time.Duration) (string, error) {
+	req, err := s.presign.PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int32(partNumber),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3BlobStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: aws.Int32(p.PartNumber),
+			ETag:       aws.String(p.ETag),
+		})
+	}
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (s *s3BlobStore) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	var noUpload *types.NoSuchUpload
+	if err != nil && !errors.As(err, &noUpload) {
+		return err
+	}
+	return nil
+}
+
+// ── Local backend ──
+// Parts are written through the signed /uploads route under multipart/<upload_id>/
+// and concatenated into the final key on completion.
+
+func localPartKey(uploadID string, partNumber int32) string {
+	return fmt.Sprintf("multipart/%s/%05d", uploadID, partNumber)
+}
+
+func (l *localBlobStore) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	return uuid.New().String(), nil
+}
+
+func (l *localBlobStore) PresignPart(ctx context.Context, key, uploadID string, partNumber int32, expires time.Duration) (string, error) {
+	return l.signedURL("PUT", localPartKey(uploadID, partNumber), "", expires), nil
+}
+
+func (l *localBlobStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		rc, err := l.Get(ctx, localPartKey(uploadID, p.PartNumber))
+		if err != nil {
+			return fmt.Errorf("part %d: %w", p.PartNumber, err)
+		}
+		defer rc.Close()
+		readers = append(readers, rc)
+	}
+	if err := l.Put(ctx, key, io.MultiReader(readers...), -1, ""); err != nil {
+		return err
+	}
+	return l.AbortMultipart(ctx, key, uploadID)
+}
+
+func (l *localBlobStore) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	return os.RemoveAll(filepath.Join(l.root, "multipart", filepath.Base(uploadID)))
+}
+
+// ── Session helpers ──
+
+func loadMultipartUpload(ctx context.Context, fileID string) (*MultipartUpload, error) {
+	data, err := redisClient.Get(ctx, "multipart_upload:"+fileID).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var upload MultipartUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func multipartIndexMember(upload *MultipartUpload) string {
+	data, _ := json.Marshal(multipartIndexEntry{FileID: upload.FileID, StorageKey: upload.StorageKey, UploadID: upload.UploadID})
+	return string(data)
+}
+
+func releaseMultipartUpload(ctx context.Context, upload *MultipartUpload) {
+	redisClient.Del(ctx, "multipart_upload:"+upload.FileID)
+	redisClient.ZRem(ctx, "multipart_uploads", multipartIndexMember(upload))
+}
+
+// ── Handlers ──
+
+func initiateMultipartUpload(c *gin.Context) {
+	var req struct {
+		Filename    string `json:"filename" binding:"required"`
+		ContentType string `json:"content_type" binding:"required"`
+		Size        int64  `json:"size" binding:"required,gt=0"`
+		PartSize    int64  `json:"part_size"`
+		WorkspaceID string `json:"workspace_id" binding:"required"`
+		ChannelID   string `json:"channel_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	uploadedBy := currentUserID(c)
+	if !requireWorkspaceMember(c, req.WorkspaceID) {
+		return
+	}
+
+	store, ok := blobStore.(MultipartBlobStore)
+	if !ok {
+		c.JSON(501, gin.H{"error": "storage backend does not support multipart uploads"})
+		return
+	}
+
+	// Validate MIME type and size against the workspace upload policy
+	fileType, err := getUploadPolicy(c.Request.Context(), req.WorkspaceID).Check(req.Filename, req.ContentType, req.Size)
+	if err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+
+	partSize := req.PartSize
+	if partSize == 0 {
+		partSize = multipartDefaultPartSize
+	}
+	if partSize < multipartMinPartSize {
+		partSize = multipartMinPartSize
+	}
+	if min := (req.Size + multipartMaxParts - 1) / multipartMaxParts; partSize < min {
+		partSize = min
+	}
+	partCount := int((req.Size + partSize - 1) / partSize)
+
+	ctx := c.Request.Context()
+	fileID := uuid.New().String()
+	storageKey := fmt.Sprintf("files/%s/%s/%s%s", req.WorkspaceID, uploadedBy, fileID, filepath.Ext(req.Filename))
+
+	if err := reserveQuota(ctx, fileID, req.WorkspaceID, uploadedBy, req.Size, multipartSessionTTL); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+
+	uploadID, err := store.CreateMultipart(ctx, storageKey, req.ContentType)
+	if err != nil {
+		releaseQuota(ctx, fileID)
+		log.Errorf("Failed to create multipart upload: %v", err)
+		c.JSON(500, gin.H{"error": "failed to create multipart upload"})
+		return
+	}
+
+	partURLs := make([]gin.H, 0, partCount)
+	for n := 1; n <= partCount; n++ {
+		url, err := store.PresignPart(ctx, storageKey, uploadID, int32(n), multipartURLExpiry)
+		if err != nil {
+			log.Errorf("Failed to presign upload part: %v", err)
+			store.AbortMultipart(ctx, storageKey, uploadID)
+			releaseQuota(ctx, fileID)
+			c.JSON(500, gin.H{"error": "failed to generate upload URLs"})
+			return
+		}
+		partURLs = append(partURLs, gin.H{"part_number": n, "upload_url": url})
+	}
+
+	upload := &MultipartUpload{
+		PendingUpload: PendingUpload{
+			FileID:      fileID,
+			Filename:    req.Filename,
+			ContentType: req.ContentType,
+			Size:        req.Size,
+			WorkspaceID: req.WorkspaceID,
+			UploadedBy:  uploadedBy,
+			ChannelID:   req.ChannelID,
+			StorageKey:  storageKey,
+			FileType:    fileType,
+		},
+		UploadID:  uploadID,
+		PartSize:  partSize,
+		PartCount: partCount,
+		ExpiresAt: time.Now().Add(multipartSessionTTL),
+	}
+	data, _ := json.Marshal(upload)
+	if err := redisClient.Set(ctx, "multipart_upload:"+fileID, data, multipartSessionTTL).Err(); err != nil {
+		store.AbortMultipart(ctx, storageKey, uploadID)
+		releaseQuota(ctx, fileID)
+		c.JSON(500, gin.H{"error": "failed to create upload session"})
+		return
+	}
+	redisClient.ZAdd(ctx, "multipart_uploads", &redis.Z{
+		Score:  float64(upload.ExpiresAt.Unix()),
+		Member: multipartIndexMember(upload),
+	})
+
+	c.JSON(200, gin.H{
+		"file_id":    fileID,
+		"key":        storageKey,
+		"upload_id":  uploadID,
+		"part_size":  partSize,
+		"part_count": partCount,
+		"parts":      partURLs,
+		"expires_at": time.Now().Add(multipartURLExpiry).Unix(),
+	})
+}
+
+func completeMultipartUpload(c *gin.Context) {
+	var req struct {
+		Parts    []CompletedPart `json:"parts" binding:"required,dive"`
+		Checksum string          `json:"checksum"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	store, ok := blobStore.(MultipartBlobStore)
+	if !ok {
+		c.JSON(501, gin.H{"error": "storage backend does not support multipart uploads"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	upload, err := loadMultipartUpload(ctx, c.Param("fileId"))
+	if err != nil || !ownsUpload(c, &upload.PendingUpload) {
+		c.JSON(404, gin.H{"error": "upload session not found or expired"})
+		return
+	}
+
+	// Every part must be present exactly once
+	sort.Slice(req.Parts, func(i, j int) bool { return req.Parts[i].PartNumber < req.Parts[j].PartNumber })
+	if len(req.Parts) != upload.PartCount {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("expected %d parts, got %d", upload.PartCount, len(req.Parts))})
+		return
+	}
+	for i, p := range req.Parts {
+		if int(p.PartNumber) != i+1 {
+			c.JSON(400, gin.H{"error": "part numbers must be 1.." + strconv.Itoa(upload.PartCount) + " without gaps or duplicates"})
+			return
+		}
+	}
+
+	if err := store.CompleteMultipart(ctx, upload.StorageKey, upload.UploadID, req.Parts); err != nil {
+		log.Errorf("Failed to complete multipart upload: %v", err)
+		c.JSON(502, gin.H{"error": "failed to complete multipart upload"})
+		return
+	}
+
+	// The parts are now one object and the upload can't be completed again, so if it
+	// doesn't become a file it is discarded
+	var newFile *File
+	verified, err := verifyStoredUpload(ctx, upload.PendingUpload, req.Checksum)
+	if err == nil {
+		upload.PendingUpload.applyContent(verified.Content)
+		newFile, err = createFileRecord(ctx, upload.PendingUpload, verified.Checksum)
+	}
+	releaseMultipartUpload(ctx, upload)
+	if err != nil {
+		discardUpload(ctx, upload.PendingUpload)
+		var verr *UploadVerificationError
+		if errors.As(err, &verr) {
+			c.JSON(verr.Status, gin.H{"error": verr.Message})
+			return
+		}
+		log.Errorf("Failed to complete multipart upload %s: %v", upload.FileID, err)
+		c.JSON(500, gin.H{"error": "failed to complete upload"})
+		return
+	}
+
+	log.WithFields(logrus.Fields{"file_id": newFile.FileID, "parts": upload.PartCount}).Info("Multipart upload completed")
+	c.JSON(201, newFile)
+}
+
+func abortMultipartUpload(c *gin.Context) {
+	store, ok := blobStore.(MultipartBlobStore)
+	if !ok {
+		c.JSON(501, gin.H{"error": "storage backend does not support multipart uploads"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	upload, err := loadMultipartUpload(ctx, c.Param("fileId"))
+	if err != nil || !ownsUpload(c, &upload.PendingUpload) {
+		c.JSON(404, gin.H{"error": "upload session not found or expired"})
+		return
+	}
+	if err := store.AbortMultipart(ctx, upload.StorageKey, upload.UploadID); err != nil {
+		log.Errorf("Failed to abort multipart upload: %v", err)
+		c.JSON(502, gin.H{"error": "failed to abort multipart upload"})
+		return
+	}
+	releaseMultipartUpload(ctx, upload)
+	releaseQuota(ctx, upload.FileID)
+	c.JSON(200, gin.H{"message": "upload aborted"})
+}
+
+// ── Janitor ──
+
+// runMultipartJanitor periodically aborts multipart uploads whose Redis session expired
+func runMultipartJanitor(ctx context.Context) {
+	ticker := time.NewTicker(multipartJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			abortStaleMultipartUploads(ctx)
+		}
+	}
+}
+
+func abortStaleMultipartUploads(ctx context.Context) {
+	store, ok := blobStore.(MultipartBlobStore)
+	if !ok {
+		return
+	}
+	members, err := redisClient.ZRangeByScore(ctx, "multipart_uploads", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Errorf("Multipart janitor failed to list sessions: %v", err)
+		return
+	}
+	for _, member := range members {
+		var entry multipartIndexEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			redisClient.ZRem(ctx, "multipart_uploads", member)
+			continue
+		}
+		// A session that still exists was refreshed; leave it for its owner
+		if exists, _ := redisClient.Exists(ctx, "multipart_upload:"+entry.FileID).Result(); exists > 0 {
+			continue
+		}
+		if err := store.AbortMultipart(ctx, entry.StorageKey, entry.UploadID); err != nil {
+			log.Errorf("Multipart janitor failed to abort %s: %v", entry.UploadID, err)
+			continue
+		}
+		redisClient.ZRem(ctx, "multipart_uploads", member)
+		releaseQuota(ctx, entry.FileID)
+		log.WithField("file_id", entry.FileID).Info("Aborted stale multipart upload")
+	}
+}
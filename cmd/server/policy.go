@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WorkspaceUploadPolicy narrows the global allowedMimeTypes/maxFileSizes catalogue
+// for one workspace. Empty fields fall back to the global defaults.
+type WorkspaceUploadPolicy struct {
+	WorkspaceID        string           `json:"workspace_id" bson:"workspace_id"`
+	AllowedMimeTypes   []string         `json:"allowed_mime_types" bson:"allowed_mime_types"`
+	DeniedExtensions   []string         `json:"denied_extensions" bson:"denied_extensions"`
+	MaxFileSizes       map[string]int64 `json:"max_file_sizes" bson:"max_file_sizes"` // by file type
+	MaxFilesPerMessage int              `json:"max_files_per_message" bson:"max_files_per_message"`
+	SanitizeImages     bool             `json:"sanitize_images" bson:"sanitize_images"` // strip EXIF GPS/device tags, apply orientation
+	UpdatedBy          string           `json:"updated_by" bson:"updated_by"`
+	CreatedAt          time.Time        `json:"created_at" bson:"created_at"`
+	UpdatedAt          time.Time        `json:"updated_at" bson:"updated_at"`
+	IsDefault          bool             `json:"is_default" bson:"-"`
+}
+
+const uploadPolicyCacheTTL = 10 * time.Minute
+
+func uploadPoliciesCol() *mongo.Collection { return mongoDB.Collection("workspace_upload_policies") }
+
+func registerPolicyRoutes(api *gin.RouterGroup) {
+	api.GET("/upload-policies", listUploadPolicies)
+	api.GET("/upload-policies/:workspaceId", getUploadPolicyHandler)
+	api.PUT("/upload-policies/:workspaceId", putUploadPolicy)
+	api.DELETE("/upload-policies/:workspaceId", deleteUploadPolicy)
+}
+
+// defaultUploadPolicy is the policy of a workspace that has not configured one
+func defaultUploadPolicy(workspaceID string) *WorkspaceUploadPolicy {
+	return &WorkspaceUploadPolicy{
+		WorkspaceID:      workspaceID,
+		AllowedMimeTypes: []string{},
+		DeniedExtensions: []string{},
+		MaxFileSizes:     map[string]int64{},
+		IsDefault:        true,
+	}
+}
+
+// getUploadPolicy returns the workspace's policy, cached in Redis
+func getUploadPolicy(ctx context.Context, workspaceID string) *WorkspaceUploadPolicy {
+	if data, err := redisClient.Get(ctx, "upload_policy:"+workspaceID).Bytes(); err == nil {
+		var policy WorkspaceUploadPolicy
+		if json.Unmarshal(data, &policy) == nil {
+			return &policy
+		}
+	}
+
+	policy := defaultUploadPolicy(workspaceID)
+	var stored WorkspaceUploadPolicy
+	err := uploadPoliciesCol().FindOne(ctx, bson.M{"workspace_id": workspaceID}).Decode(&stored)
+	if err == nil {
+		policy = &stored
+	} else if err != mongo.ErrNoDocuments {
+		// Don't cache a lookup failure as "no policy"
+		log.Errorf("Failed to load upload policy for %s: %v", workspaceID, err)
+		return policy
+	}
+
+	data, _ := json.Marshal(policy)
+	redisClient.Set(ctx, "upload_policy:"+workspaceID, data, uploadPolicyCacheTTL)
+	return policy
+}
+
+// MaxSize is the size limit for a file type under this policy; it never exceeds
+// the service-wide limit, even for policies stored before that was enforced
+func (p *WorkspaceUploadPolicy) MaxSize(fileType string) int64 {
+	if size, ok := p.MaxFileSizes[fileType]; ok && size > 0 && size < maxFileSizes[fileType] {
+		return size
+	}
+	return maxFileSizes[fileType]
+}
+
+// MaxSizeOverall is the largest size any allowed type may have
+func (p *WorkspaceUploadPolicy) MaxSizeOverall() int64 {
+	var max int64
+	for fileType := range maxFileSizes {
+		if size := p.MaxSize(fileType); size > max {
+			max = size
+		}
+	}
+	return max
+}
+
+// Check validates a file against the policy and returns its file type.
+// A negative size skips the size check (for streams whose size is not known yet).
+func (p *WorkspaceUploadPolicy) Check(filename, mimeType string, size int64) (string, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, denied := range p.DeniedExtensions {
+		if ext != "" && ext == normalizeExtension(denied) {
+			return "", &UploadVerificationError{Status: 415, Message: "file extension not allowed: " + ext}
+		}
+	}
+
+	fileType, ok := allowedMimeTypes[mimeType]
+	if ok && len(p.AllowedMimeTypes) > 0 {
+		ok = false
+		for _, allowed := range p.AllowedMimeTypes {
+			if allowed == mimeType {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return "", &UploadVerificationError{Status: 415, Message: "file type not allowed: " + mimeType}
+	}
+
+	if maxSize := p.MaxSize(fileType); size > maxSize {
+		return "", &UploadVerificationError{Status: 413, Message: fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))}
+	}
+	return fileType, nil
+}
+
+// CheckMessageLimit rejects an upload that would exceed the per-message file limit
+func (p *WorkspaceUploadPolicy) CheckMessageLimit(ctx context.Context, messageID string) error {
+	if messageID == "" || p.MaxFilesPerMessage <= 0 {
+		return nil
+	}
+	count, err := filesCol.CountDocuments(ctx, bson.M{"message_id": messageID, "deleted_at": nil})
+	if err != nil {
+		return err
+	}
+	if count >= int64(p.MaxFilesPerMessage) {
+		return &UploadVerificationError{Status: 400, Message: fmt.Sprintf("a message may have at most %d files", p.MaxFilesPerMessage)}
+	}
+	return nil
+}
+
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// ── Policy handlers ──
+
+func listUploadPolicies(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	cursor, err := uploadPoliciesCol().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "workspace_id", Value: 1}}))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer cursor.Close(ctx)
+	var policies []WorkspaceUploadPolicy
+	cursor.All(ctx, &policies)
+	c.JSON(200, gin.H{"success": true, "data": policies})
+}
+
+func getUploadPolicyHandler(c *gin.Context) {
+	if !requireWorkspaceMember(c, c.Param("workspaceId")) {
+		return
+	}
+	policy := getUploadPolicy(c.Request.Context(), c.Param("workspaceId"))
+	c.JSON(200, gin.H{"success": true, "data": policy})
+}
+
+func putUploadPolicy(c *gin.Context) {
+	workspaceID := c.Param("workspaceId")
+	if !requireWorkspaceAdmin(c, workspaceID) {
+		return
+	}
+	var req struct {
+		AllowedMimeTypes   []string         `json:"allowed_mime_types"`
+		DeniedExtensions   []string         `json:"denied_extensions"`
+		MaxFileSizes       map[string]int64 `json:"max_file_sizes"`
+		MaxFilesPerMessage int              `json:"max_files_per_message"`
+		SanitizeImages     bool             `json:"sanitize_images"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A policy can only narrow the types and sizes the service supports
+	for _, mimeType := range req.AllowedMimeTypes {
+		if _, ok := allowedMimeTypes[mimeType]; !ok {
+			c.JSON(400, gin.H{"error": "unsupported mime type: " + mimeType})
+			return
+		}
+	}
+	for fileType, size := range req.MaxFileSizes {
+		limit, ok := maxFileSizes[fileType]
+		if !ok {
+			c.JSON(400, gin.H{"error": "unknown file type: " + fileType})
+			return
+		}
+		if size <= 0 {
+			c.JSON(400, gin.H{"error": "max file size must be positive"})
+			return
+		}
+		if size > limit {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("max file size for %s may not exceed %d", fileType, limit)})
+			return
+		}
+	}
+	if req.MaxFilesPerMessage < 0 {
+		c.JSON(400, gin.H{"error": "max_files_per_message must not be negative"})
+		return
+	}
+	denied := make([]string, 0, len(req.DeniedExtensions))
+	for _, ext := range req.DeniedExtensions {
+		if ext = normalizeExtension(ext); ext != "" {
+			denied = append(denied, ext)
+		}
+	}
+	if req.AllowedMimeTypes == nil {
+		req.AllowedMimeTypes = []string{}
+	}
+	if req.MaxFileSizes == nil {
+		req.MaxFileSizes = map[string]int64{}
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	_, err := uploadPoliciesCol().UpdateOne(ctx,
+		bson.M{"workspace_id": workspaceID},
+		bson.M{
+			"$set": bson.M{
+				"allowed_mime_types":    req.AllowedMimeTypes,
+				"denied_extensions":     denied,
+				"max_file_sizes":        req.MaxFileSizes,
+				"max_files_per_message": req.MaxFilesPerMessage,
+				"sanitize_images":       req.SanitizeImages,
+				"updated_by":            currentUserID(c),
+				"updated_at":            now,
+			},
+			"$setOnInsert": bson.M{"workspace_id": workspaceID, "created_at": now},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to save upload policy"})
+		return
+	}
+
+	redisClient.Del(ctx, "upload_policy:"+workspaceID)
+	c.JSON(200, gin.H{"success": true, "data": getUploadPolicy(ctx, workspaceID)})
+}
+
+func deleteUploadPolicy(c *gin.Context) {
+	workspaceID := c.Param("workspaceId")
+	if !requireWorkspaceAdmin(c, workspaceID) {
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := uploadPoliciesCol().DeleteOne(ctx, bson.M{"workspace_id": workspaceID}); err != nil {
+		c.JSON(500, gin.H{"error": "failed to delete upload policy"})
+		return
+	}
+	redisClient.Del(ctx, "upload_policy:"+workspaceID)
+	c.JSON(200, gin.H{"success": true, "message": "upload policy reset to defaults"})
+}
+
+// respondPolicyError writes a policy or quota violation with its status, and any
+// other failure as a 500
+func respondPolicyError(c *gin.Context, err error) {
+	var verr *UploadVerificationError
+	if errors.As(err, &verr) {
+		c.JSON(verr.Status, gin.H{"error": verr.Message})
+		return
+	}
+	log.Errorf("Upload check failed: %v", err)
+	c.JSON(500, gin.H{"error": "internal error"})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUploadPolicyMaxSize(t *testing.T) {
+	policy := &WorkspaceUploadPolicy{MaxFileSizes: map[string]int64{
+		"image":    1024,
+		"video":    maxFileSizes["video"] * 2, // stored before sizes were capped
+		"document": 0,
+	}}
+	tests := []struct {
+		fileType string
+		want     int64
+	}{
+		{"image", 1024},
+		{"video", maxFileSizes["video"]},
+		{"document", maxFileSizes["document"]},
+		{"audio", maxFileSizes["audio"]},
+	}
+	for _, tt := range tests {
+		if got := policy.MaxSize(tt.fileType); got != tt.want {
+			t.Errorf("MaxSize(%s) = %d, want %d", tt.fileType, got, tt.want)
+		}
+	}
+
+	var verr *UploadVerificationError
+	if _, err := policy.Check("clip.mp4", "video/mp4", maxFileSizes["video"]+1); !errors.As(err, &verr) || verr.Status != 413 {
+		t.Fatalf("oversized video: %v", err)
+	}
+	if _, err := policy.Check("clip.mp4", "video/mp4", maxFileSizes["video"]); err != nil {
+		t.Fatalf("video at the service limit: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// File lifecycle status. Trashed files are marked by deleted_at; a quarantined file stays
+// listed but its content cannot be read, downloaded, shared, copied or exported until
+// an admin releases it.
+const (
+	fileStatusActive      = "active"
+	fileStatusQuarantined = "quarantined"
+)
+
+func registerQuarantineRoutes(api *gin.RouterGroup) {
+	api.GET("/quarantine", listQuarantinedFiles)
+	api.POST("/:id/quarantine", quarantineFileHandler)
+	api.DELETE("/:id/quarantine", releaseFileHandler)
+}
+
+func (f *File) IsQuarantined() bool {
+	return f.Status == fileStatusQuarantined
+}
+
+// rejectQuarantined writes a 403 and returns true if the file is quarantined
+func rejectQuarantined(c *gin.Context, file *File) bool {
+	if !file.IsQuarantined() {
+		return false
+	}
+	resp := gin.H{"error": "file is quarantined"}
+	if file.Quarantine != nil {
+		resp["reason"] = file.Quarantine.Reason
+	}
+	c.JSON(403, resp)
+	return true
+}
+
+// redactQuarantined strips content URLs from quarantined files in a listing
+func redactQuarantined(files []File) {
+	for i := range files {
+		if files[i].IsQuarantined() {
+			files[i].URL = ""
+			files[i].ThumbnailURL = nil
+		}
+	}
+}
+
+// quarantineFile blocks a file's content, recording why and by whom, and emits file.quarantined
+func quarantineFile(ctx context.Context, file *File, reason, by string) error {
+	now := time.Now()
+	q := FileQuarantine{Reason: reason, By: by, At: now}
+	_, err := filesCol.UpdateOne(ctx, bson.M{"file_id": file.FileID}, bson.M{"$set": bson.M{
+		"status":     fileStatusQuarantined,
+		"quarantine": q,
+		"updated_at": now,
+	}})
+	if err != nil {
+		return err
+	}
+	redisClient.Del(ctx, "file:"+file.FileID)
+	file.Status, file.Quarantine = fileStatusQuarantined, &q
+	logFileActivity(ctx, file.FileID, by, "quarantined", reason)
+
+	publishEvent(FileEvent{
+		Type:        "file.quarantined",
+		FileID:      file.FileID,
+		WorkspaceID: file.WorkspaceID,
+		UserID:      by,
+		Data:        q,
+		Timestamp:   now,
+	})
+	return nil
+}
+
+// releaseQuarantine makes a quarantined file available again. It returns false if the
+// file was not quarantined.
+func releaseQuarantine(ctx context.Context, file *File, by string) (bool, error) {
+	now := time.Now()
+	result, err := filesCol.UpdateOne(ctx,
+		bson.M{"file_id": file.FileID, "status": fileStatusQuarantined},
+		bson.M{
+			"$set":   bson.M{"status": fileStatusActive, "updated_at": now},
+			"$unset": bson.M{"quarantine": ""},
+		})
+	if err != nil || result.ModifiedCount == 0 {
+		return false, err
+	}
+	redisClient.Del(ctx, "file:"+file.FileID)
+	logFileActivity(ctx, file.FileID, by, "quarantine_released", "")
+
+	publishEvent(FileEvent{
+		Type:        "file.quarantine_released",
+		FileID:      file.FileID,
+		WorkspaceID: file.WorkspaceID,
+		UserID:      by,
+		Timestamp:   now,
+	})
+	return true, nil
+}
+
+// ── Admin handlers ──
+
+func listQuarantinedFiles(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := bson.M{"status": fileStatusQuarantined, "deleted_at": nil}
+	// Workspace admins may review their own workspace's quarantine
+	if ws := c.Query("workspace_id"); ws != "" {
+		if !requireWorkspaceAdmin(c, ws) {
+			return
+		}
+		filter["workspace_id"] = ws
+	} else if !requireAdmin(c) {
+		return
+	}
+	cursor, err := filesCol.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "quarantine.at", Value: -1}}).
+		SetLimit(200))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to fetch files"})
+		return
+	}
+	defer cursor.Close(ctx)
+	files := []File{}
+	cursor.All(ctx, &files)
+	redactQuarantined(files)
+	c.JSON(200, gin.H{"success": true, "data": files})
+}
+
+func quarantineFileHandler(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	var file File
+	err := filesCol.FindOne(ctx, bson.M{"file_id": c.Param("id"), "deleted_at": nil}).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireWorkspaceAdmin(c, file.WorkspaceID) {
+		return
+	}
+	if file.IsQuarantined() {
+		c.JSON(409, gin.H{"error": "file is already quarantined"})
+		return
+	}
+	if err := quarantineFile(ctx, &file, req.Reason, currentUserID(c)); err != nil {
+		c.JSON(500, gin.H{"error": "failed to quarantine file"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "data": file.Quarantine})
+}
+
+func releaseFileHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	var file File
+	err := filesCol.FindOne(ctx, bson.M{"file_id": c.Param("id"), "deleted_at": nil}).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireWorkspaceAdmin(c, file.WorkspaceID) {
+		return
+	}
+	released, err := releaseQuarantine(ctx, &file, currentUserID(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to release file"})
+		return
+	}
+	if !released {
+		c.JSON(409, gin.H{"error": "file is not quarantined"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "message": "file released"})
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storage quotas are enforced per workspace and, optionally, per user within a
+// workspace. Usage is kept in Redis counters (quota_used:<ws>, quota_used:<ws>:<user>)
+// that are seeded once from MongoDB and then adjusted incrementally as files and file
+// versions are created, deleted and restored. Uploads whose bytes arrive later (presigned,
+// multipart, resumable) reserve their declared size up front; reservations are
+// counted against the quota until they are committed or released, and expired
+// ones are released by the quota janitor.
+
+const quotaJanitorInterval = time.Minute
+
+var defaultWorkspaceQuota int64 = 10 * 1024 * 1024 * 1024 // 10GB
+
+// StorageQuota configures the limit of a workspace (UserID empty) or of one user in it
+type StorageQuota struct {
+	WorkspaceID           string    `json:"workspace_id" bson:"workspace_id"`
+	UserID                string    `json:"user_id,omitempty" bson:"user_id"`
+	LimitBytes            int64     `json:"limit_bytes" bson:"limit_bytes"`
+	DefaultUserLimitBytes int64     `json:"default_user_limit_bytes,omitempty" bson:"default_user_limit_bytes,omitempty"`
+	UpdatedBy             string    `json:"updated_by" bson:"updated_by"`
+	UpdatedAt             time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// QuotaReservation is space held for an upload whose content has not been committed yet
+type QuotaReservation struct {
+	FileID      string    `json:"file_id"`
+	WorkspaceID string    `json:"workspace_id"`
+	UserID      string    `json:"user_id"`
+	Size        int64     `json:"size"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func storageQuotasCol() *mongo.Collection { return mongoDB.Collection("storage_quotas") }
+
+func initQuotas() {
+	if v := getEnv("DEFAULT_WORKSPACE_QUOTA_BYTES", ""); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 0 {
+			log.Warnf("Invalid DEFAULT_WORKSPACE_QUOTA_BYTES %q, using %d", v, defaultWorkspaceQuota)
+			return
+		}
+		defaultWorkspaceQuota = limit
+	}
+}
+
+func quotaUsedKey(workspaceID, userID string) string {
+	if userID == "" {
+		return "quota_used:" + workspaceID
+	}
+	return "quota_used:" + workspaceID + ":" + userID
+}
+
+func quotaReservedKey(workspaceID, userID string) string {
+	if userID == "" {
+		return "quota_reserved:" + workspaceID
+	}
+	return "quota_reserved:" + workspaceID + ":" + userID
+}
+
+// reserveScript atomically checks used+reserved+size against both limits (0 = unlimited)
+// and records the reservation. Returns 0 on success, 1 if the workspace limit would be
+// exceeded and 2 if the user limit would be.
+var reserveScript = redis.NewScript(`
+local size = tonumber(ARGV[1])
+local wsLimit = tonumber(ARGV[2])
+local userLimit = tonumber(ARGV[3])
+local function total(used, reserved)
+	return tonumber(redis.call('GET', used) or '0') + tonumber(redis.call('GET', reserved) or '0')
+end
+if wsLimit > 0 and total(KEYS[1], KEYS[2]) + size > wsLimit then
+	return 1
+end
+if userLimit > 0 and total(KEYS[3], KEYS[4]) + size > userLimit then
+	return 2
+end
+redis.call('INCRBY', KEYS[2], size)
+if KEYS[4] ~= KEYS[2] then
+	redis.call('INCRBY', KEYS[4], size)
+end
+redis.call('SET', KEYS[5], ARGV[4])
+redis.call('ZADD', KEYS[6], ARGV[5], ARGV[6])
+return 0
+`)
+
+// settleScript drops a reservation (once, guarded by the index) and charges the
+// committed size to the usage counters that have been seeded.
+var settleScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[4], ARGV[1]) == 1 then
+	redis.call('DECRBY', KEYS[1], ARGV[2])
+	if KEYS[2] ~= KEYS[1] then
+		redis.call('DECRBY', KEYS[2], ARGV[2])
+	end
+	redis.call('DEL', KEYS[3])
+end
+local size = tonumber(ARGV[3])
+if size ~= 0 then
+	if redis.call('EXISTS', KEYS[5]) == 1 then
+		redis.call('INCRBY', KEYS[5], size)
+	end
+	if KEYS[6] ~= KEYS[5] and redis.call('EXISTS', KEYS[6]) == 1 then
+		redis.call('INCRBY', KEYS[6], size)
+	end
+end
+return 0
+`)
+
+// quotaLimits returns the workspace and user limits; 0 means unlimited
+func quotaLimits(ctx context.Context, workspaceID, userID string) (int64, int64, error) {
+	wsLimit, userLimit := defaultWorkspaceQuota, int64(0)
+	var ws StorageQuota
+	err := storageQuotasCol().FindOne(ctx, bson.M{"workspace_id": workspaceID, "user_id": ""}).Decode(&ws)
+	if err == nil {
+		wsLimit, userLimit = ws.LimitBytes, ws.DefaultUserLimitBytes
+	} else if err != mongo.ErrNoDocuments {
+		return 0, 0, err
+	}
+	if userID == "" {
+		return wsLimit, userLimit, nil
+	}
+	var user StorageQuota
+	err = storageQuotasCol().FindOne(ctx, bson.M{"workspace_id": workspaceID, "user_id": userID}).Decode(&user)
+	if err == nil {
+		userLimit = user.LimitBytes
+	} else if err != mongo.ErrNoDocuments {
+		return 0, 0, err
+	}
+	return wsLimit, userLimit, nil
+}
+
+// quotaUsage returns the committed usage, seeding the counter from MongoDB on first use
+func quotaUsage(ctx context.Context, workspaceID, userID string) (int64, error) {
+	key := quotaUsedKey(workspaceID, userID)
+	used, err := redisClient.Get(ctx, key).Int64()
+	if err == nil {
+		return used, nil
+	}
+	if err != redis.Nil {
+		return 0, err
+	}
+
+	// Live files plus every stored version, trashed files' versions included
+	match := bson.M{"workspace_id": workspaceID, "deleted_at": nil}
+	versionMatch := bson.M{"workspace_id": workspaceID}
+	if userID != "" {
+		match["uploaded_by"] = userID
+		versionMatch["owner_id"] = userID
+	}
+	if used, err = sumSizes(ctx, filesCol, match); err != nil {
+		return 0, err
+	}
+	versions, err := sumSizes(ctx, versionsCol(), versionMatch)
+	if err != nil {
+		return 0, err
+	}
+	used += versions
+	// Another request may have seeded the counter meanwhile; keep whichever was first
+	redisClient.SetNX(ctx, key, used, 0)
+	return redisClient.Get(ctx, key).Int64()
+}
+
+// sumSizes totals the size field of the documents in col matching match
+func sumSizes(ctx context.Context, col *mongo.Collection, match bson.M) (int64, error) {
+	cursor, err := col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total_size": bson.M{"$sum": "$size"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var result []struct {
+		TotalSize int64 `bson:"total_size"`
+	}
+	if err := cursor.All(ctx, &result); err != nil || len(result) == 0 {
+		return 0, err
+	}
+	return result[0].TotalSize, nil
+}
+
+func quotaReserved(ctx context.Context, workspaceID, userID string) int64 {
+	reserved, _ := redisClient.Get(ctx, quotaReservedKey(workspaceID, userID)).Int64()
+	return reserved
+}
+
+// reserveQuota holds size bytes for fileID until it is committed, released or expires.
+// Exceeding a limit returns an *UploadVerificationError with status 413; a negative
+// size, which would lower the reserved counters, is rejected with status 400.
+func reserveQuota(ctx context.Context, fileID, workspaceID, userID string, size int64, ttl time.Duration) error {
+	if size < 0 {
+		return &UploadVerificationError{Status: 400, Message: "size must not be negative"}
+	}
+	wsLimit, userLimit, err := quotaLimits(ctx, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := quotaUsage(ctx, workspaceID, ""); err != nil {
+		return err
+	}
+	if _, err := quotaUsage(ctx, workspaceID, userID); err != nil {
+		return err
+	}
+
+	reservation := QuotaReservation{
+		FileID:      fileID,
+		WorkspaceID: workspaceID,
+		UserID:      userID,
+		Size:        size,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	data, _ := json.Marshal(reservation)
+	res, err := reserveScript.Run(ctx, redisClient,
+		[]string{
+			quotaUsedKey(workspaceID, ""), quotaReservedKey(workspaceID, ""),
+			quotaUsedKey(workspaceID, userID), quotaReservedKey(workspaceID, userID),
+			"quota_reservation:" + fileID, "quota_reservations",
+		},
+		size, wsLimit, userLimit, data, reservation.ExpiresAt.Unix(), fileID,
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case 1:
+		return &UploadVerificationError{Status: 413, Message: fmt.Sprintf("workspace storage quota exceeded (limit %d bytes)", wsLimit)}
+	case 2:
+		return &UploadVerificationError{Status: 413, Message: fmt.Sprintf("user storage quota exceeded (limit %d bytes)", userLimit)}
+	}
+	return nil
+}
+
+// extendQuotaReservation pushes back the expiry of an active reservation
+func extendQuotaReservation(ctx context.Context, fileID string, expiresAt time.Time) {
+	redisClient.ZAddXX(ctx, "quota_reservations", &redis.Z{Score: float64(expiresAt.Unix()), Member: fileID})
+}
+
+// settleQuota drops fileID's reservation, if it still has one, and charges size bytes
+// of committed usage (negative to credit usage back).
+func settleQuota(ctx context.Context, fileID, workspaceID, userID string, size int64) {
+	var reservation QuotaReservation
+	if data, err := redisClient.Get(ctx, "quota_reservation:"+fileID).Bytes(); err == nil {
+		json.Unmarshal(data, &reservation)
+	}
+	if workspaceID == "" {
+		workspaceID, userID = reservation.WorkspaceID, reservation.UserID
+	}
+	if workspaceID == "" {
+		// Nothing reserved and nothing to charge
+		redisClient.ZRem(ctx, "quota_reservations", fileID)
+		return
+	}
+	err := settleScript.Run(ctx, redisClient,
+		[]string{
+			quotaReservedKey(workspaceID, ""), quotaReservedKey(workspaceID, userID),
+			"quota_reservation:" + fileID, "quota_reservations",
+			quotaUsedKey(workspaceID, ""), quotaUsedKey(workspaceID, userID),
+		},
+		fileID, reservation.Size, size,
+	).Err()
+	if err != nil {
+		log.Errorf("Failed to settle quota for %s: %v", fileID, err)
+	}
+}
+
+// commitQuota converts fileID's reservation into size bytes of usage
+func commitQuota(ctx context.Context, fileID, workspaceID, userID string, size int64) {
+	settleQuota(ctx, fileID, workspaceID, userID, size)
+}
+
+// releaseQuota gives back fileID's reservation without charging anything
+func releaseQuota(ctx context.Context, fileID string) {
+	settleQuota(ctx, fileID, "", "", 0)
+}
+
+// creditQuota returns a deleted file's bytes to its workspace and owner
+func creditQuota(ctx context.Context, file *File) {
+	settleQuota(ctx, file.FileID, file.WorkspaceID, file.UploadedBy, -file.Size)
+}
+
+// ── Janitor ──
+
+// runQuotaJanitor periodically releases reservations whose upload never completed
+func runQuotaJanitor(ctx context.Context) {
+	ticker := time.NewTicker(quotaJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			releaseExpiredReservations(ctx)
+		}
+	}
+}
+
+func releaseExpiredReservations(ctx context.Context) {
+	fileIDs, err := redisClient.ZRangeByScore(ctx, "quota_reservations", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Errorf("Quota janitor failed to list reservations: %v", err)
+		return
+	}
+	for _, fileID := range fileIDs {
+		releaseQuota(ctx, fileID)
+		log.WithField("file_id", fileID).Info("Released expired quota reservation")
+	}
+}
+
+// ── Quota handlers ──
+
+func quotaSummary(ctx context.Context, workspaceID, userID string, limit int64) (gin.H, error) {
+	used, err := quotaUsage(ctx, workspaceID, userID)
+	if err != nil {
+		return nil, err
+	}
+	reserved := quotaReserved(ctx, workspaceID, userID)
+	summary := gin.H{
+		"workspace_id": workspaceID,
+		"total_size":   used,
+		"reserved":     reserved,
+		"quota_limit":  limit,
+	}
+	if userID != "" {
+		summary["user_id"] = userID
+	}
+	if limit > 0 {
+		remaining := limit - used - reserved
+		if remaining < 0 {
+			remaining = 0
+		}
+		summary["remaining"] = remaining
+	}
+	return summary, nil
+}
+
+func getUserStorageQuota(c *gin.Context) {
+	workspaceID, userID := c.Param("workspaceId"), c.Param("userId")
+	if userID != currentUserID(c) && !requireWorkspaceAdmin(c, workspaceID) {
+		return
+	}
+	ctx := c.Request.Context()
+	_, userLimit, err := quotaLimits(ctx, workspaceID, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load quota"})
+		return
+	}
+	summary, err := quotaSummary(ctx, workspaceID, userID, userLimit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load usage"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "data": summary})
+}
+
+func setStorageQuota(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req struct {
+		LimitBytes            int64 `json:"limit_bytes"`
+		DefaultUserLimitBytes int64 `json:"default_user_limit_bytes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.LimitBytes < 0 || req.DefaultUserLimitBytes < 0 {
+		c.JSON(400, gin.H{"error": "limits must not be negative"})
+		return
+	}
+	saveStorageQuota(c, StorageQuota{
+		WorkspaceID:           c.Param("workspaceId"),
+		LimitBytes:            req.LimitBytes,
+		DefaultUserLimitBytes: req.DefaultUserLimitBytes,
+	})
+}
+
+func setUserStorageQuota(c *gin.Context) {
+	if !requireWorkspaceAdmin(c, c.Param("workspaceId")) {
+		return
+	}
+	var req struct {
+		LimitBytes int64 `json:"limit_bytes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.LimitBytes < 0 {
+		c.JSON(400, gin.H{"error": "limit must not be negative"})
+		return
+	}
+	saveStorageQuota(c, StorageQuota{
+		WorkspaceID: c.Param("workspaceId"),
+		UserID:      c.Param("userId"),
+		LimitBytes:  req.LimitBytes,
+	})
+}
+
+func saveStorageQuota(c *gin.Context, quota StorageQuota) {
+	quota.UpdatedBy = currentUserID(c)
+	quota.UpdatedAt = time.Now()
+	_, err := storageQuotasCol().ReplaceOne(c.Request.Context(),
+		bson.M{"workspace_id": quota.WorkspaceID, "user_id": quota.UserID},
+		quota,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to save quota"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "data": quota})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A negative size must never reach reserveQuota, where it would lower the reserved counters
+func TestNegativeUploadSize(t *testing.T) {
+	body := `{"filename":"a.png","content_type":"image/png","size":-1048576,"workspace_id":"ws1"}`
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+	}{
+		{"presigned", getPresignedUploadURL},
+		{"multipart", initiateMultipartUpload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			tt.handler(c)
+			if w.Code != 400 {
+				t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+			}
+		})
+	}
+
+	var verr *UploadVerificationError
+	err := reserveQuota(context.Background(), "f1", "ws1", "u1", -1, time.Minute)
+	if !errors.As(err, &verr) || verr.Status != 400 {
+		t.Fatalf("reserveQuota(-1) = %v, want a 400", err)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Resumable uploads implement the tus 1.0 core protocol plus the creation,
+// termination and expiration extensions. Each PATCH body is stored as its own
+// chunk object; once the declared length is reached the chunks are streamed
+// into the final storage key and the File record is created exactly like
+// completeUpload does for presigned uploads. Sessions are indexed in the
+// resumable_uploads sorted set (scored by expiry) so the janitor can delete
+// the chunks of uploads that were abandoned.
+
+const (
+	tusVersion        = "1.0.0"
+	tusBasePath       = "/api/v1/files/upload/resumable"
+	resumableTTL      = 24 * time.Hour
+	resumableLockTTL  = 5 * time.Minute
+	resumableMaxChunk = 64 * 1024 * 1024
+
+	resumableJanitorInterval = 10 * time.Minute
+)
+
+// ResumableUpload is the Redis-held state of a tus upload session
+type ResumableUpload struct {
+	PendingUpload
+	Offset    int64     `json:"offset"`
+	Chunks    int       `json:"chunks"`
+	HashState []byte    `json:"hash_state"`
+	Completed bool      `json:"completed"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func registerResumableRoutes(api *gin.RouterGroup) {
+	api.POST("/upload/resumable", createResumableUpload)
+	api.HEAD("/upload/resumable/:uploadId", getResumableOffset)
+	api.PATCH("/upload/resumable/:uploadId", patchResumableUpload)
+	api.DELETE("/upload/resumable/:uploadId", terminateResumableUpload)
+	api.POST("/upload/resumable/:uploadId/complete", completeResumableUpload)
+}
+
+// setTusDiscoveryHeaders answers the tus OPTIONS capability request. Clients
+// may pass ?workspace_id= to learn the maximum size that workspace accepts.
+func setTusDiscoveryHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination,expiration")
+	policy := defaultUploadPolicy("")
+	if workspaceID := c.Query("workspace_id"); workspaceID != "" {
+		policy = getUploadPolicy(c.Request.Context(), workspaceID)
+	}
+	setTusMaxSize(c, policy)
+}
+
+func setTusMaxSize(c *gin.Context, policy *WorkspaceUploadPolicy) {
+	c.Header("Tus-Max-Size", strconv.FormatInt(policy.MaxSizeOverall(), 10))
+}
+
+// requireTus rejects requests from clients speaking an unsupported protocol version
+func requireTus(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(412, gin.H{"error": "unsupported Tus-Resumable version"})
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes the Upload-Metadata header ("key base64value,...")
+func parseTusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 1 {
+			meta[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		meta[parts[0]] = string(value)
+	}
+	return meta
+}
+
+func resumableChunkKey(uploadID string, index int) string {
+	return fmt.Sprintf("uploads/resumable/%s/%06d", uploadID, index)
+}
+
+func deleteResumableChunks(ctx context.Context, upload *ResumableUpload) {
+	for i := 0; i < upload.Chunks; i++ {
+		blobStore.Delete(ctx, resumableChunkKey(upload.FileID, i))
+	}
+}
+
+func loadResumableUpload(ctx context.Context, uploadID string) (*ResumableUpload, error) {
+	data, err := redisClient.Get(ctx, "resumable_upload:"+uploadID).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var upload ResumableUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func saveResumableUpload(ctx context.Context, upload *ResumableUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	if err := redisClient.Set(ctx, "resumable_upload:"+upload.FileID, data, time.Until(upload.ExpiresAt)).Err(); err != nil {
+		return err
+	}
+	// A completed upload has no chunks left for the janitor
+	if upload.Completed {
+		redisClient.ZRem(ctx, "resumable_uploads", upload.FileID)
+	} else {
+		redisClient.ZAdd(ctx, "resumable_uploads", &redis.Z{Score: float64(upload.ExpiresAt.Unix()), Member: upload.FileID})
+	}
+	return nil
+}
+
+// lockResumableUpload serialises PATCH/finalize on one session across replicas
+func lockResumableUpload(ctx context.Context, uploadID string) (func(), bool) {
+	key := "resumable_lock:" + uploadID
+	ok, err := redisClient.SetNX(ctx, key, "1", resumableLockTTL).Result()
+	if err != nil || !ok {
+		return nil, false
+	}
+	return func() { redisClient.Del(context.Background(), key) }, true
+}
+
+func createResumableUpload(c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(400, gin.H{"error": "Upload-Defer-Length is not supported"})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(400, gin.H{"error": "valid Upload-Length header is required"})
+		return
+	}
+
+	meta := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	filename := meta["filename"]
+	contentType := meta["filetype"]
+	if contentType == "" {
+		contentType = meta["content_type"]
+	}
+	if contentType == "" {
+		contentType = detectMimeType(filename)
+	}
+	workspaceID := meta["workspace_id"]
+	uploadedBy := currentUserID(c)
+	if filename == "" || workspaceID == "" {
+		c.JSON(400, gin.H{"error": "Upload-Metadata must include filename and workspace_id"})
+		return
+	}
+	if !requireWorkspaceMember(c, workspaceID) {
+		return
+	}
+
+	// Validate MIME type and size against the workspace upload policy
+	policy := getUploadPolicy(c.Request.Context(), workspaceID)
+	setTusMaxSize(c, policy)
+	fileType, err := policy.Check(filename, contentType, length)
+	if err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+
+	fileID := uuid.New().String()
+	hashState, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	upload := &ResumableUpload{
+		PendingUpload: PendingUpload{
+			FileID:      fileID,
+			Filename:    filename,
+			ContentType: contentType,
+			Size:        length,
+			WorkspaceID: workspaceID,
+			UploadedBy:  uploadedBy,
+			ChannelID:   meta["channel_id"],
+			StorageKey:  fmt.Sprintf("files/%s/%s/%s%s", workspaceID, uploadedBy, fileID, filepath.Ext(filename)),
+			FileType:    fileType,
+		},
+		HashState: hashState,
+		ExpiresAt: time.Now().Add(resumableTTL),
+	}
+	if err := reserveQuota(c.Request.Context(), fileID, workspaceID, uploadedBy, length, resumableTTL); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	if err := saveResumableUpload(c.Request.Context(), upload); err != nil {
+		releaseQuota(c.Request.Context(), fileID)
+		log.Errorf("Failed to create resumable upload: %v", err)
+		c.JSON(500, gin.H{"error": "failed to create upload session"})
+		return
+	}
+
+	c.Header("Location", tusBasePath+"/"+fileID)
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(201)
+}
+
+func getResumableOffset(c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	upload, err := loadResumableUpload(c.Request.Context(), c.Param("uploadId"))
+	if err != nil || !ownsUpload(c, &upload.PendingUpload) {
+		c.Status(404)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(200)
+}
+
+func patchResumableUpload(c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	uploadID := c.Param("uploadId")
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(415, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(400, gin.H{"error": "valid Upload-Offset header is required"})
+		return
+	}
+
+	unlock, ok := lockResumableUpload(ctx, uploadID)
+	if !ok {
+		c.JSON(423, gin.H{"error": "upload is busy"})
+		return
+	}
+	defer unlock()
+
+	upload, err := loadResumableUpload(ctx, uploadID)
+	if err != nil || !ownsUpload(c, &upload.PendingUpload) {
+		c.JSON(404, gin.H{"error": "upload session not found or expired"})
+		return
+	}
+	if upload.Completed {
+		c.JSON(409, gin.H{"error": "upload already completed"})
+		return
+	}
+	if offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(409, gin.H{"error": "Upload-Offset does not match current offset"})
+		return
+	}
+
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		c.JSON(500, gin.H{"error": "corrupt upload session"})
+		return
+	}
+
+	// Store this chunk as its own object, never accepting more than the remaining length
+	remaining := upload.Size - upload.Offset
+	limit := remaining
+	if limit > resumableMaxChunk {
+		limit = resumableMaxChunk
+	}
+	chunkKey := resumableChunkKey(uploadID, upload.Chunks)
+	body := &countingReader{r: io.LimitReader(c.Request.Body, limit+1)}
+	if err := blobStore.Put(ctx, chunkKey, io.TeeReader(body, hasher), -1, "application/octet-stream"); err != nil {
+		log.Errorf("Failed to store upload chunk: %v", err)
+		blobStore.Delete(context.Background(), chunkKey)
+		c.JSON(500, gin.H{"error": "failed to store chunk"})
+		return
+	}
+	if body.n > limit {
+		blobStore.Delete(ctx, chunkKey)
+		c.JSON(413, gin.H{"error": "chunk exceeds remaining upload length or max chunk size"})
+		return
+	}
+	if body.n == 0 {
+		blobStore.Delete(ctx, chunkKey)
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Status(204)
+		return
+	}
+
+	upload.Offset += body.n
+	upload.Chunks++
+	upload.HashState, _ = hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	upload.ExpiresAt = time.Now().Add(resumableTTL)
+	extendQuotaReservation(ctx, uploadID, upload.ExpiresAt)
+	if err := saveResumableUpload(ctx, upload); err != nil {
+		blobStore.Delete(ctx, chunkKey)
+		c.JSON(500, gin.H{"error": "failed to update upload session"})
+		return
+	}
+
+	if upload.Offset == upload.Size {
+		file, err := finalizeResumableUpload(ctx, upload)
+		if err != nil {
+			respondFinalizeError(c, uploadID, err)
+			return
+		}
+		c.Header("Upload-File-ID", file.FileID)
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(204)
+}
+
+// finalizeResumableUpload concatenates the chunks into the final object and
+// creates the File record. The session is kept, marked completed, so that a
+// retried finalize returns the same file. A rejected upload is discarded.
+func finalizeResumableUpload(ctx context.Context, upload *ResumableUpload) (_ *File, err error) {
+	defer func() {
+		var verr *UploadVerificationError
+		if errors.As(err, &verr) {
+			deleteResumableChunks(ctx, upload)
+			discardUpload(ctx, upload.PendingUpload, "resumable_upload:"+upload.FileID)
+			redisClient.ZRem(ctx, "resumable_uploads", upload.FileID)
+		}
+	}()
+	readers := make([]io.Reader, 0, upload.Chunks)
+	closers := make([]io.Closer, 0, upload.Chunks)
+	defer func() {
+		for _, rc := range closers {
+			rc.Close()
+		}
+	}()
+	for i := 0; i < upload.Chunks; i++ {
+		rc, err := blobStore.Get(ctx, resumableChunkKey(upload.FileID, i))
+		if err != nil {
+			return nil, fmt.Errorf("read chunk %d: %w", i, err)
+		}
+		readers = append(readers, rc)
+		closers = append(closers, rc)
+	}
+	// Classify the content from the head of the first chunk before assembling
+	first := bufio.NewReaderSize(readers[0], sniffLen)
+	head, err := first.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	content, err := classifyUpload(head, upload.Filename, upload.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getUploadPolicy(ctx, upload.WorkspaceID).Check(upload.Filename, content.MimeType, upload.Size); err != nil {
+		return nil, err
+	}
+	upload.PendingUpload.applyContent(content)
+	readers[0] = first
+
+	if err := blobStore.Put(ctx, upload.StorageKey, io.MultiReader(readers...), upload.Size, upload.ContentType); err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		return nil, err
+	}
+	file, err := createFileRecord(ctx, upload.PendingUpload, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return nil, err
+	}
+
+	upload.Completed = true
+	upload.ExpiresAt = time.Now().Add(1 * time.Hour)
+	saveResumableUpload(ctx, upload)
+	deleteResumableChunks(ctx, upload)
+
+	log.WithFields(logrus.Fields{"file_id": file.FileID, "size": file.Size}).Info("Resumable upload completed")
+	return file, nil
+}
+
+// completeResumableUpload finalizes an upload whose bytes have all arrived and
+// returns its File; it is idempotent for sessions finalized by the last PATCH
+func completeResumableUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+	uploadID := c.Param("uploadId")
+
+	unlock, ok := lockResumableUpload(ctx, uploadID)
+	if !ok {
+		c.JSON(423, gin.H{"error": "upload is busy"})
+		return
+	}
+	defer unlock()
+
+	upload, err := loadResumableUpload(ctx, uploadID)
+	if err != nil || !ownsUpload(c, &upload.PendingUpload) {
+		c.JSON(404, gin.H{"error": "upload session not found or expired"})
+		return
+	}
+	if upload.Completed {
+		var file File
+		if err := filesCol.FindOne(ctx, bson.M{"file_id": upload.FileID}).Decode(&file); err != nil {
+			c.JSON(404, gin.H{"error": "file not found"})
+			return
+		}
+		c.JSON(200, file)
+		return
+	}
+	if upload.Offset != upload.Size {
+		c.JSON(409, gin.H{"error": "upload incomplete", "offset": upload.Offset, "length": upload.Size})
+		return
+	}
+
+	file, err := finalizeResumableUpload(ctx, upload)
+	if err != nil {
+		respondFinalizeError(c, uploadID, err)
+		return
+	}
+	c.JSON(201, file)
+}
+
+func respondFinalizeError(c *gin.Context, uploadID string, err error) {
+	var verr *UploadVerificationError
+	if errors.As(err, &verr) {
+		c.JSON(verr.Status, gin.H{"error": verr.Message})
+		return
+	}
+	log.Errorf("Failed to finalize resumable upload %s: %v", uploadID, err)
+	c.JSON(500, gin.H{"error": "failed to finalize upload"})
+}
+
+func terminateResumableUpload(c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	uploadID := c.Param("uploadId")
+
+	unlock, ok := lockResumableUpload(ctx, uploadID)
+	if !ok {
+		c.JSON(423, gin.H{"error": "upload is busy"})
+		return
+	}
+	defer unlock()
+
+	upload, err := loadResumableUpload(ctx, uploadID)
+	if err != nil || !ownsUpload(c, &upload.PendingUpload) {
+		c.Status(404)
+		return
+	}
+	if !upload.Completed {
+		deleteResumableChunks(ctx, upload)
+		releaseQuota(ctx, uploadID)
+	}
+	redisClient.Del(ctx, "resumable_upload:"+uploadID)
+	redisClient.ZRem(ctx, "resumable_uploads", uploadID)
+	c.Status(204)
+}
+
+// ── Janitor ──
+
+// runResumableJanitor periodically deletes the chunks of resumable uploads whose
+// Redis session expired
+func runResumableJanitor(ctx context.Context) {
+	ticker := time.NewTicker(resumableJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cleanStaleResumableUploads(ctx)
+		}
+	}
+}
+
+func cleanStaleResumableUploads(ctx context.Context) {
+	uploadIDs, err := redisClient.ZRangeByScore(ctx, "resumable_uploads", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Errorf("Resumable janitor failed to list sessions: %v", err)
+		return
+	}
+	for _, uploadID := range uploadIDs {
+		// A session that still exists was refreshed; leave it for its owner
+		if exists, _ := redisClient.Exists(ctx, "resumable_upload:"+uploadID).Result(); exists > 0 {
+			continue
+		}
+		// The session, and with it the chunk count, is gone, so delete chunks
+		// until the first one that was never written
+		var err error
+		chunks := 0
+		for ; ; chunks++ {
+			key := resumableChunkKey(uploadID, chunks)
+			if _, err = blobStore.Stat(ctx, key); err != nil {
+				break
+			}
+			if err = blobStore.Delete(ctx, key); err != nil {
+				break
+			}
+		}
+		if !errors.Is(err, ErrBlobNotFound) {
+			log.Errorf("Resumable janitor failed to delete chunks of %s: %v", uploadID, err)
+			continue
+		}
+		redisClient.ZRem(ctx, "resumable_uploads", uploadID)
+		releaseQuota(ctx, uploadID)
+		log.WithFields(logrus.Fields{"file_id": uploadID, "chunks": chunks}).Info("Cleaned up stale resumable upload")
+	}
+}
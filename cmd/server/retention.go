@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// VersionRetentionPolicy decides which versions of a workspace's files are kept. A version
+// survives if any rule keeps it, so a workspace without a policy keeps every version.
+// Daily and weekly rules keep the newest version saved in each of the most recent N UTC
+// days or ISO weeks that have versions, whatever their age.
+type VersionRetentionPolicy struct {
+	WorkspaceID    string     `json:"workspace_id" bson:"workspace_id"`
+	KeepLast       int        `json:"keep_last" bson:"keep_last"`               // newest N versions of each file
+	KeepWithinDays int        `json:"keep_within_days" bson:"keep_within_days"` // versions saved in the last D days
+	KeepDaily      int        `json:"keep_daily" bson:"keep_daily"`
+	KeepWeekly     int        `json:"keep_weekly" bson:"keep_weekly"`
+	UpdatedBy      string     `json:"updated_by" bson:"updated_by"`
+	CreatedAt      time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" bson:"updated_at"`
+	LastPrunedAt   *time.Time `json:"last_pruned_at,omitempty" bson:"last_pruned_at,omitempty"`
+	ReclaimedBytes int64      `json:"reclaimed_bytes" bson:"reclaimed_bytes"` // total freed by pruning
+	IsDefault      bool       `json:"is_default" bson:"-"`
+}
+
+const versionPruneInterval = time.Hour
+
+func retentionPoliciesCol() *mongo.Collection {
+	return mongoDB.Collection("version_retention_policies")
+}
+
+func registerRetentionRoutes(api *gin.RouterGroup) {
+	api.GET("/retention-policies/:workspaceId", getRetentionPolicy)
+	api.PUT("/retention-policies/:workspaceId", putRetentionPolicy)
+	api.DELETE("/retention-policies/:workspaceId", deleteRetentionPolicy)
+	api.POST("/retention-policies/:workspaceId/prune", pruneWorkspaceVersionsHandler)
+}
+
+// retainedVersions returns the IDs of the versions to keep. versions must be one file's
+// versions, newest first.
+func (p *VersionRetentionPolicy) retainedVersions(versions []FileVersion, now time.Time) map[string]bool {
+	keep := map[string]bool{}
+	days, weeks := map[string]bool{}, map[string]bool{}
+	for i, v := range versions {
+		id := v.ID.Hex()
+		if i < p.KeepLast {
+			keep[id] = true
+		}
+		if p.KeepWithinDays > 0 && now.Sub(v.CreatedAt) < time.Duration(p.KeepWithinDays)*24*time.Hour {
+			keep[id] = true
+		}
+		day := v.CreatedAt.UTC().Format("2006-01-02")
+		if !days[day] && len(days) < p.KeepDaily {
+			days[day] = true
+			keep[id] = true
+		}
+		year, week := v.CreatedAt.UTC().ISOWeek()
+		if w := fmt.Sprintf("%d-W%02d", year, week); !weeks[w] && len(weeks) < p.KeepWeekly {
+			weeks[w] = true
+			keep[id] = true
+		}
+	}
+	return keep
+}
+
+// ── Pruner ──
+
+// runVersionPruner periodically applies every workspace's retention policy
+func runVersionPruner(ctx context.Context) {
+	ticker := time.NewTicker(versionPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruneAllVersions(ctx)
+		}
+	}
+}
+
+func pruneAllVersions(ctx context.Context) {
+	cursor, err := retentionPoliciesCol().Find(ctx, bson.M{})
+	if err != nil {
+		log.Errorf("Version pruner failed to list retention policies: %v", err)
+		return
+	}
+	var policies []VersionRetentionPolicy
+	if err := cursor.All(ctx, &policies); err != nil {
+		log.Errorf("Version pruner failed to list retention policies: %v", err)
+		return
+	}
+	for i := range policies {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, _, err := pruneWorkspaceVersions(ctx, &policies[i]); err != nil {
+			log.WithField("workspace_id", policies[i].WorkspaceID).Errorf("Failed to prune versions: %v", err)
+		}
+	}
+}
+
+// pruneWorkspaceVersions deletes the versions the policy doesn't keep, with their blobs,
+// returning how many were deleted and the bytes credited back to the quota
+func pruneWorkspaceVersions(ctx context.Context, policy *VersionRetentionPolicy) (int, int64, error) {
+	fileIDs, err := versionsCol().Distinct(ctx, "file_id", bson.M{"workspace_id": policy.WorkspaceID})
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	pruned, reclaimed := 0, int64(0)
+	for _, fileID := range fileIDs {
+		cursor, err := versionsCol().Find(ctx,
+			bson.M{"file_id": fileID, "workspace_id": policy.WorkspaceID},
+			options.Find().SetSort(bson.D{{Key: "version_num", Value: -1}}))
+		if err != nil {
+			return pruned, reclaimed, err
+		}
+		var versions []FileVersion
+		if err := cursor.All(ctx, &versions); err != nil {
+			return pruned, reclaimed, err
+		}
+		keep := policy.retainedVersions(versions, now)
+		for i := range versions {
+			if keep[versions[i].ID.Hex()] {
+				continue
+			}
+			freed, err := deleteFileVersion(ctx, &versions[i])
+			if err != nil {
+				return pruned, reclaimed, err
+			}
+			pruned++
+			reclaimed += freed
+		}
+	}
+
+	retentionPoliciesCol().UpdateOne(ctx, bson.M{"workspace_id": policy.WorkspaceID}, bson.M{
+		"$set": bson.M{"last_pruned_at": now},
+		"$inc": bson.M{"reclaimed_bytes": reclaimed},
+	})
+	if pruned > 0 {
+		log.WithField("workspace_id", policy.WorkspaceID).Infof("Pruned %d versions, reclaimed %d bytes", pruned, reclaimed)
+	}
+	return pruned, reclaimed, nil
+}
+
+// ── Retention policy handlers ──
+
+func loadRetentionPolicy(ctx context.Context, workspaceID string) (*VersionRetentionPolicy, error) {
+	var policy VersionRetentionPolicy
+	err := retentionPoliciesCol().FindOne(ctx, bson.M{"workspace_id": workspaceID}).Decode(&policy)
+	if err == mongo.ErrNoDocuments {
+		return &VersionRetentionPolicy{WorkspaceID: workspaceID, IsDefault: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func getRetentionPolicy(c *gin.Context) {
+	if !requireWorkspaceMember(c, c.Param("workspaceId")) {
+		return
+	}
+	policy, err := loadRetentionPolicy(c.Request.Context(), c.Param("workspaceId"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load retention policy"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "data": policy})
+}
+
+func putRetentionPolicy(c *gin.Context) {
+	workspaceID := c.Param("workspaceId")
+	if !requireWorkspaceAdmin(c, workspaceID) {
+		return
+	}
+	var req struct {
+		KeepLast       int `json:"keep_last"`
+		KeepWithinDays int `json:"keep_within_days"`
+		KeepDaily      int `json:"keep_daily"`
+		KeepWeekly     int `json:"keep_weekly"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.KeepLast < 0 || req.KeepWithinDays < 0 || req.KeepDaily < 0 || req.KeepWeekly < 0 {
+		c.JSON(400, gin.H{"error": "retention rules must not be negative"})
+		return
+	}
+	// A policy with no rules would prune every version; deleting the policy keeps them all
+	if req.KeepLast == 0 && req.KeepWithinDays == 0 && req.KeepDaily == 0 && req.KeepWeekly == 0 {
+		c.JSON(400, gin.H{"error": "at least one retention rule is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	_, err := retentionPoliciesCol().UpdateOne(ctx,
+		bson.M{"workspace_id": workspaceID},
+		bson.M{
+			"$set": bson.M{
+				"keep_last":        req.KeepLast,
+				"keep_within_days": req.KeepWithinDays,
+				"keep_daily":       req.KeepDaily,
+				"keep_weekly":      req.KeepWeekly,
+				"updated_by":       currentUserID(c),
+				"updated_at":       now,
+			},
+			"$setOnInsert": bson.M{"workspace_id": workspaceID, "created_at": now},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to save retention policy"})
+		return
+	}
+	policy, err := loadRetentionPolicy(ctx, workspaceID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load retention policy"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "data": policy})
+}
+
+func deleteRetentionPolicy(c *gin.Context) {
+	workspaceID := c.Param("workspaceId")
+	if !requireWorkspaceAdmin(c, workspaceID) {
+		return
+	}
+	if _, err := retentionPoliciesCol().DeleteOne(c.Request.Context(), bson.M{"workspace_id": workspaceID}); err != nil {
+		c.JSON(500, gin.H{"error": "failed to delete retention policy"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "message": "retention policy removed, all versions are kept"})
+}
+
+// pruneWorkspaceVersionsHandler applies the workspace's policy now instead of waiting
+// for the pruner
+func pruneWorkspaceVersionsHandler(c *gin.Context) {
+	workspaceID := c.Param("workspaceId")
+	if !requireWorkspaceAdmin(c, workspaceID) {
+		return
+	}
+	ctx := c.Request.Context()
+	policy, err := loadRetentionPolicy(ctx, workspaceID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load retention policy"})
+		return
+	}
+	if policy.IsDefault {
+		c.JSON(400, gin.H{"error": "workspace has no retention policy"})
+		return
+	}
+	pruned, reclaimed, err := pruneWorkspaceVersions(ctx, policy)
+	if err != nil {
+		log.WithField("workspace_id", workspaceID).Errorf("Failed to prune versions: %v", err)
+		c.JSON(500, gin.H{"error": "failed to prune versions", "versions_pruned": pruned, "bytes_reclaimed": reclaimed})
+		return
+	}
+	c.JSON(200, gin.H{"success": true, "versions_pruned": pruned, "bytes_reclaimed": reclaimed})
+}
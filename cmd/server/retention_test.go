@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRetainedVersions(t *testing.T) {
+	// Monday of ISO week 2027-W01; 2026-12-28 to 2027-01-03 is 2026-W53
+	now := time.Date(2027, 1, 4, 12, 0, 0, 0, time.UTC)
+	est := time.FixedZone("EST", -5*60*60)
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name    string
+		policy  VersionRetentionPolicy
+		created []time.Time // newest first
+		keep    []int
+	}{
+		{"no rules", VersionRetentionPolicy{}, []time.Time{ago(day), ago(2 * day)}, nil},
+		{"keep last", VersionRetentionPolicy{KeepLast: 2}, []time.Time{ago(day), ago(2 * day), ago(3 * day), ago(4 * day)}, []int{0, 1}},
+		{"keep last, fewer versions", VersionRetentionPolicy{KeepLast: 5}, []time.Time{ago(day), ago(2 * day)}, []int{0, 1}},
+		{"keep within days", VersionRetentionPolicy{KeepWithinDays: 7},
+			[]time.Time{ago(time.Hour), ago(7*day - time.Minute), ago(7 * day), ago(30 * day)}, []int{0, 1}},
+		{"keep daily across a UTC day boundary", VersionRetentionPolicy{KeepDaily: 2}, []time.Time{
+			time.Date(2027, 1, 3, 19, 30, 0, 0, est), // 2027-01-04 00:30 UTC
+			at(2027, 1, 3, 23),
+			at(2027, 1, 3, 10),
+			at(2027, 1, 2, 12),
+		}, []int{0, 1}},
+		{"keep daily skips days without versions", VersionRetentionPolicy{KeepDaily: 2}, []time.Time{
+			at(2026, 12, 1, 9), at(2026, 11, 1, 9), at(2026, 11, 1, 8),
+		}, []int{0, 1}},
+		{"keep weekly across an ISO year boundary", VersionRetentionPolicy{KeepWeekly: 2}, []time.Time{
+			at(2027, 1, 4, 10),  // 2027-W01
+			at(2027, 1, 2, 12),  // 2026-W53
+			at(2026, 12, 29, 9), // 2026-W53
+			at(2026, 12, 21, 9), // 2026-W52
+		}, []int{0, 1}},
+		{"keep weekly, calendar year differs from ISO year", VersionRetentionPolicy{KeepWeekly: 3}, []time.Time{
+			at(2027, 1, 1, 12),  // 2026-W53
+			at(2026, 12, 28, 9), // 2026-W53
+			at(2026, 12, 27, 9), // 2026-W52
+			at(2025, 12, 29, 9), // 2026-W01
+			at(2025, 12, 28, 9), // 2025-W52
+		}, []int{0, 2, 3}},
+		{"union of rules", VersionRetentionPolicy{KeepLast: 1, KeepWithinDays: 3, KeepWeekly: 3}, []time.Time{
+			at(2027, 1, 4, 9),    // last, within, 2027-W01
+			at(2027, 1, 3, 12),   // within, 2026-W53
+			at(2027, 1, 2, 12),   // within
+			at(2026, 12, 30, 12), // 2026-W53 already kept
+			at(2026, 12, 22, 12), // 2026-W52
+			at(2026, 12, 15, 12), // fourth week
+			at(2026, 12, 1, 12),
+		}, []int{0, 1, 2, 4}},
+		{"union with daily", VersionRetentionPolicy{KeepLast: 1, KeepDaily: 4, KeepWeekly: 3}, []time.Time{
+			at(2027, 1, 4, 9),
+			at(2027, 1, 3, 12),
+			at(2027, 1, 2, 12),
+			at(2026, 12, 30, 12),
+			at(2026, 12, 22, 12),
+			at(2026, 12, 15, 12),
+		}, []int{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions := make([]FileVersion, len(tt.created))
+			for i, created := range tt.created {
+				versions[i] = FileVersion{ID: primitive.NewObjectID(), VersionNum: len(tt.created) - i, CreatedAt: created}
+			}
+			kept := tt.policy.retainedVersions(versions, now)
+			var got []int
+			for i, v := range versions {
+				if kept[v.ID.Hex()] {
+					got = append(got, i)
+				}
+			}
+			sort.Ints(got)
+			if len(kept) != len(got) || !reflect.DeepEqual(got, tt.keep) {
+				t.Fatalf("kept %v, want %v", got, tt.keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every change a user makes to a file bumps File.Revision. getFile sends it as the ETag,
+// and requests that modify the file with an If-Match header only apply to that revision,
+// so two clients editing the same file get a 412 instead of overwriting each other.
+// Without If-Match the update applies to whatever revision the handler loaded.
+
+// errFileChanged means the file was modified after the request loaded it
+var errFileChanged = errors.New("file was modified concurrently")
+
+func revisionETag(revision int64) string {
+	return `"r` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// checkIfMatch writes a 412 and returns false if the request has an If-Match header that
+// doesn't name the file's current revision. Only strong validators match.
+func checkIfMatch(c *gin.Context, file *File) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+	etag := revisionETag(file.Revision)
+	for _, candidate := range strings.Split(header, ",") {
+		if candidate = strings.TrimSpace(candidate); candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	c.Header("ETag", etag)
+	c.JSON(412, gin.H{"error": "file has been modified", "revision": file.Revision})
+	return false
+}
+
+// revisionFilter adds a condition on the revision file was loaded at to filter. Files
+// stored before revisions were tracked have no revision field.
+func revisionFilter(filter bson.M, file *File) bson.M {
+	if file.Revision == 0 {
+		filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+	} else {
+		filter["revision"] = file.Revision
+	}
+	return filter
+}
+
+// updateFileRevision applies update to file if it is still at the revision it was
+// loaded at, bumping the revision, and returns errFileChanged if it isn't. file's
+// Revision is advanced to match.
+func updateFileRevision(ctx context.Context, file *File, update bson.M) error {
+	inc, _ := update["$inc"].(bson.M)
+	if inc == nil {
+		inc = bson.M{}
+		update["$inc"] = inc
+	}
+	inc["revision"] = 1
+	result, err := filesCol.UpdateOne(ctx, revisionFilter(bson.M{"_id": file.ID}, file), update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errFileChanged
+	}
+	file.Revision++
+	redisClient.Del(ctx, "file:"+file.FileID)
+	return nil
+}
+
+// respondUpdateError writes a failed update: 412 when the client's If-Match revision was
+// overtaken, 409 when the handler's own read was, and 500 otherwise
+func respondUpdateError(c *gin.Context, err error, message string) {
+	if !errors.Is(err, errFileChanged) {
+		log.Errorf("%s: %v", message, err)
+		c.JSON(500, gin.H{"error": message})
+		return
+	}
+	if c.GetHeader("If-Match") != "" {
+		c.JSON(412, gin.H{"error": "file has been modified"})
+		return
+	}
+	c.JSON(409, gin.H{"error": "file was modified by another request, retry"})
+}
+
+// allocateVersionNum atomically takes the file's next version number
+func allocateVersionNum(ctx context.Context, file *File) (int, error) {
+	// Files versioned before the counter existed continue from their highest version
+	if file.VersionCounter == 0 {
+		var latest FileVersion
+		err := versionsCol().FindOne(ctx, bson.M{"file_id": file.FileID}, options.FindOne().SetSort(bson.D{{Key: "version_num", Value: -1}})).Decode(&latest)
+		if err == nil && latest.VersionNum > 0 {
+			filesCol.UpdateOne(ctx,
+				bson.M{"file_id": file.FileID, "version_counter": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"version_counter": latest.VersionNum}})
+		}
+	}
+	var counter struct {
+		VersionCounter int `bson:"version_counter"`
+	}
+	err := filesCol.FindOneAndUpdate(ctx,
+		bson.M{"file_id": file.FileID},
+		bson.M{"$inc": bson.M{"version_counter": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"version_counter": 1}),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	file.VersionCounter = counter.VersionCounter
+	return counter.VersionCounter, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	file := &File{FileID: "f1", Revision: 7}
+	tests := []struct {
+		name    string
+		ifMatch string
+		ok      bool
+	}{
+		{"no header", "", true},
+		{"any", "*", true},
+		{"current revision", `"r7"`, true},
+		{"listed", `"r6", "r7"`, true},
+		{"stale revision", `"r6"`, false},
+		{"newer revision", `"r8"`, false},
+		{"weak", `W/"r7"`, false},
+		{"unquoted", "r7", false},
+		{"bare number", "7", false},
+		{"garbage", "not-an-etag", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("PATCH", "/api/v1/files/f1", nil)
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", tt.ifMatch)
+			}
+			if got := checkIfMatch(c, file); got != tt.ok {
+				t.Fatalf("checkIfMatch = %v, want %v", got, tt.ok)
+			}
+			if tt.ok {
+				if w.Body.Len() != 0 {
+					t.Fatalf("allowed request got a response: %s", w.Body)
+				}
+				return
+			}
+			if w.Code != 412 || w.Header().Get("ETag") != `"r7"` {
+				t.Fatalf("status %d, ETag %q", w.Code, w.Header().Get("ETag"))
+			}
+			var body struct {
+				Revision int64 `json:"revision"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Revision != 7 {
+				t.Fatalf("body %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestRespondUpdateError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		ifMatch string
+		status  int
+	}{
+		{"overtaken If-Match", errFileChanged, `"r7"`, 412},
+		{"overtaken read", errFileChanged, "", 409},
+		{"wrapped", errors.Join(errors.New("update"), errFileChanged), "", 409},
+		{"database error", errors.New("connection reset"), `"r7"`, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("PATCH", "/", nil)
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", tt.ifMatch)
+			}
+			respondUpdateError(c, tt.err, "failed to update file")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAllocateVersionNum(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer func(db *mongo.Database, files *mongo.Collection) { mongoDB, filesCol = db, files }(mongoDB, filesCol)
+
+	mt.Run("counter", func(mt *mtest.T) {
+		mongoDB, filesCol = mt.DB, mt.DB.Collection("files")
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "version_counter", Value: 4}}}))
+		file := &File{FileID: "f1", VersionCounter: 3}
+		num, err := allocateVersionNum(context.Background(), file)
+		if err != nil || num != 4 || file.VersionCounter != 4 {
+			mt.Fatalf("allocateVersionNum = %d, %v (counter %d)", num, err, file.VersionCounter)
+		}
+		started := mt.GetStartedEvent()
+		if started.CommandName != "findAndModify" {
+			mt.Fatalf("ran %s, want a single findAndModify", started.CommandName)
+		}
+		if inc := started.Command.Lookup("update", "$inc", "version_counter"); inc.AsInt64() != 1 {
+			mt.Fatalf("update %v", started.Command.Lookup("update"))
+		}
+	})
+
+	mt.Run("seeded from existing versions", func(mt *mtest.T) {
+		mongoDB, filesCol = mt.DB, mt.DB.Collection("files")
+		ns := mt.DB.Name() + ".file_versions"
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "file_id", Value: "f1"}, {Key: "version_num", Value: 9}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "version_counter", Value: 10}}}),
+		)
+		file := &File{FileID: "f1"}
+		num, err := allocateVersionNum(context.Background(), file)
+		if err != nil || num != 10 {
+			mt.Fatalf("allocateVersionNum = %d, %v", num, err)
+		}
+		mt.GetStartedEvent() // find the latest version
+		seed := mt.GetStartedEvent()
+		if seed.CommandName != "update" {
+			mt.Fatalf("ran %s, want the counter seeded", seed.CommandName)
+		}
+		stmt := seed.Command.Lookup("updates").Array().Index(0).Value().Document()
+		if stmt.Lookup("u", "$set", "version_counter").AsInt64() != 9 {
+			mt.Fatalf("seed %v", stmt)
+		}
+		// Only a file that still has no counter may be seeded
+		if _, err := stmt.LookupErr("q", "version_counter", "$exists"); err != nil {
+			mt.Fatalf("seed filter %v", stmt.Lookup("q"))
+		}
+	})
+
+	mt.Run("missing file", func(mt *mtest.T) {
+		mongoDB, filesCol = mt.DB, mt.DB.Collection("files")
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		if _, err := allocateVersionNum(context.Background(), &File{FileID: "f1", VersionCounter: 1}); !errors.Is(err, mongo.ErrNoDocuments) {
+			mt.Fatalf("err = %v, want ErrNoDocuments", err)
+		}
+	})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// Workspaces that enable sanitize_images in their upload policy get photos scrubbed
+// before they are stored: EXIF GPS data and device-identifying tags are removed,
+// XMP/IPTC/text metadata blocks are dropped, and EXIF orientation is applied to the
+// pixels. Images that need no rotation are edited in place without re-encoding;
+// rotated ones are re-encoded (JPEG and PNG keep their scrubbed EXIF, WebP loses it).
+
+// sanitizableImageTypes are the formats sanitizeImage understands
+var sanitizableImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// Tags removed from IFD0 and the Exif sub-IFD. The GPS IFD is removed entirely.
+var (
+	sanitizedIFD0Tags = map[uint16]bool{
+		0x010F: true, // Make
+		0x0110: true, // Model
+		0x0131: true, // Software
+		0x013B: true, // Artist
+		0x013C: true, // HostComputer
+		0x8825: true, // GPS IFD pointer
+	}
+	sanitizedExifTags = map[uint16]bool{
+		0x927C: true, // MakerNote
+		0xA420: true, // ImageUniqueID
+		0xA430: true, // CameraOwnerName
+		0xA431: true, // BodySerialNumber
+		0xA433: true, // LensMake
+		0xA434: true, // LensModel
+		0xA435: true, // LensSerialNumber
+	}
+)
+
+const sanitizedJPEGQuality = 92
+
+// SanitizedObject is the result of rewriting a stored image
+type SanitizedObject struct {
+	Size     int64
+	Checksum string
+}
+
+// sanitizeImage returns a copy of data with privacy-sensitive metadata removed and
+// orientation applied
+func sanitizeImage(data []byte, mimeType string) ([]byte, error) {
+	out := append([]byte(nil), data...)
+	r := bytes.NewReader(out)
+	size := int64(len(out))
+
+	var loc exifLocation
+	switch mimeType {
+	case "image/jpeg":
+		loc = findJPEGExif(r, size)
+	case "image/png":
+		loc = findPNGExif(r, size)
+	case "image/webp":
+		loc = findWebPExif(r, size)
+	default:
+		return nil, errors.New("unsupported image type " + mimeType)
+	}
+
+	orientation := 1
+	var exif []byte
+	if loc.length > 0 && loc.offset+loc.length <= size {
+		payload := out[loc.offset : loc.offset+loc.length]
+		tiff := payload
+		if bytes.HasPrefix(tiff, []byte("Exif\x00\x00")) {
+			tiff = tiff[6:]
+		}
+		orientation = scrubTIFF(tiff)
+		exif = tiff
+		if mimeType == "image/png" {
+			// The chunk CRC covers the payload we just edited
+			if loc.offset+loc.length+4 > size {
+				return nil, errors.New("truncated PNG chunk")
+			}
+			binary.BigEndian.PutUint32(out[loc.offset+loc.length:], crc32.ChecksumIEEE(out[loc.offset-4:loc.offset+loc.length]))
+		}
+	}
+
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		out, err = dropJPEGMetadata(out)
+	case "image/png":
+		out, err = dropPNGMetadata(out)
+	case "image/webp":
+		out, err = dropWebPMetadata(out)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if orientation > 1 && orientation <= 8 {
+		return reorientImage(out, mimeType, orientation, exif)
+	}
+	return out, nil
+}
+
+// sanitizeStoredObject rewrites a stored image with sanitizeImage. The object is only
+// replaced when sanitizing changed it.
+func sanitizeStoredObject(ctx context.Context, key, mimeType string) (*SanitizedObject, error) {
+	body, err := blobStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	sanitized, err := sanitizeImage(data, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sanitized, data) {
+		if err := blobStore.Put(ctx, key, bytes.NewReader(sanitized), int64(len(sanitized)), mimeType); err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(sanitized)
+	return &SanitizedObject{Size: int64(len(sanitized)), Checksum: hex.EncodeToString(sum[:])}, nil
+}
+
+// ── EXIF ──
+
+// scrubTIFF removes sensitive tags from an EXIF TIFF structure in place, resets the
+// orientation tag to 1 and returns the orientation it had
+func scrubTIFF(b []byte) int {
+	if len(b) < 8 {
+		return 1
+	}
+	t := &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd0 := t.order.Uint32(b[4:8])
+	entries := t.ifd(ifd0)
+
+	orientation := 1
+	if v, ok := t.uint(entries[0x0112]); ok && v >= 1 && v <= 8 {
+		orientation = int(v)
+		if e := entries[0x0112]; e.typ == 3 {
+			t.order.PutUint16(e.value, 1)
+		}
+	}
+	if ptr, ok := t.uint(entries[0x8825]); ok {
+		t.clearIFD(ptr, nil)
+	}
+	if ptr, ok := t.uint(entries[0x8769]); ok {
+		t.clearIFD(ptr, sanitizedExifTags)
+	}
+	t.clearIFD(ifd0, sanitizedIFD0Tags)
+	return orientation
+}
+
+// clearIFD removes the entries of the IFD at offset whose tags are in drop (all of them
+// when drop is nil), compacting the entry table and zeroing their out-of-line values
+func (t *tiffReader) clearIFD(offset uint32, drop map[uint16]bool) {
+	start := int(offset)
+	if start+2 > len(t.b) {
+		return
+	}
+	n := int(t.order.Uint16(t.b[start:]))
+	end := start + 2 + n*12 + 4
+	if end > len(t.b) {
+		return
+	}
+	next := t.order.Uint32(t.b[end-4:])
+
+	kept := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		e := append([]byte(nil), t.b[start+2+i*12:start+2+(i+1)*12]...)
+		tag, typ, count := t.order.Uint16(e[0:2]), t.order.Uint16(e[2:4]), t.order.Uint32(e[4:8])
+		if drop != nil && !drop[tag] {
+			kept = append(kept, e)
+			continue
+		}
+		if size := int64(tiffTypeSizes[typ]) * int64(count); size > 4 {
+			if at := int64(t.order.Uint32(e[8:12])); at+size <= int64(len(t.b)) {
+				clear(t.b[at : at+size])
+			}
+		}
+	}
+
+	// Nested sub-IFDs of a fully cleared IFD are left unreferenced; that is fine
+	// since the only one we clear fully is GPS, which has none
+	pos := start
+	t.order.PutUint16(t.b[pos:], uint16(len(kept)))
+	pos += 2
+	for _, e := range kept {
+		copy(t.b[pos:], e)
+		pos += 12
+	}
+	t.order.PutUint32(t.b[pos:], next)
+	clear(t.b[pos+4 : end])
+}
+
+// ── Container metadata blocks ──
+
+// dropJPEGMetadata removes XMP (APP1) and Photoshop/IPTC (APP13) segments and comments
+func dropJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	off := 2
+	for off+4 <= len(data) {
+		if data[off] != 0xFF {
+			return nil, errors.New("corrupt JPEG segment")
+		}
+		marker := data[off+1]
+		if marker == 0xDA { // start of scan: the rest is image data
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(data[off+2 : off+4]))
+		if segLen < 2 {
+			return nil, errors.New("corrupt JPEG segment")
+		}
+		end := off + 2 + segLen
+		if end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment := data[off:end]
+		drop := marker == 0xED || marker == 0xFE ||
+			(marker == 0xE1 && !bytes.HasPrefix(segment[4:], []byte("Exif\x00\x00")))
+		if !drop {
+			out = append(out, segment...)
+		}
+		off = end
+	}
+	return append(out, data[off:]...), nil
+}
+
+// dropPNGMetadata removes textual chunks, which carry XMP and free-form metadata
+func dropPNGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 8 || string(data[:8]) != "\x89PNG\r\n\x1a\n" {
+		return nil, errors.New("not a PNG")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:8]...)
+	for off := 8; off < len(data); {
+		if off+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		end := off + 12 + int(binary.BigEndian.Uint32(data[off:off+4]))
+		if end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		switch string(data[off+4 : off+8]) {
+		case "tEXt", "zTXt", "iTXt":
+		default:
+			out = append(out, data[off:end]...)
+		}
+		off = end
+	}
+	return out, nil
+}
+
+// dropWebPMetadata removes the XMP chunk and fixes up the RIFF size and VP8X flags
+func dropWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	for off := 12; off < len(data); {
+		if off+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		length := int(binary.LittleEndian.Uint32(data[off+4 : off+8]))
+		end := off + 8 + length + length%2
+		if end > len(data) {
+			end = len(data)
+		}
+		if string(data[off:off+4]) != "XMP " {
+			out = append(out, data[off:end]...)
+		}
+		off = end
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	if len(out) >= 21 && string(out[12:16]) == "VP8X" {
+		out[20] &^= 0x04 // XMP metadata present
+	}
+	return out, nil
+}
+
+// ── Orientation ──
+
+// reorientImage decodes data, applies the EXIF orientation and re-encodes it,
+// re-attaching the scrubbed EXIF block for JPEG and PNG
+func reorientImage(data []byte, mimeType string, orientation int, exif []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := applyOrientation(src, orientation)
+
+	var buf bytes.Buffer
+	switch mimeType {
+	case "image/jpeg":
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: sanitizedJPEGQuality}); err != nil {
+			return nil, err
+		}
+		if len(exif) > 0 && len(exif)+8 <= 0xFFFF {
+			segment := make([]byte, 0, len(exif)+10)
+			segment = append(segment, 0xFF, 0xE1)
+			segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+8))
+			segment = append(segment, "Exif\x00\x00"...)
+			segment = append(segment, exif...)
+			encoded := buf.Bytes()
+			return append(append(append([]byte(nil), encoded[:2]...), segment...), encoded[2:]...), nil
+		}
+	case "image/png":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		if len(exif) > 0 {
+			// eXIf goes right after IHDR (8-byte signature + 25-byte IHDR chunk)
+			chunk := binary.BigEndian.AppendUint32(nil, uint32(len(exif)))
+			chunk = append(chunk, "eXIf"...)
+			chunk = append(chunk, exif...)
+			chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+			encoded := buf.Bytes()
+			return append(append(append([]byte(nil), encoded[:33]...), chunk...), encoded[33:]...), nil
+		}
+	case "image/webp":
+		if err := nativewebp.Encode(&buf, img, nil); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// applyOrientation transforms src so it displays upright without the EXIF tag
+func applyOrientation(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			si := y*rgba.Stride + x*4
+			di := dy*dst.Stride + dx*4
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// sampleTIFF is a little-endian EXIF block with Make = "ACME" and the given orientation
+func sampleTIFF(orientation uint16) []byte {
+	b := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0,
+		2, 0,
+		0x0F, 0x01, 2, 0, 4, 0, 0, 0, 'A', 'C', 'M', 'E', // Make
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 0, 0, 0, 0, // Orientation
+		0, 0, 0, 0,
+	}
+	binary.LittleEndian.PutUint16(b[30:], orientation)
+	return b
+}
+
+func sampleImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	return img
+}
+
+func sampleSanitizeJPEG(t testing.TB, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, sampleImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	app1 := append([]byte("Exif\x00\x00"), sampleTIFF(orientation)...)
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(app1)+2))
+	segment = append(segment, app1...)
+	comment := []byte{0xFF, 0xFE, 0, 6, 'h', 'i', '!', '!'}
+	return append(append(append(append([]byte(nil), encoded[:2]...), segment...), comment...), encoded[2:]...)
+}
+
+func sampleSanitizePNG(t testing.TB, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, sampleImage()); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	tiff := sampleTIFF(orientation)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+	chunk = append(chunk, "eXIf"...)
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	return append(append(append([]byte(nil), encoded[:33]...), chunk...), encoded[33:]...)
+}
+
+func sampleSanitizeWebP(t testing.TB, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, sampleImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	tiff := sampleTIFF(orientation)
+	chunk := binary.LittleEndian.AppendUint32([]byte("EXIF"), uint32(len(tiff)))
+	chunk = append(chunk, tiff...)
+	out = append(out, chunk...)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
+
+func TestSanitizeImage(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		sample   func(testing.TB, uint16) []byte
+	}{
+		{"image/jpeg", sampleSanitizeJPEG},
+		{"image/png", sampleSanitizePNG},
+		{"image/webp", sampleSanitizeWebP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mimeType, func(t *testing.T) {
+			out, err := sanitizeImage(tt.sample(t, 1), tt.mimeType)
+			if err != nil {
+				t.Fatalf("sanitize: %v", err)
+			}
+			if bytes.Contains(out, []byte("ACME")) {
+				t.Fatal("camera make survived sanitizing")
+			}
+			if bytes.Contains(out, []byte("hi!!")) {
+				t.Fatal("comment survived sanitizing")
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+			if err != nil || cfg.Width != 4 || cfg.Height != 2 {
+				t.Fatalf("sanitized image %+v, %v", cfg, err)
+			}
+
+			// Rotated 90° clockwise: the 4x2 image becomes 2x4
+			out, err = sanitizeImage(tt.sample(t, 6), tt.mimeType)
+			if err != nil {
+				t.Fatalf("sanitize rotated: %v", err)
+			}
+			cfg, _, err = image.DecodeConfig(bytes.NewReader(out))
+			if err != nil || cfg.Width != 2 || cfg.Height != 4 {
+				t.Fatalf("reoriented image %+v, %v", cfg, err)
+			}
+		})
+	}
+}
+
+func TestSanitizeImageMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		data     []byte
+	}{
+		{"png eXIf chunk without CRC", "image/png", append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x08eXIf"), "II*\x00\x08\x00\x00\x00"...)},
+		{"jpeg APP1 length below 2", "image/jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xD9}},
+		{"jpeg APP1 length zero", "image/jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00, 0xFF, 0xD9}},
+		{"jpeg no segments", "image/jpeg", []byte{0xFF, 0xD8}},
+		{"png signature only", "image/png", []byte("\x89PNG\r\n\x1a\n")},
+		{"webp header only", "image/webp", []byte("RIFF\x04\x00\x00\x00WEBP")},
+		{"webp chunk past end", "image/webp", []byte("RIFF\x10\x00\x00\x00WEBPEXIF\xFF\xFF\xFF\xFFII*\x00")},
+		{"empty", "image/jpeg", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sanitizeImage(tt.data, tt.mimeType)
+		})
+	}
+}
+
+// TestSanitizeImageMutated sanitizes every truncation of each sample, and copies of the
+// unrotated samples with single bytes corrupted
+func TestSanitizeImageMutated(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		sample   func(testing.TB, uint16) []byte
+	}{
+		{"image/jpeg", sampleSanitizeJPEG},
+		{"image/png", sampleSanitizePNG},
+		{"image/webp", sampleSanitizeWebP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mimeType, func(t *testing.T) {
+			for _, orientation := range []uint16{1, 6} {
+				data := tt.sample(t, orientation)
+				for n := 0; n < len(data); n++ {
+					sanitizeImage(data[:n], tt.mimeType)
+				}
+			}
+			data := tt.sample(t, 1)
+			for i := range data {
+				for _, v := range []byte{0x00, 0x01, 0xFF} {
+					corrupt := bytes.Clone(data)
+					corrupt[i] = v
+					sanitizeImage(corrupt, tt.mimeType)
+				}
+			}
+		})
+	}
+}
+
+func FuzzSanitizeImage(f *testing.F) {
+	for _, orientation := range []uint16{1, 6} {
+		f.Add(sampleSanitizeJPEG(f, orientation), "image/jpeg")
+		f.Add(sampleSanitizePNG(f, orientation), "image/png")
+		f.Add(sampleSanitizeWebP(f, orientation), "image/webp")
+	}
+	f.Fuzz(func(t *testing.T, data []byte, mimeType string) {
+		if !sanitizableImageTypes[mimeType] {
+			return
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err == nil && cfg.Width*cfg.Height > 1<<20 {
+			return // keep reorienting cheap
+		}
+		sanitizeImage(data, mimeType)
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Uploads are scanned by a worker consuming file.uploaded events, and on demand through
+// POST /:id/scan. Objects are streamed to clamd with the INSTREAM command; infected files
+// are quarantined and can no longer be downloaded. Scans that failed (e.g. clamd was
+// down) or never finished are retried periodically until they get a verdict.
+//
+//	CLAMD_ADDRESS  host:port, tcp://host:port or unix:///path/to/clamd.sock; unset disables scanning
+//	CLAMD_TIMEOUT  per-scan deadline (default 2m)
+
+const (
+	scannerConsumerGroup = "file-service-scanner"
+	// clamd rejects INSTREAM chunks larger than its StreamMaxLength; 64KB is well below any setting
+	clamdChunkSize = 64 << 10
+
+	scanRetryInterval = 5 * time.Minute
+	// Pending scans older than this are assumed lost (longer than an on-demand scan may run)
+	scanRetryAfter = 15 * time.Minute
+	scanRetryBatch = 100
+)
+
+// Scanner checks content for malware
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanVerdict, error)
+	Name() string
+}
+
+type ScanVerdict struct {
+	Infected bool
+	Findings []string
+}
+
+// fileScanner is nil when no scanner is configured
+var fileScanner Scanner
+
+func initScanner() {
+	addr := getEnv("CLAMD_ADDRESS", "")
+	if addr == "" {
+		log.Warn("CLAMD_ADDRESS not set, antivirus scanning is disabled")
+		return
+	}
+	timeout, err := time.ParseDuration(getEnv("CLAMD_TIMEOUT", "2m"))
+	if err != nil || timeout <= 0 {
+		log.Warnf("Invalid CLAMD_TIMEOUT, using 2m")
+		timeout = 2 * time.Minute
+	}
+	network, address := parseClamdAddress(addr)
+	fileScanner = &clamdScanner{network: network, address: address, timeout: timeout}
+	log.Infof("Antivirus scanning via clamd at %s://%s", network, address)
+}
+
+func parseClamdAddress(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// clamdScanner speaks the clamd INSTREAM protocol: the command is followed by chunks
+// each prefixed with a 4-byte big-endian length, terminated by a zero-length chunk
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+func (s *clamdScanner) Name() string { return "clamd" }
+
+func (s *clamdScanner) Scan(ctx context.Context, r io.Reader) (*ScanVerdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	// The z prefix selects NUL-terminated commands and replies
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("send INSTREAM: %w", err)
+	}
+
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	buf := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			if _, err := w.Write(buf[:n]); err != nil {
+				// clamd closes the connection once StreamMaxLength is exceeded; its reply says so
+				break
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			binary.BigEndian.PutUint32(size[:], 0)
+			w.Write(size[:])
+			break
+		}
+		if rerr != nil {
+			return nil, fmt.Errorf("read object: %w", rerr)
+		}
+	}
+	if err := w.Flush(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Debugf("clamd stream ended early: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return nil, fmt.Errorf("read clamd reply: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets "stream: OK", "stream: <signature> FOUND" and "<message> ERROR"
+func parseClamdReply(reply string) (*ScanVerdict, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return &ScanVerdict{Infected: true, Findings: []string{signature}}, nil
+	case strings.HasSuffix(reply, "OK"):
+		return &ScanVerdict{Findings: []string{}}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return nil, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+	return nil, fmt.Errorf("unexpected clamd reply %q", reply)
+}
+
+func runScanWorker(ctx context.Context) {
+	if fileScanner == nil {
+		return
+	}
+	runEventConsumer(ctx, scannerConsumerGroup, []string{"file.uploaded", "file.version_created"}, handleScanEvent)
+}
+
+// runScanRetrier rescans files whose latest scan failed or never completed
+func runScanRetrier(ctx context.Context) {
+	if fileScanner == nil {
+		return
+	}
+	ticker := time.NewTicker(scanRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			retryFailedScans(ctx)
+		}
+	}
+}
+
+func retryFailedScans(ctx context.Context) {
+	cursor, err := scansCol().Find(ctx, bson.M{
+		"scan_type": "antivirus",
+		"$or": []bson.M{
+			{"status": "error"},
+			{"status": "pending", "scanned_at": bson.M{"$lt": time.Now().Add(-scanRetryAfter)}},
+		},
+	}, options.Find().SetSort(bson.D{{Key: "scanned_at", Value: 1}}).SetLimit(scanRetryBatch))
+	if err != nil {
+		log.Errorf("Scan retrier failed to list scans: %v", err)
+		return
+	}
+	var scans []FileScanResult
+	if err := cursor.All(ctx, &scans); err != nil {
+		log.Errorf("Scan retrier failed to list scans: %v", err)
+		return
+	}
+	for i := range scans {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := retryScan(ctx, &scans[i]); err != nil {
+			log.WithField("file_id", scans[i].FileID).Warnf("Scan retry failed: %v", err)
+		}
+	}
+}
+
+// retryScan rescans the file of a failed scan into the same record. Records that are no
+// longer the file's latest scan, or whose file was deleted, are closed without scanning.
+func retryScan(ctx context.Context, scan *FileScanResult) error {
+	newer, err := scansCol().CountDocuments(ctx, bson.M{"file_id": scan.FileID, "_id": bson.M{"$ne": scan.ID}, "scanned_at": bson.M{"$gt": scan.ScannedAt}})
+	if err != nil {
+		return err
+	}
+	var file File
+	err = filesCol.FindOne(ctx, bson.M{"file_id": scan.FileID, "deleted_at": nil}).Decode(&file)
+	if newer > 0 || errors.Is(err, mongo.ErrNoDocuments) {
+		_, err := scansCol().UpdateOne(ctx, bson.M{"_id": scan.ID}, bson.M{"$set": bson.M{"status": "superseded"}})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// Claim the record so another replica's retrier leaves it alone
+	result, err := scansCol().UpdateOne(ctx,
+		bson.M{"_id": scan.ID, "status": scan.Status, "scanned_at": scan.ScannedAt},
+		bson.M{"$set": bson.M{"status": "pending", "scanned_at": time.Now()}})
+	if err != nil || result.ModifiedCount == 0 {
+		return err
+	}
+	return scanFile(ctx, &file, scan)
+}
+
+func handleScanEvent(ctx context.Context, event FileEvent) error {
+	var file File
+	err := filesCol.FindOne(ctx, bson.M{"file_id": event.FileID, "deleted_at": nil}).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scan, err := newPendingScan(ctx, file.FileID)
+	if err != nil {
+		return err
+	}
+	return scanFile(ctx, &file, scan)
+}
+
+func newPendingScan(ctx context.Context, fileID string) (*FileScanResult, error) {
+	scan := &FileScanResult{
+		FileID: fileID, ScanType: "antivirus", Status: "pending", Findings: []string{}, ScannedAt: time.Now(),
+	}
+	result, err := scansCol().InsertOne(ctx, scan)
+	if err != nil {
+		return nil, err
+	}
+	scan.ID = result.InsertedID.(primitive.ObjectID)
+	return scan, nil
+}
+
+// scanFile streams the file's object through the scanner and completes the pending scan
+// record as clean, infected or error. Infected files are quarantined.
+func scanFile(ctx context.Context, file *File, scan *FileScanResult) error {
+	verdict, err := scanObject(ctx, file.StorageKey)
+	if err != nil {
+		scan.Status = "error"
+		scan.Findings = []string{err.Error()}
+	} else if verdict.Infected {
+		scan.Status = "infected"
+		scan.Findings = verdict.Findings
+	} else {
+		scan.Status = "clean"
+		scan.Findings = verdict.Findings
+	}
+	scan.ScannedAt = time.Now()
+
+	_, uerr := scansCol().UpdateOne(ctx, bson.M{"_id": scan.ID}, bson.M{"$set": bson.M{
+		"status":     scan.Status,
+		"findings":   scan.Findings,
+		"scanned_at": scan.ScannedAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if uerr != nil {
+		return uerr
+	}
+
+	if verdict.Infected {
+		log.WithField("file_id", file.FileID).Warnf("Malware detected: %s", strings.Join(verdict.Findings, ", "))
+		return quarantineFile(ctx, file, "malware detected: "+strings.Join(verdict.Findings, ", "), fileScanner.Name())
+	}
+	return nil
+}
+
+func scanObject(ctx context.Context, key string) (*ScanVerdict, error) {
+	if fileScanner == nil {
+		return nil, errors.New("antivirus scanning is not configured")
+	}
+	body, err := blobStore.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("read object: %w", err)
+	}
+	defer body.Close()
+	return fileScanner.Scan(ctx, body)
+}
+
+// scanFileAsync runs an on-demand scan outside the request; the scan record is
+// completed when it finishes
+func scanFileAsync(file File, scan FileScanResult) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if err := scanFile(ctx, &file, &scan); err != nil {
+			log.WithField("file_id", file.FileID).Errorf("Scan failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts one INSTREAM session, checks its framing and answers with reply. The
+// streamed content is sent on the returned channel.
+func fakeClamd(t *testing.T, reply string) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		cmd, err := r.ReadString(0)
+		if err != nil || cmd != "zINSTREAM\x00" {
+			t.Errorf("unexpected command %q (%v)", cmd, err)
+			return
+		}
+		var content bytes.Buffer
+		var size [4]byte
+		for {
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				t.Errorf("read chunk size: %v", err)
+				return
+			}
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			if n > clamdChunkSize {
+				t.Errorf("chunk of %d bytes exceeds %d", n, clamdChunkSize)
+			}
+			if _, err := io.CopyN(&content, r, int64(n)); err != nil {
+				t.Errorf("read chunk: %v", err)
+				return
+			}
+		}
+		received <- content.Bytes()
+		conn.Write([]byte(reply + "\x00"))
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestClamdScannerInstream(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), clamdChunkSize/8+3) // a little over two chunks
+	tests := []struct {
+		name     string
+		reply    string
+		content  []byte
+		infected bool
+		findings []string
+	}{
+		{"clean", "stream: OK", content, false, []string{}},
+		{"infected", "stream: Eicar-Test-Signature FOUND", content, true, []string{"Eicar-Test-Signature"}},
+		{"empty", "stream: OK", nil, false, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := fakeClamd(t, tt.reply)
+			scanner := &clamdScanner{network: "tcp", address: addr, timeout: 5 * time.Second}
+			verdict, err := scanner.Scan(context.Background(), bytes.NewReader(tt.content))
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if got := <-received; !bytes.Equal(got, tt.content) {
+				t.Fatalf("clamd received %d bytes, want %d", len(got), len(tt.content))
+			}
+			if verdict.Infected != tt.infected || len(verdict.Findings) != len(tt.findings) {
+				t.Fatalf("verdict %+v", verdict)
+			}
+			for i := range tt.findings {
+				if verdict.Findings[i] != tt.findings[i] {
+					t.Fatalf("findings %v, want %v", verdict.Findings, tt.findings)
+				}
+			}
+		})
+	}
+}
+
+func TestClamdScannerUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	scanner := &clamdScanner{network: "tcp", address: addr, timeout: time.Second}
+	if _, err := scanner.Scan(context.Background(), bytes.NewReader([]byte("data"))); err == nil {
+		t.Fatal("expected an error when clamd is unreachable")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply    string
+		infected bool
+		finding  string
+		wantErr  bool
+	}{
+		{"stream: OK", false, "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", true, "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR", false, "", true},
+		{"", false, "", true},
+		{"garbage", false, "", true},
+	}
+	for _, tt := range tests {
+		verdict, err := parseClamdReply(tt.reply)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if verdict.Infected != tt.infected || (tt.infected && verdict.Findings[0] != tt.finding) {
+			t.Errorf("%q: verdict %+v", tt.reply, verdict)
+		}
+	}
+}
+
+func TestParseClamdAddress(t *testing.T) {
+	tests := []struct{ addr, network, address string }{
+		{"localhost:3310", "tcp", "localhost:3310"},
+		{"tcp://clamd:3310", "tcp", "clamd:3310"},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock"},
+		{"unix:/run/clamd.sock", "unix", "/run/clamd.sock"},
+		{"/run/clamd.sock", "unix", "/run/clamd.sock"},
+	}
+	for _, tt := range tests {
+		if network, address := parseClamdAddress(tt.addr); network != tt.network || address != tt.address {
+			t.Errorf("parseClamdAddress(%q) = %s, %s", tt.addr, network, address)
+		}
+	}
+}
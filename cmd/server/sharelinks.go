@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share links are opened without an account, so the public endpoint is the one place
+// where tokens and link passwords can be guessed. Failed attempts are counted per client
+// IP in Redis and the IP is locked out for the rest of the window once it has too many.
+//
+//	SHARE_LINK_DEFAULT_TTL    expiry for links created without expires_at (default 168h)
+//	SHARE_LINK_MAX_FAILURES   failed attempts allowed per IP per window (default 10)
+//	SHARE_LINK_FAILURE_WINDOW length of the throttling window (default 15m)
+const (
+	shareTokenBytes       = 24
+	shareDownloadURLTTL   = 5 * time.Minute
+	maxSharePasswordBytes = 72 // bcrypt ignores anything longer
+	sharePasswordHeader   = "X-Share-Password"
+)
+
+// sharedFileView is what an anonymous recipient learns about a shared file
+type sharedFileView struct {
+	FileID         string        `json:"file_id"`
+	Name           string        `json:"name"`
+	MimeType       string        `json:"mime_type"`
+	Size           int64         `json:"size"`
+	FileType       string        `json:"file_type"`
+	Metadata       *FileMetadata `json:"metadata,omitempty"`
+	DownloadURL    string        `json:"download_url"`
+	URLExpiresAt   time.Time     `json:"url_expires_at"`
+	LinkExpiresAt  *time.Time    `json:"link_expires_at,omitempty"`
+	ViewsRemaining *int          `json:"views_remaining,omitempty"`
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSharePassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword reports whether password opens the link. Links created before passwords
+// were hashed still hold the plain text in Password.
+func (l *FileLink) checkPassword(password string) bool {
+	if l.PasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(l.Password), []byte(password)) == 1
+}
+
+func (l *FileLink) hasPassword() bool {
+	return l.PasswordHash != "" || l.Password != ""
+}
+
+func (l *FileLink) expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !l.ExpiresAt.After(now)
+}
+
+func defaultShareLinkTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("SHARE_LINK_DEFAULT_TTL", "168h"))
+	if err != nil || ttl <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return ttl
+}
+
+func registerShareRoutes(r *gin.Engine) {
+	r.GET("/s/:token", streamSharedFile)
+	r.HEAD("/s/:token", streamSharedFile)
+	r.POST("/s/:token", streamSharedFile)
+}
+
+// openShareLink resolves the link in the token path parameter and checks its expiry,
+// password and view limit, counting a view if countView is set. On failure it writes
+// the response and returns false.
+func openShareLink(c *gin.Context, countView bool) (*FileLink, *File, bool) {
+	ctx := c.Request.Context()
+	if shareThrottled(c) {
+		return nil, nil, false
+	}
+	var link FileLink
+	if err := linksCol().FindOne(ctx, bson.M{"token": c.Param("token"), "is_active": true}).Decode(&link); err != nil {
+		recordShareFailure(ctx, c.ClientIP())
+		c.JSON(404, gin.H{"error": "link not found or expired"})
+		return nil, nil, false
+	}
+	if link.expired(time.Now()) || (link.MaxViews > 0 && link.Views >= link.MaxViews) {
+		c.JSON(410, gin.H{"error": "link has expired or reached its view limit"})
+		return nil, nil, false
+	}
+	if link.hasPassword() {
+		password := c.GetHeader(sharePasswordHeader)
+		if password == "" && c.Request.Method == http.MethodPost {
+			// JSON from API clients, a form post from the landing page
+			var req struct {
+				Password string `json:"password" form:"password"`
+			}
+			c.ShouldBind(&req)
+			password = req.Password
+		}
+		if password == "" {
+			c.JSON(401, gin.H{"error": "password required", "password_required": true})
+			return nil, nil, false
+		}
+		if !link.checkPassword(password) {
+			recordShareFailure(ctx, c.ClientIP())
+			c.JSON(401, gin.H{"error": "incorrect password", "password_required": true})
+			return nil, nil, false
+		}
+	}
+
+	var file File
+	if err := filesCol.FindOne(ctx, bson.M{"file_id": link.FileID, "deleted_at": nil}).Decode(&file); err != nil {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return nil, nil, false
+	}
+	if rejectQuarantined(c, &file) {
+		return nil, nil, false
+	}
+	if countView {
+		ok, err := claimShareView(ctx, &link)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "failed to open link"})
+			return nil, nil, false
+		}
+		if !ok {
+			c.JSON(410, gin.H{"error": "link has expired or reached its view limit"})
+			return nil, nil, false
+		}
+	}
+	return &link, &file, true
+}
+
+// streamSharedFile serves a shared file's content to recipients without an account.
+// ?inline=1 renders it in the browser for previews. Every GET or POST counts as a view,
+// so range requests from media players each use one up; HEAD does not.
+func streamSharedFile(c *gin.Context) {
+	countView := c.Request.Method != http.MethodHead
+	link, file, ok := openShareLink(c, countView)
+	if !ok {
+		return
+	}
+	status := serveFileContent(c, file, c.Query("inline") == "1")
+	if countView && (status == 200 || status == 206) {
+		recordDownload(c, file.FileID, downloadChannelShareLink, &link.ID)
+	}
+}
+
+// ── Throttling ──
+
+func shareFailureKey(ip string) string {
+	return "share_link_failures:" + ip
+}
+
+func shareFailureLimit() (int64, time.Duration) {
+	limit, err := strconv.ParseInt(getEnv("SHARE_LINK_MAX_FAILURES", "10"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	window, err := time.ParseDuration(getEnv("SHARE_LINK_FAILURE_WINDOW", "15m"))
+	if err != nil || window <= 0 {
+		window = 15 * time.Minute
+	}
+	return limit, window
+}
+
+// shareThrottled writes a 429 and returns true if the client IP has used up its failed
+// attempts. Redis being unavailable does not lock recipients out.
+func shareThrottled(c *gin.Context) bool {
+	limit, window := shareFailureLimit()
+	key := shareFailureKey(c.ClientIP())
+	failures, err := redisClient.Get(c.Request.Context(), key).Int64()
+	if err != nil || failures < limit {
+		return false
+	}
+	retry := window
+	if ttl, err := redisClient.TTL(c.Request.Context(), key).Result(); err == nil && ttl > 0 {
+		retry = ttl
+	}
+	c.Header("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+	c.JSON(429, gin.H{"error": "too many failed attempts, try again later"})
+	return true
+}
+
+// recordShareFailure counts a bad token or password against the client IP
+func recordShareFailure(ctx context.Context, ip string) {
+	_, window := shareFailureLimit()
+	key := shareFailureKey(ip)
+	n, err := redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		log.Warnf("Failed to record share link failure: %v", err)
+		return
+	}
+	if n == 1 {
+		redisClient.Expire(ctx, key, window)
+	}
+}
+
+// ── Views ──
+
+// claimShareView atomically counts a view against the link, returning false if the
+// link has expired, been revoked or used up its views in the meantime
+func claimShareView(ctx context.Context, link *FileLink) (bool, error) {
+	now := time.Now()
+	result, err := linksCol().UpdateOne(ctx, bson.M{
+		"_id":       link.ID,
+		"is_active": true,
+		"$and": []bson.M{
+			{"$or": []bson.M{{"expires_at": nil}, {"expires_at": bson.M{"$gt": now}}}},
+			{"$or": []bson.M{{"max_views": bson.M{"$lte": 0}}, {"$expr": bson.M{"$lt": bson.A{"$views", "$max_views"}}}}},
+		},
+	}, bson.M{"$inc": bson.M{"views": 1}})
+	if err != nil {
+		return false, err
+	}
+	if result.ModifiedCount == 0 {
+		return false, nil
+	}
+	link.Views++
+	return true, nil
+}
+
+func newSharedFileView(ctx context.Context, link *FileLink, file *File) (*sharedFileView, error) {
+	downloadURL, err := fileDownloadURL(ctx, file, false, shareDownloadURLTTL)
+	if err != nil {
+		return nil, err
+	}
+	view := &sharedFileView{
+		FileID:        file.FileID,
+		Name:          file.OriginalName,
+		MimeType:      file.MimeType,
+		Size:          file.Size,
+		FileType:      file.FileType,
+		DownloadURL:   downloadURL,
+		URLExpiresAt:  time.Now().Add(shareDownloadURLTTL),
+		LinkExpiresAt: link.ExpiresAt,
+	}
+	// Dimensions and duration only; location and device details stay private
+	if m := file.Metadata; m.Width != nil || m.Height != nil || m.Duration != nil || m.Pages != nil {
+		view.Metadata = &FileMetadata{Width: m.Width, Height: m.Height, Duration: m.Duration, Pages: m.Pages}
+	}
+	if link.MaxViews > 0 {
+		remaining := link.MaxViews - link.Views
+		view.ViewsRemaining = &remaining
+	}
+	return view, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The local backend has no presigning of its own, so the service signs its URLs with
+// HMAC-SHA256 and validates them when they come back. Each signature names the key it
+// was made with, so keys can be rotated by adding a new one in front and dropping the
+// old one once the URLs it signed have expired.
+//
+//	STORAGE_SIGNING_KEYS    comma-separated kid:secret pairs; the first signs, all verify
+//	STORAGE_SIGNING_SECRET  single secret used as kid "default" when no keys are listed
+const defaultSigningKeyID = "default"
+
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+type urlSigner struct {
+	keys []signingKey
+}
+
+// downloadSigner signs /d/:fileId download URLs; it is nil when S3 presigns downloads
+var downloadSigner *urlSigner
+
+func loadURLSigner() *urlSigner {
+	s := &urlSigner{}
+	for _, pair := range strings.Split(getEnv("STORAGE_SIGNING_KEYS", ""), ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			if pair != "" {
+				log.Warnf("Ignoring malformed STORAGE_SIGNING_KEYS entry")
+			}
+			continue
+		}
+		s.keys = append(s.keys, signingKey{id: id, secret: []byte(secret)})
+	}
+	if len(s.keys) == 0 {
+		secret := []byte(getEnv("STORAGE_SIGNING_SECRET", ""))
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			rand.Read(secret)
+			log.Warn("No URL signing key configured, using a random secret (signed URLs will not survive restarts)")
+		}
+		s.keys = []signingKey{{id: defaultSigningKeyID, secret: secret}}
+	}
+	return s
+}
+
+func (s *urlSigner) mac(key signingKey, parts []string) string {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(key.id))
+	for _, part := range parts {
+		mac.Write([]byte{'\n'})
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign signs parts with the current key, returning its ID and the signature
+func (s *urlSigner) sign(parts ...string) (kid, signature string) {
+	key := s.keys[0]
+	return key.id, s.mac(key, parts)
+}
+
+// verify checks a signature made with any active key
+func (s *urlSigner) verify(kid, signature string, parts ...string) bool {
+	for _, key := range s.keys {
+		if key.id == kid {
+			return hmac.Equal([]byte(s.mac(key, parts)), []byte(signature))
+		}
+	}
+	return false
+}
+
+// signedQuery builds the query string of a signed URL. The expiry and every value in
+// params are covered by the signature, along with scope, which ties it to one resource.
+func (s *urlSigner) signedQuery(scope string, params url.Values, expires time.Duration) url.Values {
+	q := url.Values{}
+	for name, values := range params {
+		q[name] = values
+	}
+	q.Set("expires", strconv.FormatInt(time.Now().Add(expires).Unix(), 10))
+	kid, sig := s.sign(scope, q.Encode())
+	q.Set("kid", kid)
+	q.Set("signature", sig)
+	return q
+}
+
+// verifyQuery checks a URL signed by signedQuery for the same scope and that it hasn't expired
+func (s *urlSigner) verifyQuery(scope string, query url.Values) bool {
+	exp, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	signed := url.Values{}
+	for name, values := range query {
+		if name != "kid" && name != "signature" {
+			signed[name] = values
+		}
+	}
+	kid := query.Get("kid")
+	if kid == "" {
+		kid = defaultSigningKeyID
+	}
+	return s.verify(kid, query.Get("signature"), scope, signed.Encode())
+}
+
+// ── File download URLs ──
+
+// fileDownloadURL returns a time-limited URL for a file's content: an S3 presigned URL,
+// or a URL to this service's /d/:fileId route on the local backend
+func fileDownloadURL(ctx context.Context, file *File, inline bool, expires time.Duration) (string, error) {
+	if downloadSigner == nil {
+		return blobStore.PresignGet(ctx, file.StorageKey, contentDisposition(inline, file.OriginalName), expires)
+	}
+	params := url.Values{}
+	if inline {
+		params.Set("inline", "1")
+	}
+	q := downloadSigner.signedQuery(http.MethodGet+" /d/"+file.FileID, params, expires)
+	return "/d/" + url.PathEscape(file.FileID) + "?" + q.Encode(), nil
+}
+
+func registerSignedDownloadRoutes(r *gin.Engine) {
+	r.GET("/d/:fileId", serveSignedDownload)
+	r.HEAD("/d/:fileId", serveSignedDownload)
+}
+
+func serveSignedDownload(c *gin.Context) {
+	fileID := c.Param("fileId")
+	if downloadSigner == nil || !downloadSigner.verifyQuery(http.MethodGet+" /d/"+fileID, c.Request.URL.Query()) {
+		c.JSON(403, gin.H{"error": "invalid or expired signature"})
+		return
+	}
+	var file File
+	if err := filesCol.FindOne(c.Request.Context(), bson.M{"file_id": fileID, "deleted_at": nil}).Decode(&file); err != nil {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	// A URL issued before the file was quarantined must stop working
+	if rejectQuarantined(c, &file) {
+		return
+	}
+	serveFileContent(c, &file, c.Query("inline") == "1")
+}
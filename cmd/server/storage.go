@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrBlobNotFound is returned when a storage key does not exist in the backend
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored object
+type BlobInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// BlobStore is the storage backend used by every handler that touches file content.
+// Put accepts a size of -1 for streamed bodies whose length is not known upfront.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error)
+	PresignGet(ctx context.Context, key, disposition string, expires time.Duration) (string, error)
+	URL(key string) string
+}
+
+var blobStore BlobStore
+
+// initBlobStore selects the storage backend from STORAGE_BACKEND (s3 or local)
+func initBlobStore(ctx context.Context) {
+	backend := getEnv("STORAGE_BACKEND", "s3")
+	if backend == "s3" {
+		store, err := newS3BlobStore(ctx, getEnv("S3_BUCKET", "quckapp-files"), getEnv("AWS_REGION", "us-east-1"))
+		if err == nil {
+			blobStore = store
+			log.Infof("Using S3 storage backend (bucket %s)", store.bucket)
+			return
+		}
+		log.Warnf("Failed to load AWS config: %v (falling back to local storage)", err)
+	}
+
+	downloadSigner = loadURLSigner()
+	blobStore = &localBlobStore{root: getEnv("LOCAL_STORAGE_DIR", "uploads"), signer: downloadSigner}
+	log.Infof("Using local storage backend (%s)", getEnv("LOCAL_STORAGE_DIR", "uploads"))
+}
+
+// copyBlob duplicates an object under a new key through the configured backend
+func copyBlob(ctx context.Context, srcKey, dstKey string) error {
+	info, err := blobStore.Stat(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	body, err := blobStore.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return blobStore.Put(ctx, dstKey, body, info.Size, info.ContentType)
+}
+
+// ── S3 backend ──
+
+type s3BlobStore struct {
+	client   *s3.Client
+	presign  *s3.PresignClient
+	uploader *manager.Uploader
+	bucket   string
+}
+
+func newS3BlobStore(ctx context.Context, bucket, region string) (*s3BlobStore, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(awsCfg)
+	// Streamed bodies are buffered one part at a time, so memory per upload stays
+	// at roughly PartSize * Concurrency regardless of the object size.
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = 8 * 1024 * 1024
+		u.Concurrency = 2
+	})
+	return &s3BlobStore{client: client, presign: s3.NewPresignClient(client), uploader: uploader, bucket: bucket}, nil
+}
+
+// Put uploads body through the multipart uploader; size may be -1 when unknown
+func (s *s3BlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3NotFound(err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3BlobStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, s3NotFound(err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3NotFound(err)
+	}
+	info := &BlobInfo{
+		Key:         key,
+		Size:        aws.ToInt64(out.ContentLength),
+		ContentType: aws.ToString(out.ContentType),
+		ETag:        strings.Trim(aws.ToString(out.ETag), `"`),
+	}
+	if out.LastModified != nil {
+		info.LastModified = *out.LastModified
+	}
+	return info, nil
+}
+
+func (s *s3BlobStore) PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error) {
+	req, err := s.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3BlobStore) PresignGet(ctx context.Context, key, disposition string, expires time.Duration) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+	req, err := s.presign.PresignGetObject(ctx, input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3BlobStore) URL(key string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, key)
+}
+
+func s3NotFound(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noKey) || errors.As(err, &notFound) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// ── Local filesystem backend ──
+
+type localBlobStore struct {
+	root   string
+	signer *urlSigner
+}
+
+func (l *localBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean)), nil
+}
+
+func (l *localBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (l *localBlobStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	body, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f := body.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (l *localBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *localBlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  detectMimeType(key),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (l *localBlobStore) PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error) {
+	return l.signedURL(http.MethodPut, key, "", expires), nil
+}
+
+func (l *localBlobStore) PresignGet(ctx context.Context, key, disposition string, expires time.Duration) (string, error) {
+	return l.signedURL(http.MethodGet, key, disposition, expires), nil
+}
+
+func (l *localBlobStore) URL(key string) string {
+	return "/uploads/" + key
+}
+
+func (l *localBlobStore) signedURL(method, key, disposition string, expires time.Duration) string {
+	params := url.Values{}
+	if disposition != "" {
+		params.Set("disposition", disposition)
+	}
+	return l.URL(key) + "?" + l.signer.signedQuery(method+" "+key, params, expires).Encode()
+}
+
+func (l *localBlobStore) verify(c *gin.Context, key string) bool {
+	return l.signer.verifyQuery(c.Request.Method+" "+key, c.Request.URL.Query())
+}
+
+// ── Local backend routes ──
+
+// registerLocalStorageRoutes serves presigned GET/PUT URLs issued by the local backend
+func registerLocalStorageRoutes(r *gin.Engine) {
+	r.GET("/uploads/*key", serveLocalBlob)
+	r.PUT("/uploads/*key", receiveLocalBlob)
+}
+
+func serveLocalBlob(c *gin.Context) {
+	store, ok := blobStore.(*localBlobStore)
+	if !ok {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !store.verify(c, key) {
+		c.JSON(403, gin.H{"error": "invalid or expired signature"})
+		return
+	}
+	p, err := store.path(key)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to read file"})
+		return
+	}
+	if d := c.Query("disposition"); d != "" {
+		c.Header("Content-Disposition", d)
+	}
+	c.Header("Content-Type", detectMimeType(key))
+	http.ServeContent(c.Writer, c.Request, fi.Name(), fi.ModTime(), f)
+}
+
+func receiveLocalBlob(c *gin.Context) {
+	store, ok := blobStore.(*localBlobStore)
+	if !ok {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !store.verify(c, key) {
+		c.JSON(403, gin.H{"error": "invalid or expired signature"})
+		return
+	}
+	// Return an MD5 ETag like S3 does, which multipart clients echo back on completion
+	hasher := md5.New()
+	if err := store.Put(c.Request.Context(), key, io.TeeReader(c.Request.Body, hasher), c.Request.ContentLength, c.ContentType()); err != nil {
+		log.Errorf("Failed to store presigned upload: %v", err)
+		c.JSON(500, gin.H{"error": "failed to store file"})
+		return
+	}
+	c.Header("ETag", `"`+hex.EncodeToString(hasher.Sum(nil))+`"`)
+	c.Status(200)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails are generated off the upload path by a worker consuming file.uploaded
+// events. Each configured size is the longest edge in pixels; the results are
+// stored at thumbnails/<file_id>/<size>.<ext> and recorded as FilePreview documents.
+// Storage is private, so they are served by GET /:id/thumbnail to callers who can
+// read the file, and that route is what preview and thumbnail URLs point at.
+//
+//	THUMBNAIL_SIZES   comma-separated edge lengths (default "128,512")
+//	THUMBNAIL_FORMAT  jpeg or webp (default jpeg; webp is lossless)
+//	THUMBNAIL_QUALITY JPEG quality 1-100 (default 80)
+
+const (
+	thumbnailConsumerGroup = "file-service-thumbnails"
+	// Larger sources are skipped rather than decoded into memory
+	maxThumbnailSourcePixels = 50 * 1000 * 1000
+	maxThumbnailSourceBytes  = 64 << 20
+)
+
+var (
+	thumbnailSizes   = []int{128, 512}
+	thumbnailFormat  = "jpeg"
+	thumbnailQuality = 80
+)
+
+// thumbnailSourceTypes are the image types the pure Go decoders can read
+var thumbnailSourceTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func initThumbnails() {
+	if v := getEnv("THUMBNAIL_SIZES", ""); v != "" {
+		var sizes []int
+		for _, s := range strings.Split(v, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || size <= 0 {
+				log.Warnf("Ignoring invalid thumbnail size %q", s)
+				continue
+			}
+			sizes = append(sizes, size)
+		}
+		if len(sizes) > 0 {
+			sort.Ints(sizes)
+			thumbnailSizes = sizes
+		}
+	}
+	switch f := getEnv("THUMBNAIL_FORMAT", "jpeg"); f {
+	case "jpeg", "webp":
+		thumbnailFormat = f
+	default:
+		log.Warnf("Unknown THUMBNAIL_FORMAT %q, using jpeg", f)
+	}
+	if v := getEnv("THUMBNAIL_QUALITY", ""); v != "" {
+		if q, err := strconv.Atoi(v); err == nil && q >= 1 && q <= 100 {
+			thumbnailQuality = q
+		} else {
+			log.Warnf("Invalid THUMBNAIL_QUALITY %q, using %d", v, thumbnailQuality)
+		}
+	}
+}
+
+func runThumbnailWorker(ctx context.Context) {
+	runEventConsumer(ctx, thumbnailConsumerGroup, []string{"file.uploaded", "file.version_created"}, handleThumbnailEvent)
+}
+
+func handleThumbnailEvent(ctx context.Context, event FileEvent) error {
+	var file File
+	err := filesCol.FindOne(ctx, bson.M{"file_id": event.FileID, "deleted_at": nil}).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if file.FileType != "image" || !thumbnailSourceTypes[file.MimeType] {
+		return nil
+	}
+	return generateThumbnails(ctx, &file)
+}
+
+// generateThumbnails renders every configured size of an image file, stores them and
+// records them as the file's previews, replacing any generated earlier
+func generateThumbnails(ctx context.Context, file *File) error {
+	if file.Size > maxThumbnailSourceBytes {
+		log.WithField("file_id", file.FileID).Warnf("Skipping thumbnails for %d byte image", file.Size)
+		return nil
+	}
+	body, err := blobStore.Get(ctx, file.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Read only the header until the dimensions are known to be acceptable
+	var data bytes.Buffer
+	limited := io.LimitReader(body, maxThumbnailSourceBytes+1)
+	cfg, _, err := image.DecodeConfig(io.TeeReader(limited, &data))
+	if err != nil {
+		return fmt.Errorf("decode image header: %w", err)
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		log.WithField("file_id", file.FileID).Warnf("Skipping thumbnails for %dx%d image", cfg.Width, cfg.Height)
+		return nil
+	}
+	if _, err := io.Copy(&data, limited); err != nil {
+		return err
+	}
+	if data.Len() > maxThumbnailSourceBytes {
+		log.WithField("file_id", file.FileID).Warnf("Skipping thumbnails for image over %d bytes", maxThumbnailSourceBytes)
+		return nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+
+	// Thumbnails are rendered upright; the EXIF orientation is applied after scaling
+	orientation := imageOrientation(data.Bytes())
+	width, height := cfg.Width, cfg.Height
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	ext, contentType := "jpg", "image/jpeg"
+	if thumbnailFormat == "webp" {
+		ext, contentType = "webp", "image/webp"
+	}
+
+	now := time.Now()
+	var previews []interface{}
+	var smallestURL string
+	seen := map[image.Point]bool{}
+	for _, size := range thumbnailSizes {
+		w, h := fitWithin(width, height, size)
+		// Sources smaller than several sizes would produce identical thumbnails
+		if seen[image.Pt(w, h)] {
+			continue
+		}
+		seen[image.Pt(w, h)] = true
+
+		var buf bytes.Buffer
+		if err := encodeThumbnail(&buf, renderThumbnail(src, w, h, orientation)); err != nil {
+			return fmt.Errorf("encode thumbnail: %w", err)
+		}
+		key := fmt.Sprintf("thumbnails/%s/%d.%s", file.FileID, size, ext)
+		if err := blobStore.Put(ctx, key, &buf, int64(buf.Len()), contentType); err != nil {
+			return fmt.Errorf("store thumbnail: %w", err)
+		}
+
+		url := thumbnailURL(file.FileID, size)
+		if smallestURL == "" {
+			smallestURL = url
+		}
+		previews = append(previews, FilePreview{
+			FileID:       file.FileID,
+			PreviewURL:   url,
+			ThumbnailURL: smallestURL,
+			PreviewType:  contentType,
+			Size:         size,
+			Width:        w,
+			Height:       h,
+			StorageKey:   key,
+			GeneratedAt:  now,
+		})
+	}
+
+	if _, err := previewsCol().DeleteMany(ctx, bson.M{"file_id": file.FileID}); err != nil {
+		return err
+	}
+	if _, err := previewsCol().InsertMany(ctx, previews); err != nil {
+		return err
+	}
+	_, err = filesCol.UpdateOne(ctx, bson.M{"file_id": file.FileID}, bson.M{"$set": bson.M{
+		"thumbnail_url":   smallestURL,
+		"metadata.width":  cfg.Width,
+		"metadata.height": cfg.Height,
+		"updated_at":      now,
+	}})
+	if err != nil {
+		return err
+	}
+	redisClient.Del(ctx, "file:"+file.FileID)
+
+	log.WithField("file_id", file.FileID).Infof("Generated %d thumbnails", len(previews))
+	return nil
+}
+
+// thumbnailURL is where a file's thumbnail of the given size is served
+func thumbnailURL(fileID string, size int) string {
+	return "/api/v1/files/" + url.PathEscape(fileID) + "/thumbnail?size=" + strconv.Itoa(size)
+}
+
+// getThumbnail serves one of a file's thumbnails: ?size=N picks the configured size,
+// the smallest is served by default
+func getThumbnail(c *gin.Context) {
+	file := authorizedFile(c, c.Param("id"), permRead)
+	if file == nil || rejectQuarantined(c, file) {
+		return
+	}
+	ctx := c.Request.Context()
+	filter := bson.M{"file_id": file.FileID, "storage_key": bson.M{"$exists": true}}
+	if v := c.Query("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid size"})
+			return
+		}
+		filter["size"] = size
+	}
+	var preview FilePreview
+	err := previewsCol().FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "width", Value: 1}})).Decode(&preview)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(404, gin.H{"error": "thumbnail not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to load thumbnail"})
+		return
+	}
+	info, err := blobStore.Stat(ctx, preview.StorageKey)
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(404, gin.H{"error": "thumbnail not found"})
+		return
+	}
+	if err != nil {
+		contentReadFailed(c, preview.StorageKey, err)
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Header("X-Content-Type-Options", "nosniff")
+	sendBlob(c, preview.StorageKey, nil, info.Size, preview.PreviewType, 200)
+}
+
+// fitWithin scales width x height down so the longest edge is at most size; images
+// are never scaled up
+func fitWithin(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		h := height * size / width
+		if h < 1 {
+			h = 1
+		}
+		return size, h
+	}
+	w := width * size / height
+	if w < 1 {
+		w = 1
+	}
+	return w, size
+}
+
+// imageOrientation returns the EXIF orientation of an encoded image, 1 if it has none
+func imageOrientation(data []byte) int {
+	var meta FileMetadata
+	if tiff := findExif(bytes.NewReader(data), int64(len(data))); tiff != nil {
+		parseExif(tiff, &meta)
+	}
+	if meta.Orientation == nil {
+		return 1
+	}
+	return *meta.Orientation
+}
+
+// renderThumbnail scales src so that, once orientation is applied, it is width x height
+func renderThumbnail(src image.Image, width, height, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return resizeImage(src, width, height)
+	}
+	if orientation >= 5 {
+		return applyOrientation(resizeImage(src, height, width), orientation)
+	}
+	return applyOrientation(resizeImage(src, width, height), orientation)
+}
+
+func resizeImage(src image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if thumbnailFormat == "jpeg" {
+		// JPEG has no alpha; flatten transparency onto white instead of black
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+func encodeThumbnail(w io.Writer, img image.Image) error {
+	if thumbnailFormat == "webp" {
+		return nativewebp.Encode(w, img, nil)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: thumbnailQuality})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFitWithin(t *testing.T) {
+	tests := []struct{ w, h, size, wantW, wantH int }{
+		{4000, 3000, 512, 512, 384},
+		{3000, 4000, 512, 384, 512},
+		{100, 50, 512, 100, 50},
+		{10000, 1, 128, 128, 1},
+	}
+	for _, tt := range tests {
+		if w, h := fitWithin(tt.w, tt.h, tt.size); w != tt.wantW || h != tt.wantH {
+			t.Errorf("fitWithin(%d, %d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.size, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestImageOrientation(t *testing.T) {
+	if got := imageOrientation(sampleExifJPEG()); got != 6 {
+		t.Fatalf("orientation = %d, want 6", got)
+	}
+	if got := imageOrientation([]byte{0xFF, 0xD8, 0xFF, 0xD9}); got != 1 {
+		t.Fatalf("orientation without EXIF = %d, want 1", got)
+	}
+}
+
+func TestRenderThumbnailOrientation(t *testing.T) {
+	// A landscape sensor image whose top row is red, taken with the camera rotated:
+	// orientation 6 displays it portrait with the red edge on the right
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			c := color.RGBA{B: 255, A: 255}
+			if y < 10 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	img := renderThumbnail(src, 10, 20, 6)
+	if b := img.Bounds(); b.Dx() != 10 || b.Dy() != 20 {
+		t.Fatalf("thumbnail is %dx%d, want 10x20", b.Dx(), b.Dy())
+	}
+	if r, _, _, _ := img.At(9, 10).RGBA(); r < 0x8000 {
+		t.Fatal("expected the red edge on the right")
+	}
+	if r, _, _, _ := img.At(0, 10).RGBA(); r >= 0x8000 {
+		t.Fatal("expected the blue edge on the left")
+	}
+}
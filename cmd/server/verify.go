@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// UploadVerificationError describes why a client-uploaded object was rejected
+type UploadVerificationError struct {
+	Status  int
+	Message string
+}
+
+func (e *UploadVerificationError) Error() string { return e.Message }
+
+// VerifiedUpload holds the facts established by re-reading the stored object
+type VerifiedUpload struct {
+	Size     int64
+	Checksum string
+	Content  *ContentClassification
+}
+
+// verifyStoredUpload checks an object uploaded directly to storage against its
+// pending session: it must exist, match the declared size and content type, and
+// match the client checksum when one was supplied. The SHA-256 is always
+// computed server-side from a streamed re-read of the object.
+func verifyStoredUpload(ctx context.Context, pending PendingUpload, clientChecksum string) (*VerifiedUpload, error) {
+	info, err := blobStore.Stat(ctx, pending.StorageKey)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, &UploadVerificationError{Status: 409, Message: "uploaded object not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size != pending.Size {
+		return nil, &UploadVerificationError{Status: 422, Message: fmt.Sprintf("size mismatch: declared %d bytes, stored %d bytes", pending.Size, info.Size)}
+	}
+
+	body, err := blobStore.Get(ctx, pending.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	hasher := sha256.New()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(io.TeeReader(body, hasher), head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := io.Copy(hasher, body); err != nil {
+		return nil, err
+	}
+
+	verified := &VerifiedUpload{
+		Size:     info.Size,
+		Checksum: hex.EncodeToString(hasher.Sum(nil)),
+	}
+	if clientChecksum != "" && !strings.EqualFold(clientChecksum, verified.Checksum) {
+		return nil, &UploadVerificationError{Status: 422, Message: "checksum mismatch"}
+	}
+	verified.Content, err = classifyUpload(head[:n], pending.Filename, pending.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	policy := getUploadPolicy(ctx, pending.WorkspaceID)
+	if _, err := policy.Check(pending.Filename, verified.Content.MimeType, verified.Size); err != nil {
+		return nil, err
+	}
+	return verified, nil
+}
+
+// discardUpload removes what a rejected direct-to-storage upload left behind: the
+// stored object, the given session keys and the quota reservation
+func discardUpload(ctx context.Context, pending PendingUpload, sessionKeys ...string) {
+	if err := blobStore.Delete(ctx, pending.StorageKey); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		log.WithField("storage_key", pending.StorageKey).Warnf("Failed to delete rejected upload: %v", err)
+	}
+	if len(sessionKeys) > 0 {
+		redisClient.Del(ctx, sessionKeys...)
+	}
+	releaseQuota(ctx, pending.FileID)
+}
+
+// applyContent records the classified content type on a pending upload
+func (p *PendingUpload) applyContent(content *ContentClassification) {
+	p.ContentType = content.MimeType
+	p.DetectedMimeType = content.DetectedMimeType
+	p.FileType = content.FileType
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A file always points at its current content. Replacing the content first records the
+// content being replaced as a FileVersion, which takes over its blob, and then swaps the
+// file over to the new blob in a single conditional update. Every blob belongs to exactly
+// one file or version and is charged to the quota of the workspace and owner it was
+// stored for, until that file or version is deleted.
+
+// fileContent is a stored blob about to become a file's current content
+type fileContent struct {
+	StorageKey       string
+	Size             int64
+	Checksum         string
+	OriginalChecksum string
+	MimeType         string
+	DetectedMimeType string
+	FileType         string
+}
+
+// versionStorageKey returns a fresh key for a new blob of file's content
+func versionStorageKey(file *File) string {
+	return fmt.Sprintf("files/%s/%s/%s/%s%s", file.WorkspaceID, file.UploadedBy, file.FileID, uuid.New().String(), filepath.Ext(file.OriginalName))
+}
+
+// snapshotVersion describes file's current content as a version stored at storageKey,
+// numbered from the file's version counter
+func snapshotVersion(ctx context.Context, file *File, storageKey, comment string) (FileVersion, error) {
+	versionNum, err := allocateVersionNum(ctx, file)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	uploadedBy := file.UploadedBy
+	if file.ModifiedBy != "" {
+		uploadedBy = file.ModifiedBy
+	}
+	return FileVersion{
+		FileID:           file.FileID,
+		VersionNum:       versionNum,
+		WorkspaceID:      file.WorkspaceID,
+		OwnerID:          file.UploadedBy,
+		StorageKey:       storageKey,
+		Size:             file.Size,
+		Checksum:         file.Checksum,
+		MimeType:         file.MimeType,
+		DetectedMimeType: file.DetectedMimeType,
+		FileType:         file.FileType,
+		UploadedBy:       uploadedBy,
+		Comment:          comment,
+		CreatedAt:        time.Now(),
+	}, nil
+}
+
+// replaceFileContent makes content the file's current content, keeping what it replaces
+// as a new version. It returns errFileChanged, leaving everything as it was, if the file
+// was modified since it was loaded. The caller keeps ownership of the new blob on failure.
+func replaceFileContent(ctx context.Context, file *File, content fileContent, userID, comment string) (*FileVersion, error) {
+	version, err := snapshotVersion(ctx, file, file.StorageKey, comment)
+	if err != nil {
+		return nil, err
+	}
+	result, err := versionsCol().InsertOne(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	version.ID = result.InsertedID.(primitive.ObjectID)
+
+	now := time.Now()
+	err = updateFileRevision(ctx, file, bson.M{"$set": bson.M{
+		"storage_key":        content.StorageKey,
+		"url":                blobStore.URL(content.StorageKey),
+		"size":               content.Size,
+		"checksum":           content.Checksum,
+		"original_checksum":  content.OriginalChecksum,
+		"mime_type":          content.MimeType,
+		"detected_mime_type": content.DetectedMimeType,
+		"file_type":          content.FileType,
+		"metadata":           FileMetadata{},
+		"thumbnail_url":      nil,
+		"modified_by":        userID,
+		"updated_at":         now,
+	}})
+	if err != nil {
+		versionsCol().DeleteOne(context.Background(), bson.M{"_id": version.ID})
+		return nil, err
+	}
+
+	// Previews of the old content are regenerated by the thumbnail worker if still applicable
+	previewsCol().DeleteMany(ctx, bson.M{"file_id": file.FileID})
+	logFileActivity(ctx, file.FileID, userID, "version_created", strconv.Itoa(version.VersionNum))
+	publishEvent(FileEvent{
+		Type:        "file.version_created",
+		FileID:      file.FileID,
+		WorkspaceID: file.WorkspaceID,
+		UserID:      userID,
+		Data: map[string]interface{}{
+			"version_id":  version.ID.Hex(),
+			"version_num": version.VersionNum,
+			"size":        content.Size,
+			"mime_type":   content.MimeType,
+		},
+		Timestamp: now,
+	})
+	return &version, nil
+}
+
+// deleteFileVersion removes a version and its blob, crediting the blob's bytes back to
+// the quota it was charged to, and returns the bytes credited
+func deleteFileVersion(ctx context.Context, version *FileVersion) (int64, error) {
+	result, err := versionsCol().DeleteOne(ctx, bson.M{"_id": version.ID})
+	if err != nil || result.DeletedCount == 0 {
+		return 0, err
+	}
+	if version.StorageKey == "" {
+		return 0, nil
+	}
+	// Versions restored before content was versioned may share their blob with the file
+	if n, err := filesCol.CountDocuments(ctx, bson.M{"storage_key": version.StorageKey}); err != nil || n > 0 {
+		return 0, err
+	}
+	if err := blobStore.Delete(ctx, version.StorageKey); err != nil {
+		log.Warnf("Failed to delete version blob %s: %v", version.StorageKey, err)
+	}
+	if version.WorkspaceID == "" {
+		return 0, nil
+	}
+	settleQuota(ctx, version.ID.Hex(), version.WorkspaceID, version.OwnerID, -version.Size)
+	return version.Size, nil
+}
+
+// ── Handlers ──
+
+// createVersion uploads new content for a file as multipart/form-data (a "file" part,
+// optionally preceded by a "comment" field). A JSON body instead checkpoints the
+// current content as a version without changing it.
+func createVersion(c *gin.Context) {
+	file := authorizedFile(c, c.Param("id"), permEdit)
+	if file == nil || rejectQuarantined(c, file) || rejectLocked(c, file) || !checkIfMatch(c, file) {
+		return
+	}
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		uploadVersion(c, file)
+		return
+	}
+	checkpointVersion(c, file)
+}
+
+func uploadVersion(c *gin.Context, file *File) {
+	ctx := c.Request.Context()
+	fields, part, ok := readUploadPart(c)
+	if !ok {
+		return
+	}
+	defer part.Close()
+
+	content, classified, ok := classifyUploadPart(c, part)
+	if !ok {
+		return
+	}
+	filename := part.FileName()
+	if filename == "" {
+		filename = file.OriginalName
+	}
+	policy := getUploadPolicy(ctx, file.WorkspaceID)
+	fileType, err := policy.Check(filename, classified.MimeType, -1)
+	if err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	maxSize := policy.MaxSize(fileType)
+	if c.Request.ContentLength > 0 && c.Request.ContentLength > maxSize+1024*1024 {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("file too large, max size is %d MB", maxSize/(1024*1024))})
+		return
+	}
+
+	// New content is charged to the file's workspace and owner like the original upload
+	reservationID := uuid.New().String()
+	reserve := maxSize
+	if c.Request.ContentLength > 0 && c.Request.ContentLength < reserve {
+		reserve = c.Request.ContentLength
+	}
+	if err := reserveQuota(ctx, reservationID, file.WorkspaceID, file.UploadedBy, reserve, time.Hour); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	defer releaseQuota(context.Background(), reservationID)
+
+	storageKey := versionStorageKey(file)
+	stored, ok := storeUpload(c, content, storageKey, classified.MimeType, policy, maxSize)
+	if !ok {
+		return
+	}
+	if stored.Checksum == file.Checksum {
+		blobStore.Delete(ctx, storageKey)
+		c.JSON(200, gin.H{"success": true, "data": file, "unchanged": true})
+		return
+	}
+
+	version, err := replaceFileContent(ctx, file, fileContent{
+		StorageKey:       storageKey,
+		Size:             stored.Size,
+		Checksum:         stored.Checksum,
+		OriginalChecksum: stored.OriginalChecksum,
+		MimeType:         classified.MimeType,
+		DetectedMimeType: classified.DetectedMimeType,
+		FileType:         fileType,
+	}, currentUserID(c), fields["comment"])
+	if err != nil {
+		blobStore.Delete(context.Background(), storageKey)
+		respondUpdateError(c, err, "failed to save version")
+		return
+	}
+	commitQuota(ctx, reservationID, file.WorkspaceID, file.UploadedBy, stored.Size)
+	c.Header("ETag", revisionETag(file.Revision))
+
+	log.WithFields(logrus.Fields{"file_id": file.FileID, "version_num": version.VersionNum, "size": stored.Size}).Info("File content replaced")
+	c.JSON(201, gin.H{"success": true, "data": version})
+}
+
+// checkpointVersion stores a copy of the file's current content as a version
+func checkpointVersion(c *gin.Context, file *File) {
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	c.ShouldBindJSON(&req)
+	ctx := c.Request.Context()
+
+	version, err := snapshotVersion(ctx, file, versionStorageKey(file), req.Comment)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "failed to save version"})
+		return
+	}
+	version.ID = primitive.NewObjectID()
+	quotaID := version.ID.Hex()
+	if err := reserveQuota(ctx, quotaID, file.WorkspaceID, file.UploadedBy, file.Size, time.Hour); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	defer releaseQuota(context.Background(), quotaID)
+	if err := copyBlob(ctx, file.StorageKey, version.StorageKey); err != nil {
+		log.Errorf("Failed to copy %s for version: %v", file.StorageKey, err)
+		c.JSON(500, gin.H{"error": "failed to save version"})
+		return
+	}
+	if _, err := versionsCol().InsertOne(ctx, version); err != nil {
+		blobStore.Delete(context.Background(), version.StorageKey)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	commitQuota(ctx, quotaID, file.WorkspaceID, file.UploadedBy, file.Size)
+	logFileActivity(ctx, file.FileID, currentUserID(c), "version_created", req.Comment)
+	c.JSON(201, gin.H{"success": true, "data": version})
+}
+
+func deleteVersion(c *gin.Context) {
+	versionID, err := primitive.ObjectIDFromHex(c.Param("versionId"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid version ID"})
+		return
+	}
+	if authorizedFile(c, c.Param("id"), permManage) == nil {
+		return
+	}
+	var version FileVersion
+	if err := versionsCol().FindOne(c.Request.Context(), bson.M{"_id": versionID, "file_id": c.Param("id")}).Decode(&version); err != nil {
+		c.JSON(404, gin.H{"error": "version not found"})
+		return
+	}
+	if _, err := deleteFileVersion(c.Request.Context(), &version); err != nil {
+		c.JSON(500, gin.H{"error": "failed to delete version"})
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+// restoreVersion makes a copy of an earlier version's content the file's current
+// content. The content it replaces is kept as a new version, so a restore can be undone.
+func restoreVersion(c *gin.Context) {
+	versionID, err := primitive.ObjectIDFromHex(c.Param("versionId"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid version ID"})
+		return
+	}
+	file := authorizedFile(c, c.Param("id"), permEdit)
+	if file == nil || rejectQuarantined(c, file) || rejectLocked(c, file) || !checkIfMatch(c, file) {
+		return
+	}
+	ctx := c.Request.Context()
+	var version FileVersion
+	if err := versionsCol().FindOne(ctx, bson.M{"_id": versionID, "file_id": file.FileID}).Decode(&version); err != nil {
+		c.JSON(404, gin.H{"error": "version not found"})
+		return
+	}
+	if version.StorageKey == "" {
+		c.JSON(409, gin.H{"error": "version content not available"})
+		return
+	}
+
+	quotaID := uuid.New().String()
+	if err := reserveQuota(ctx, quotaID, file.WorkspaceID, file.UploadedBy, version.Size, time.Hour); err != nil {
+		respondPolicyError(c, err)
+		return
+	}
+	defer releaseQuota(context.Background(), quotaID)
+	storageKey := versionStorageKey(file)
+	if err := copyBlob(ctx, version.StorageKey, storageKey); err != nil {
+		log.Errorf("Failed to copy version %s: %v", version.StorageKey, err)
+		c.JSON(409, gin.H{"error": "version content not available"})
+		return
+	}
+
+	mimeType, fileType := version.MimeType, version.FileType
+	if mimeType == "" {
+		mimeType, fileType = file.MimeType, file.FileType
+	}
+	created, err := replaceFileContent(ctx, file, fileContent{
+		StorageKey:       storageKey,
+		Size:             version.Size,
+		Checksum:         version.Checksum,
+		MimeType:         mimeType,
+		DetectedMimeType: version.DetectedMimeType,
+		FileType:         fileType,
+	}, currentUserID(c), "restored version "+strconv.Itoa(version.VersionNum))
+	if err != nil {
+		blobStore.Delete(context.Background(), storageKey)
+		respondUpdateError(c, err, "failed to save version")
+		return
+	}
+	commitQuota(ctx, quotaID, file.WorkspaceID, file.UploadedBy, version.Size)
+	c.Header("ETag", revisionETag(file.Revision))
+	logFileActivity(ctx, file.FileID, currentUserID(c), "version_restored", strconv.Itoa(version.VersionNum))
+	c.JSON(200, gin.H{"success": true, "message": "version restored", "data": created})
+}